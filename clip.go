@@ -0,0 +1,47 @@
+package xonacatl
+
+// Clip restricts the contents of a tile to the features which intersect a bounding box.
+//
+// Box is in longitude and latitude, and Tile is the requested tile, which is used to convert the box into tile units for MVT. If Geometries is set, then the geometries of the kept features are also cut down to the part inside the box, otherwise they are kept whole.
+type Clip struct {
+	Tile       TileCoord
+	Box        Box
+	Geometries bool
+}
+
+// tileBox returns the box in the tile units of the requested tile with the given extent. Note that the Y axis of tile units points down, so the maximum latitude gives the minimum Y.
+func (c *Clip) tileBox(extent uint32) Box {
+	ext := float64(extent)
+	x := float64(c.Tile.X)
+	y := float64(c.Tile.Y)
+	return Box{
+		MinX: (lonTileX(c.Box.MinX, c.Tile.Z) - x) * ext,
+		MinY: (latTileY(c.Box.MaxY, c.Tile.Z) - y) * ext,
+		MaxX: (lonTileX(c.Box.MaxX, c.Tile.Z) - x) * ext,
+		MaxY: (latTileY(c.Box.MinY, c.Tile.Z) - y) * ext,
+	}
+}
+
+// mvtTransform returns the clip transform for geometry in tile units with the given extent.
+func (c *Clip) mvtTransform(extent uint32) geometryTransform {
+	return c.transform(c.tileBox(extent))
+}
+
+// lonLatTransform returns the clip transform for geometry in longitude and latitude.
+func (c *Clip) lonLatTransform() geometryTransform {
+	return c.transform(c.Box)
+}
+
+func (c *Clip) transform(b Box) geometryTransform {
+	return func(g *Geometry) *Geometry {
+		if !g.Bounds().Intersects(b) {
+			return nil
+		}
+
+		clipped := g.ClipToBox(b)
+		if c.Geometries || clipped == nil {
+			return clipped
+		}
+		return g
+	}
+}
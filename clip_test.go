@@ -0,0 +1,121 @@
+package xonacatl
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	"github.com/tilezen/xonacatl/mapnik_vector"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClipTileBox(t *testing.T) {
+	// the north-east quarter of tile 1/1/0 is the part of the world east of 90 and north of about 66.5
+	c := &Clip{Tile: TileCoord{Z: 1, X: 1, Y: 0}, Box: Box{90, tileLat(0.5, 1), 180, 90}}
+	b := c.tileBox(4096)
+	if math.Abs(b.MinX-2048) > 1e-6 || math.Abs(b.MaxX-4096) > 1e-6 || math.Abs(b.MaxY-2048) > 1e-6 || b.MinY > 0 {
+		t.Fatalf("Unexpected tile box %#v", b)
+	}
+}
+
+func TestClipGeoJSON(t *testing.T) {
+	input := `{"roads":{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"LineString","coordinates":[[0,0],[20,0]]},"properties":{"name":"crosses"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[30,30]},"properties":{"name":"outside"}}]}}`
+	box := Box{-10, -10, 10, 10}
+
+	tests := []struct {
+		geometries bool
+		expected   string
+	}{
+		{false, `{"features":[{"geometry":{"coordinates":[[0,0],[20,0]],"type":"LineString"},"properties":{"name":"crosses"},"type":"Feature"}],"type":"FeatureCollection"}`},
+		{true, `{"features":[{"geometry":{"coordinates":[[0,0],[10,0]],"type":"LineString"},"properties":{"name":"crosses"},"type":"Feature"}],"type":"FeatureCollection"}`},
+	}
+
+	for _, test := range tests {
+		options := &CopyOptions{Clip: &Clip{Box: box, Geometries: test.geometries}}
+		var buf bytes.Buffer
+		err := NewCopyLayersWithOptions(map[string]bool{"roads": true}, options).CopyLayers(strings.NewReader(input), &buf)
+		if err != nil {
+			t.Fatalf("CopyLayers failed, error: %s", err.Error())
+		}
+		if buf.String() != test.expected {
+			t.Fatalf("Expected clipped output to be %#v, but was %#v", test.expected, buf.String())
+		}
+	}
+}
+
+func TestClipTopoJSON(t *testing.T) {
+	// arc 0 runs from (0,0) to (2,2) and arc 1 from (20,20) to (22,22), delta-encoded in quantized units of 0.5. the second line uses arc 1 reversed, with index ~1 = -2.
+	input := `{"type":"Topology","transform":{"scale":[0.5,0.5],"translate":[0,0]},"objects":{"foo":{"type":"GeometryCollection","geometries":[{"type":"LineString","arcs":[0]},{"type":"LineString","arcs":[-2]},{"type":"Point","coordinates":[2,2]},{"type":"Point","coordinates":[60,60]}]}},"arcs":[[[0,0],[4,4]],[[40,40],[4,4]]]}`
+	expected := `{"type":"Topology","transform":{"scale":[0.5,0.5],"translate":[0,0]},"objects":{"foo":{"geometries":[{"type":"LineString","arcs":[0]},{"type":"Point","coordinates":[2,2]}],"type":"GeometryCollection"}},"arcs":[[[0,0],[4,4]],[[40,40],[4,4]]]}`
+
+	options := &CopyOptions{Clip: &Clip{Box: Box{0, 0, 5, 5}}}
+	var buf bytes.Buffer
+	err := NewCopyTopoJSONLayersWithOptions(map[string]bool{"foo": true}, options).CopyLayers(strings.NewReader(input), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+
+	out := strings.TrimSpace(buf.String())
+	if out != expected {
+		t.Fatalf("Expected clipped output to be %#v, but was %#v", expected, out)
+	}
+}
+
+func TestClipMVT(t *testing.T) {
+	// a line across the top half of tile 0/0/0, and a point in the bottom half.
+	layer := &mapnik_vector.TileLayer{
+		Version: proto.Uint32(2),
+		Name:    proto.String("roads"),
+		Extent:  proto.Uint32(4096),
+		Features: []*mapnik_vector.TileFeature{{
+			Type:     mapnik_vector.Tile_LineString.Enum(),
+			Geometry: []uint32{9, 0, 2048, 10, 8192, 0},
+		}, {
+			Type:     mapnik_vector.Tile_Point.Enum(),
+			Geometry: []uint32{9, 4096, 6144},
+		}},
+	}
+	input, err := proto.Marshal(&mapnik_vector.Tile{Layers: []*mapnik_vector.TileLayer{layer}})
+	if err != nil {
+		t.Fatalf("Unable to marshal test tile: %s", err.Error())
+	}
+
+	// the eastern hemisphere, north of the equator.
+	options := &CopyOptions{Clip: &Clip{Tile: TileCoord{}, Box: Box{0, 0, 180, 85}, Geometries: true}}
+	var buf bytes.Buffer
+	err = NewCopyMVTLayersWithOptions(map[string]bool{"all": true}, options).CopyLayers(bytes.NewReader(input), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+
+	var out mapnik_vector.Tile
+	err = proto.Unmarshal(buf.Bytes(), &out)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal output tile: %s", err.Error())
+	}
+	if len(out.Layers[0].Features) != 1 {
+		t.Fatalf("Expected only the line to be kept, but got %d features", len(out.Layers[0].Features))
+	}
+
+	g, err := decodeMVTGeometry(out.Layers[0].Features[0].GetType(), out.Layers[0].Features[0].Geometry)
+	if err != nil {
+		t.Fatalf("Unable to decode output geometry: %s", err.Error())
+	}
+	expected := &Geometry{Type: "LineString", Lines: [][]Point{{{2048, 1024}, {4096, 1024}}}}
+	if !reflect.DeepEqual(g, expected) {
+		t.Fatalf("Expected clipped geometry to be %#v, but was %#v", expected, g)
+	}
+}
+
+func TestTopoJSONPositionsIgnoresMalformed(t *testing.T) {
+	var g topoJSONGeometry
+	err := json.Unmarshal([]byte(`{"type":"LineString","arcs":[5]}`), &g)
+	if err != nil {
+		t.Fatalf("Unable to parse geometry: %s", err.Error())
+	}
+	if !(&topoJSONPositions{}).geometry(&g).isEmpty() {
+		t.Fatalf("Expected geometry with out of range arc to have no positions")
+	}
+}
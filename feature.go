@@ -0,0 +1,36 @@
+package xonacatl
+
+// Feature is the information about a single feature in a tile which is available to a FeatureFilter, independent of the tile format.
+//
+// GeometryType is one of "Point", "LineString", "Polygon" or "Unknown", with multi-geometries reported as their single counterpart. Property values are strings, float64 numbers or bools. Id is nil if the feature has no ID.
+type Feature struct {
+	Layer        string
+	GeometryType string
+	Id           interface{}
+	Properties   map[string]interface{}
+}
+
+// FeatureFilter decides whether a feature should be kept in the output.
+type FeatureFilter interface {
+	KeepFeature(f *Feature) bool
+}
+
+// FeatureFilterFunc adapts a function to the FeatureFilter interface.
+type FeatureFilterFunc func(f *Feature) bool
+
+func (fn FeatureFilterFunc) KeepFeature(f *Feature) bool {
+	return fn(f)
+}
+
+// baseGeometryType returns the single geometry type name for a GeoJSON geometry type, so that multi-geometries are reported the same as single ones.
+func baseGeometryType(typ string) string {
+	switch typ {
+	case "Point", "MultiPoint":
+		return "Point"
+	case "LineString", "MultiLineString":
+		return "LineString"
+	case "Polygon", "MultiPolygon":
+		return "Polygon"
+	}
+	return "Unknown"
+}
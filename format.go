@@ -0,0 +1,67 @@
+package xonacatl
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// CopierFactory returns a LayerCopier which keeps the given layers, applying the options, which may be nil.
+type CopierFactory func(layers map[string]bool, options *CopyOptions) LayerCopier
+
+// Format describes a tile format which xonacatl can copy layers from.
+//
+// Extension is the file extension used for the format in tile URLs, without the dot, and ContentType is the MIME type of tiles in the format. NewCopier makes the LayerCopier for a request.
+//
+// VectorLayers is optional, and reads a tile to describe its layers for TileJSON. Transforms should be true only if the format's copiers apply the geometry transforms in CopyOptions, such as Overzoom, so that the format can be overzoomed. Rounds should be true only if they round coordinates to the Precision in CopyOptions, so that the option isn't set for formats which would ignore it.
+type Format struct {
+	Extension    string
+	ContentType  string
+	NewCopier    CopierFactory
+	VectorLayers func(io.Reader) ([]VectorLayer, error)
+	Transforms   bool
+	Rounds       bool
+}
+
+var (
+	formatsLock sync.RWMutex
+	formats     = make(map[string]*Format)
+)
+
+// RegisterFormat makes a format available by its extension. It is intended to be called from init functions, and panics if the format is incomplete or its extension is already registered, as with database/sql drivers.
+func RegisterFormat(f *Format) {
+	if f == nil || len(f.Extension) == 0 || f.NewCopier == nil {
+		panic("xonacatl: RegisterFormat needs a format with an extension and copier factory")
+	}
+
+	formatsLock.Lock()
+	defer formatsLock.Unlock()
+
+	if _, dup := formats[f.Extension]; dup {
+		panic(fmt.Sprintf("xonacatl: RegisterFormat called twice for extension %#v", f.Extension))
+	}
+	formats[f.Extension] = f
+}
+
+// FormatFor returns the format registered for the extension, or false if there isn't one.
+func FormatFor(extension string) (*Format, bool) {
+	formatsLock.RLock()
+	defer formatsLock.RUnlock()
+
+	f, ok := formats[extension]
+	return f, ok
+}
+
+// Formats returns the extensions of all the registered formats, sorted.
+func Formats() []string {
+	formatsLock.RLock()
+	defer formatsLock.RUnlock()
+
+	extensions := make([]string, 0, len(formats))
+	for ext := range formats {
+		extensions = append(extensions, ext)
+	}
+	sort.Strings(extensions)
+	return extensions
+}
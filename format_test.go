@@ -0,0 +1,71 @@
+package xonacatl
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinFormats(t *testing.T) {
+	expected := []string{"json", "mvt", "mvtb", "topojson"}
+	for _, ext := range expected {
+		f, ok := FormatFor(ext)
+		if !ok {
+			t.Fatalf("Expected built-in format %#v to be registered", ext)
+		}
+		if f.NewCopier(map[string]bool{"water": true}, nil) == nil {
+			t.Fatalf("Expected format %#v to make a copier", ext)
+		}
+	}
+
+	if _, ok := FormatFor("geobuf"); ok {
+		t.Fatalf("Didn't expect an unknown format to be registered")
+	}
+}
+
+// upperCopier is a toy format which upper-cases the whole tile.
+type upperCopier struct{}
+
+func (_ *upperCopier) CopyLayers(rd io.Reader, wr io.Writer) error {
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(rd)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(wr, strings.ToUpper(buf.String()))
+	return err
+}
+
+func TestRegisterFormat(t *testing.T) {
+	RegisterFormat(&Format{
+		Extension:   "test-upper",
+		ContentType: "text/plain",
+		NewCopier: func(layers map[string]bool, options *CopyOptions) LayerCopier {
+			return &upperCopier{}
+		},
+	})
+
+	f, ok := FormatFor("test-upper")
+	if !ok {
+		t.Fatalf("Expected registered format to be found")
+	}
+
+	var buf bytes.Buffer
+	err := f.NewCopier(nil, nil).CopyLayers(strings.NewReader("tile"), &buf)
+	if err != nil || buf.String() != "TILE" {
+		t.Fatalf("Expected registered copier to be used, but got %#v, error %v", buf.String(), err)
+	}
+
+	_, err = VectorLayersFor("test-upper", strings.NewReader("tile"))
+	if err == nil {
+		t.Fatalf("Expected format without vector layers to be an error")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected registering a duplicate extension to panic")
+		}
+	}()
+	RegisterFormat(&Format{Extension: "json", NewCopier: f.NewCopier})
+}
@@ -0,0 +1,83 @@
+package xonacatl
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// decodeGeoJSONGeometry decodes a GeoJSON geometry object. It returns nil, without an error, for geometry types which can't be represented as a Geometry, such as GeometryCollection, so that the caller can leave them unchanged.
+func decodeGeoJSONGeometry(raw json.RawMessage) (*Geometry, error) {
+	var gj geoJSONGeometry
+	err := json.Unmarshal(raw, &gj)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Geometry{Type: gj.Type}
+	switch gj.Type {
+	case "Point":
+		var p Point
+		err = json.Unmarshal(gj.Coordinates, &p)
+		g.Points = []Point{p}
+
+	case "MultiPoint":
+		err = json.Unmarshal(gj.Coordinates, &g.Points)
+
+	case "LineString":
+		var line []Point
+		err = json.Unmarshal(gj.Coordinates, &line)
+		g.Lines = [][]Point{line}
+
+	case "MultiLineString":
+		err = json.Unmarshal(gj.Coordinates, &g.Lines)
+
+	case "Polygon":
+		var polygon [][]Point
+		err = json.Unmarshal(gj.Coordinates, &polygon)
+		g.Polygons = [][][]Point{polygon}
+
+	case "MultiPolygon":
+		err = json.Unmarshal(gj.Coordinates, &g.Polygons)
+
+	default:
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode %s coordinates: %s", gj.Type, err.Error())
+	}
+
+	return g, nil
+}
+
+// encodeGeoJSONGeometry encodes the geometry as a GeoJSON geometry object.
+func encodeGeoJSONGeometry(g *Geometry) (json.RawMessage, error) {
+	var coordinates interface{}
+
+	switch g.Type {
+	case "Point":
+		coordinates = g.Points[0]
+	case "MultiPoint":
+		coordinates = g.Points
+	case "LineString":
+		coordinates = g.Lines[0]
+	case "MultiLineString":
+		coordinates = g.Lines
+	case "Polygon":
+		coordinates = g.Polygons[0]
+	case "MultiPolygon":
+		coordinates = g.Polygons
+	default:
+		return nil, fmt.Errorf("Unable to encode geometry of type %#v", g.Type)
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"type":        g.Type,
+		"coordinates": coordinates,
+	})
+}
@@ -0,0 +1,340 @@
+package xonacatl
+
+// Point is a single coordinate, either in tile units or as longitude and latitude, depending on the format of the tile it came from.
+type Point [2]float64
+
+// Geometry is a format-independent representation of a feature's geometry, used where xonacatl needs to alter geometries rather than just copy them.
+//
+// Type is a GeoJSON geometry type name. Depending on the type, the coordinates are in Points (Point and MultiPoint), Lines (LineString and MultiLineString) or Polygons (Polygon and MultiPolygon). Each polygon is a list of rings, the first of which is the exterior, and rings are closed, with the last point equal to the first.
+type Geometry struct {
+	Type     string
+	Points   []Point
+	Lines    [][]Point
+	Polygons [][][]Point
+}
+
+// geometryTransform alters a geometry, returning nil if nothing remains of it.
+type geometryTransform func(g *Geometry) *Geometry
+
+// composeTransforms returns a transform which applies each of the non-nil transforms in order, or nil if there are none.
+func composeTransforms(transforms ...geometryTransform) geometryTransform {
+	var fns []geometryTransform
+	for _, fn := range transforms {
+		if fn != nil {
+			fns = append(fns, fn)
+		}
+	}
+
+	if len(fns) == 0 {
+		return nil
+	} else if len(fns) == 1 {
+		return fns[0]
+	}
+
+	return func(g *Geometry) *Geometry {
+		for _, fn := range fns {
+			g = fn(g)
+			if g == nil {
+				return nil
+			}
+		}
+		return g
+	}
+}
+
+// Box is an axis-aligned rectangle.
+type Box struct {
+	MinX, MinY, MaxX, MaxY float64
+}
+
+// Contains returns true if the point is inside or on the edge of the box.
+func (b Box) Contains(p Point) bool {
+	return p[0] >= b.MinX && p[0] <= b.MaxX && p[1] >= b.MinY && p[1] <= b.MaxY
+}
+
+// Intersects returns true if the two boxes overlap or touch.
+func (b Box) Intersects(o Box) bool {
+	return b.MinX <= o.MaxX && o.MinX <= b.MaxX && b.MinY <= o.MaxY && o.MinY <= b.MaxY
+}
+
+// Expand returns the box grown by dx and dy on each side.
+func (b Box) Expand(dx, dy float64) Box {
+	return Box{b.MinX - dx, b.MinY - dy, b.MaxX + dx, b.MaxY + dy}
+}
+
+// Transform applies fn to every coordinate of the geometry, in place.
+func (g *Geometry) Transform(fn func(Point) Point) {
+	for i := range g.Points {
+		g.Points[i] = fn(g.Points[i])
+	}
+	for _, line := range g.Lines {
+		for i := range line {
+			line[i] = fn(line[i])
+		}
+	}
+	for _, polygon := range g.Polygons {
+		for _, ring := range polygon {
+			for i := range ring {
+				ring[i] = fn(ring[i])
+			}
+		}
+	}
+}
+
+// Bounds returns the bounding box of the geometry. The result is undefined for an empty geometry.
+func (g *Geometry) Bounds() Box {
+	first := true
+	var b Box
+	add := func(p Point) {
+		if first {
+			b = Box{p[0], p[1], p[0], p[1]}
+			first = false
+			return
+		}
+		if p[0] < b.MinX {
+			b.MinX = p[0]
+		}
+		if p[0] > b.MaxX {
+			b.MaxX = p[0]
+		}
+		if p[1] < b.MinY {
+			b.MinY = p[1]
+		}
+		if p[1] > b.MaxY {
+			b.MaxY = p[1]
+		}
+	}
+
+	for _, p := range g.Points {
+		add(p)
+	}
+	for _, line := range g.Lines {
+		for _, p := range line {
+			add(p)
+		}
+	}
+	for _, polygon := range g.Polygons {
+		if len(polygon) > 0 {
+			for _, p := range polygon[0] {
+				add(p)
+			}
+		}
+	}
+
+	return b
+}
+
+// isEmpty returns true if the geometry has no coordinates.
+func (g *Geometry) isEmpty() bool {
+	return len(g.Points) == 0 && len(g.Lines) == 0 && len(g.Polygons) == 0
+}
+
+// normalise sets the type of the geometry to the single or multi variant depending on how many parts it has, and returns nil if it has none.
+func (g *Geometry) normalise() *Geometry {
+	if g.isEmpty() {
+		return nil
+	}
+
+	switch baseGeometryType(g.Type) {
+	case "Point":
+		g.Type = singleOrMulti("Point", len(g.Points))
+	case "LineString":
+		g.Type = singleOrMulti("LineString", len(g.Lines))
+	case "Polygon":
+		g.Type = singleOrMulti("Polygon", len(g.Polygons))
+	}
+
+	return g
+}
+
+func singleOrMulti(typ string, n int) string {
+	if n == 1 {
+		return typ
+	}
+	return "Multi" + typ
+}
+
+// ClipToBox returns the part of the geometry inside the box, or nil if none of it is.
+func (g *Geometry) ClipToBox(b Box) *Geometry {
+	clipped := &Geometry{Type: g.Type}
+
+	for _, p := range g.Points {
+		if b.Contains(p) {
+			clipped.Points = append(clipped.Points, p)
+		}
+	}
+
+	for _, line := range g.Lines {
+		clipped.Lines = append(clipped.Lines, clipLine(line, b)...)
+	}
+
+	for _, polygon := range g.Polygons {
+		var rings [][]Point
+		for i, ring := range polygon {
+			r := clipRing(ring, b)
+			if r == nil {
+				if i == 0 {
+					// if the exterior is gone, then so are the holes
+					break
+				}
+				continue
+			}
+			rings = append(rings, r)
+		}
+		if len(rings) > 0 {
+			clipped.Polygons = append(clipped.Polygons, rings)
+		}
+	}
+
+	return clipped.normalise()
+}
+
+// clipSegment clips the segment from a to c to the box using the Liang-Barsky algorithm, returning false if no part of it is inside.
+func clipSegment(a, c Point, b Box) (Point, Point, bool) {
+	t0, t1 := 0.0, 1.0
+	dx, dy := c[0]-a[0], c[1]-a[1]
+
+	edges := [4][2]float64{
+		{-dx, a[0] - b.MinX},
+		{dx, b.MaxX - a[0]},
+		{-dy, a[1] - b.MinY},
+		{dy, b.MaxY - a[1]},
+	}
+
+	for _, e := range edges {
+		p, q := e[0], e[1]
+		if p == 0 {
+			if q < 0 {
+				return a, c, false
+			}
+			continue
+		}
+		r := q / p
+		if p < 0 {
+			if r > t1 {
+				return a, c, false
+			} else if r > t0 {
+				t0 = r
+			}
+		} else {
+			if r < t0 {
+				return a, c, false
+			} else if r < t1 {
+				t1 = r
+			}
+		}
+	}
+
+	start, end := a, c
+	if t0 > 0 {
+		start = Point{a[0] + t0*dx, a[1] + t0*dy}
+	}
+	if t1 < 1 {
+		end = Point{a[0] + t1*dx, a[1] + t1*dy}
+	}
+	return start, end, true
+}
+
+// clipLine clips a line to the box, returning the parts of it which are inside.
+func clipLine(line []Point, b Box) [][]Point {
+	var parts [][]Point
+	var current []Point
+
+	for i := 0; i+1 < len(line); i++ {
+		start, end, ok := clipSegment(line[i], line[i+1], b)
+		if !ok {
+			continue
+		}
+
+		if len(current) > 0 && current[len(current)-1] == start {
+			current = append(current, end)
+		} else {
+			if len(current) > 1 {
+				parts = append(parts, current)
+			}
+			current = []Point{start, end}
+		}
+
+		// the line left the box, so the next part inside will be separate.
+		if end != line[i+1] {
+			parts = append(parts, current)
+			current = nil
+		}
+	}
+
+	if len(current) > 1 {
+		parts = append(parts, current)
+	}
+
+	return parts
+}
+
+// clipRing clips a closed ring to the box using the Sutherland-Hodgman algorithm, which works for any ring since the box is convex. It returns nil if the result has no area.
+func clipRing(ring []Point, b Box) []Point {
+	if len(ring) < 4 {
+		return nil
+	}
+
+	// work on the ring without the closing point.
+	points := ring[:len(ring)-1]
+
+	type edge struct {
+		inside    func(Point) bool
+		intersect func(Point, Point) Point
+	}
+	edges := []edge{
+		{
+			func(p Point) bool { return p[0] >= b.MinX },
+			func(p, q Point) Point { return Point{b.MinX, p[1] + (q[1]-p[1])*(b.MinX-p[0])/(q[0]-p[0])} },
+		},
+		{
+			func(p Point) bool { return p[0] <= b.MaxX },
+			func(p, q Point) Point { return Point{b.MaxX, p[1] + (q[1]-p[1])*(b.MaxX-p[0])/(q[0]-p[0])} },
+		},
+		{
+			func(p Point) bool { return p[1] >= b.MinY },
+			func(p, q Point) Point { return Point{p[0] + (q[0]-p[0])*(b.MinY-p[1])/(q[1]-p[1]), b.MinY} },
+		},
+		{
+			func(p Point) bool { return p[1] <= b.MaxY },
+			func(p, q Point) Point { return Point{p[0] + (q[0]-p[0])*(b.MaxY-p[1])/(q[1]-p[1]), b.MaxY} },
+		},
+	}
+
+	for _, e := range edges {
+		if len(points) == 0 {
+			return nil
+		}
+
+		var output []Point
+		prev := points[len(points)-1]
+		for _, p := range points {
+			if e.inside(p) {
+				if !e.inside(prev) {
+					output = append(output, e.intersect(prev, p))
+				}
+				output = append(output, p)
+			} else if e.inside(prev) {
+				output = append(output, e.intersect(prev, p))
+			}
+			prev = p
+		}
+		points = output
+	}
+
+	if len(points) < 3 || ringArea(points) == 0 {
+		return nil
+	}
+
+	return append(points, points[0])
+}
+
+// ringArea returns the signed area of a ring using the shoelace formula. The ring may be open or closed.
+func ringArea(ring []Point) float64 {
+	var sum float64
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		sum += ring[i][0]*ring[j][1] - ring[j][0]*ring[i][1]
+	}
+	return sum / 2
+}
@@ -0,0 +1,73 @@
+package xonacatl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func assertClip(g *Geometry, b Box, expected *Geometry, t *testing.T) {
+	out := g.ClipToBox(b)
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("Expected ClipToBox(%#v) to be %#v, but was %#v", g, expected, out)
+	}
+}
+
+var unitBox = Box{0, 0, 10, 10}
+
+func TestClipPoints(t *testing.T) {
+	g := &Geometry{Type: "MultiPoint", Points: []Point{{1, 1}, {11, 1}, {5, 5}}}
+	assertClip(g, unitBox, &Geometry{Type: "MultiPoint", Points: []Point{{1, 1}, {5, 5}}}, t)
+
+	g = &Geometry{Type: "MultiPoint", Points: []Point{{1, 1}, {11, 1}}}
+	assertClip(g, unitBox, &Geometry{Type: "Point", Points: []Point{{1, 1}}}, t)
+
+	g = &Geometry{Type: "Point", Points: []Point{{-1, 1}}}
+	assertClip(g, unitBox, nil, t)
+}
+
+func TestClipLineSplits(t *testing.T) {
+	// goes out of the box and back in again, so should become two lines.
+	g := &Geometry{Type: "LineString", Lines: [][]Point{{{5, 5}, {15, 5}, {15, 8}, {5, 8}}}}
+	expected := &Geometry{Type: "MultiLineString", Lines: [][]Point{
+		{{5, 5}, {10, 5}},
+		{{10, 8}, {5, 8}},
+	}}
+	assertClip(g, unitBox, expected, t)
+}
+
+func TestClipLineCrossing(t *testing.T) {
+	g := &Geometry{Type: "LineString", Lines: [][]Point{{{-5, 5}, {15, 5}}}}
+	expected := &Geometry{Type: "LineString", Lines: [][]Point{{{0, 5}, {10, 5}}}}
+	assertClip(g, unitBox, expected, t)
+}
+
+func TestClipPolygon(t *testing.T) {
+	g := &Geometry{Type: "Polygon", Polygons: [][][]Point{{
+		{{5, 5}, {15, 5}, {15, 15}, {5, 15}, {5, 5}},
+	}}}
+	expected := &Geometry{Type: "Polygon", Polygons: [][][]Point{{
+		{{5, 10}, {5, 5}, {10, 5}, {10, 10}, {5, 10}},
+	}}}
+	assertClip(g, unitBox, expected, t)
+}
+
+func TestClipPolygonDropsOutsideHole(t *testing.T) {
+	g := &Geometry{Type: "Polygon", Polygons: [][][]Point{{
+		{{-20, -20}, {20, -20}, {20, 20}, {-20, 20}, {-20, -20}},
+		{{12, 12}, {12, 14}, {14, 14}, {14, 12}, {12, 12}},
+	}}}
+	out := g.ClipToBox(unitBox)
+	if out == nil || len(out.Polygons) != 1 || len(out.Polygons[0]) != 1 {
+		t.Fatalf("Expected a single polygon with no holes, but was %#v", out)
+	}
+	if ringArea(out.Polygons[0][0]) != 100 {
+		t.Fatalf("Expected clipped polygon to cover the box, but was %#v", out.Polygons[0][0])
+	}
+}
+
+func TestClipPolygonOutside(t *testing.T) {
+	g := &Geometry{Type: "Polygon", Polygons: [][][]Point{{
+		{{20, 20}, {30, 20}, {30, 30}, {20, 30}, {20, 20}},
+	}}}
+	assertClip(g, unitBox, nil, t)
+}
@@ -0,0 +1,336 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/sync/singleflight"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAPIKeyParam is the query parameter which API keys are read from if APIKeyOptions doesn't say.
+const DefaultAPIKeyParam = "api_key"
+
+// DefaultAPIKeyCacheSize is the number of verdicts from the auth service an APIKeyChecker keeps if APIKeyOptions doesn't say.
+const DefaultAPIKeyCacheSize = 10000
+
+// keyFileCheckInterval is how often key files are checked for changes.
+var keyFileCheckInterval = 10 * time.Second
+
+// APIKeyOptions configures an APIKeyChecker.
+//
+// Keys are read from the Param query parameter, or DefaultAPIKeyParam if it's empty. A key is valid if it's in File, which has one key per line, ignoring blank lines and lines starting with "#", and is reloaded when it changes. Otherwise, if AuthURL is set, the key is valid if a GET of AuthURL with the key in a "key" query parameter returns a 2xx status, and invalid if it returns 401, 403 or 404. The auth service's verdicts are cached for CacheTTL if valid, and NegativeCacheTTL if not, which are durations such as "5m" defaulting to a minute, and at most CacheSize are kept, or DefaultAPIKeyCacheSize if it's zero.
+//
+// If Strip is set, the key isn't forwarded to the origin. Otherwise, it's forwarded in the ForwardAs query parameter, or the same one if that's empty, with the value OriginKey instead if that's set, for origins which have their own key.
+type APIKeyOptions struct {
+	Param            string `json:"param"`
+	File             string `json:"file"`
+	AuthURL          string `json:"auth_url"`
+	CacheTTL         string `json:"cache_ttl"`
+	NegativeCacheTTL string `json:"negative_cache_ttl"`
+	CacheSize        int    `json:"cache_size"`
+	Strip            bool   `json:"strip"`
+	ForwardAs        string `json:"forward_as"`
+	OriginKey        string `json:"origin_key"`
+}
+
+// keyFile is a set of keys loaded from disk, which is reloaded when the file changes.
+type keyFile struct {
+	name string
+
+	mutex    sync.Mutex
+	keys     map[string]bool
+	mod_time time.Time
+	checked  time.Time
+}
+
+func loadKeyFile(name string) (*keyFile, error) {
+	k := &keyFile{name: name}
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read key file: %s", err.Error())
+	}
+	err = k.load(info.ModTime())
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *keyFile) load(mod_time time.Time) error {
+	file, err := os.Open(k.name)
+	if err != nil {
+		return fmt.Errorf("Unable to read key file: %s", err.Error())
+	}
+	defer file.Close()
+
+	keys := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			keys[line] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("Unable to read key file %#v: %s", k.name, err.Error())
+	}
+
+	k.keys = keys
+	k.mod_time = mod_time
+	k.checked = time.Now()
+	return nil
+}
+
+// contains returns true if the key is in the file, reloading it first if it has changed. If the new file can't be read, then the old keys are kept.
+func (k *keyFile) contains(key string) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if time.Since(k.checked) >= keyFileCheckInterval {
+		k.checked = time.Now()
+		info, err := os.Stat(k.name)
+		if err != nil {
+			log.Printf("WARNING: Unable to check key file %#v for changes: %s", k.name, err.Error())
+		} else if !info.ModTime().Equal(k.mod_time) {
+			if err = k.load(info.ModTime()); err != nil {
+				log.Printf("WARNING: Keeping the current keys: %s", err.Error())
+			} else {
+				log.Printf("Reloaded key file %#v.", k.name)
+			}
+		}
+	}
+
+	return k.keys[key]
+}
+
+// verdict is a cached answer from the auth service.
+type verdict struct {
+	valid   bool
+	expires time.Time
+}
+
+// APIKeyChecker checks the API keys of tile requests before they are proxied, so that requests with invalid keys don't cost a request to the origin. Its CheckRequest and RewriteRequest methods are used as the hooks of the same names of a LayersHandler.
+type APIKeyChecker struct {
+	param        string
+	file         *keyFile
+	auth_url     *url.URL
+	auth_client  *http.Client
+	ttl          time.Duration
+	negative_ttl time.Duration
+	cache_size   int
+	strip        bool
+	forward_as   string
+	origin_key   string
+	now          func() time.Time
+	lookups      singleflight.Group
+
+	mutex sync.Mutex
+	cache map[string]verdict
+}
+
+// parseTTL parses a cache TTL option, which defaults to a minute.
+func parseTTL(name, value string) (time.Duration, error) {
+	if len(value) == 0 {
+		return time.Minute, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid %s %#v, expected a duration such as \"5m\"", name, value)
+	}
+	return d, nil
+}
+
+// NewAPIKeyChecker returns an APIKeyChecker configured by the options, or an error if they aren't valid or the key file can't be read.
+func NewAPIKeyChecker(options *APIKeyOptions) (*APIKeyChecker, error) {
+	if len(options.File) == 0 && len(options.AuthURL) == 0 {
+		return nil, fmt.Errorf("Unable to check API keys without a key file or an auth service URL")
+	}
+
+	c := &APIKeyChecker{
+		param:       options.Param,
+		auth_client: &http.Client{Timeout: 10 * time.Second},
+		cache_size:  options.CacheSize,
+		strip:       options.Strip,
+		forward_as:  options.ForwardAs,
+		origin_key:  options.OriginKey,
+		now:         time.Now,
+		cache:       make(map[string]verdict),
+	}
+	if len(c.param) == 0 {
+		c.param = DefaultAPIKeyParam
+	}
+	if len(c.forward_as) == 0 {
+		c.forward_as = c.param
+	}
+	if c.cache_size < 0 {
+		return nil, fmt.Errorf("Invalid cache_size %d, must not be negative", c.cache_size)
+	} else if c.cache_size == 0 {
+		c.cache_size = DefaultAPIKeyCacheSize
+	}
+
+	var err error
+	if c.ttl, err = parseTTL("cache_ttl", options.CacheTTL); err != nil {
+		return nil, err
+	}
+	if c.negative_ttl, err = parseTTL("negative_cache_ttl", options.NegativeCacheTTL); err != nil {
+		return nil, err
+	}
+
+	if len(options.AuthURL) > 0 {
+		c.auth_url, err = url.Parse(options.AuthURL)
+		if err != nil || len(c.auth_url.Scheme) == 0 || len(c.auth_url.Host) == 0 {
+			return nil, fmt.Errorf("Invalid auth_url %#v, expected an absolute URL", options.AuthURL)
+		}
+	}
+
+	if len(options.File) > 0 {
+		c.file, err = loadKeyFile(options.File)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// cached returns the auth service's cached verdict on the key, if there is one which hasn't expired.
+func (c *APIKeyChecker) cached(key string) (verdict, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	v, ok := c.cache[key]
+	if ok && c.now().After(v.expires) {
+		delete(c.cache, key)
+		return v, false
+	}
+	return v, ok
+}
+
+// remember caches a verdict from the auth service. When the cache is full, expired verdicts are dropped, and if that doesn't make room, an arbitrary one is.
+func (c *APIKeyChecker) remember(key string, valid bool) {
+	ttl := c.ttl
+	if !valid {
+		ttl = c.negative_ttl
+	}
+	if ttl == 0 {
+		return
+	}
+	now := c.now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.cache) >= c.cache_size {
+		for k, v := range c.cache {
+			if now.After(v.expires) {
+				delete(c.cache, k)
+			}
+		}
+		for k := range c.cache {
+			if len(c.cache) < c.cache_size {
+				break
+			}
+			delete(c.cache, k)
+		}
+	}
+	c.cache[key] = verdict{valid: valid, expires: now.Add(ttl)}
+}
+
+// askAuthService asks the auth service whether the key is valid. the request isn't tied to any one client request, as its answer may be shared by several, so it's only limited by the auth client's timeout.
+func (c *APIKeyChecker) askAuthService(key string) (bool, error) {
+	auth_url := *c.auth_url
+	values := auth_url.Query()
+	values.Set("key", key)
+	auth_url.RawQuery = values.Encode()
+
+	auth_req, err := http.NewRequest("GET", auth_url.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.auth_client.Do(auth_req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("Auth service returned status %d", resp.StatusCode)
+}
+
+// valid returns true if the key is valid, according to the key file or the auth service. Concurrent requests with the same uncached key share a single request to the auth service.
+func (c *APIKeyChecker) valid(key string) (bool, error) {
+	if c.file != nil && c.file.contains(key) {
+		return true, nil
+	}
+	if c.auth_url == nil {
+		return false, nil
+	}
+
+	if v, ok := c.cached(key); ok {
+		apiKeyCacheHits.Add(1)
+		return v.valid, nil
+	}
+
+	v, err, _ := c.lookups.Do(key, func() (interface{}, error) {
+		valid, err := c.askAuthService(key)
+		if err != nil {
+			apiKeyAuthErrors.Add(1)
+			return false, err
+		}
+		c.remember(key, valid)
+		return valid, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+// CheckRequest rejects the client request with 401 Unauthorized if it has no API key, or 403 Forbidden if the key isn't valid. If the auth service can't be reached, the request fails with 502 Bad Gateway, and the verdict isn't cached.
+func (c *APIKeyChecker) CheckRequest(req *http.Request) error {
+	key := req.Form.Get(c.param)
+	if len(key) == 0 {
+		apiKeyRejections.Add(1)
+		return &HTTPError{Status: http.StatusUnauthorized, Message: "An API key is required"}
+	}
+
+	valid, err := c.valid(key)
+	if err != nil {
+		return &HTTPError{Status: http.StatusBadGateway, Message: fmt.Sprintf("Unable to check API key: %s", err.Error())}
+	}
+	if !valid {
+		apiKeyRejections.Add(1)
+		return &HTTPError{Status: http.StatusForbidden, Message: "Invalid API key"}
+	}
+	return nil
+}
+
+// RewriteRequest strips or rewrites the key in the origin request as configured. It doesn't check the key, which CheckRequest has already done by the time the origin request is made.
+func (c *APIKeyChecker) RewriteRequest(origin_req, req *http.Request) error {
+	key := req.Form.Get(c.param)
+	values := origin_req.URL.Query()
+	values.Del(c.param)
+	if !c.strip {
+		forward := key
+		if len(c.origin_key) > 0 {
+			forward = c.origin_key
+		}
+		// requests made on behalf of no client, such as for the TileJSON, have no key of their own to forward.
+		if len(forward) > 0 {
+			values.Set(c.forward_as, forward)
+		}
+	}
+	origin_req.URL.RawQuery = values.Encode()
+	return nil
+}
@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/tilezen/xonacatl"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeKeyFile(t *testing.T, name, keys string) {
+	err := ioutil.WriteFile(name, []byte(keys), 0644)
+	if err != nil {
+		t.Fatalf("Unable to write key file: %s", err.Error())
+	}
+}
+
+func TestAPIKeyFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "xonacatl-keys")
+	if err != nil {
+		t.Fatalf("Unable to create key file: %s", err.Error())
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	writeKeyFile(t, file.Name(), "# customers\nabc\n\ndef\n")
+
+	old_interval := keyFileCheckInterval
+	keyFileCheckInterval = 0
+	defer func() { keyFileCheckInterval = old_interval }()
+
+	var origin_query string
+	origin_requests := 0
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		origin_requests++
+		origin_query = req.URL.RawQuery
+		rw.Write([]byte(`{"water":{}}`))
+	})
+	defer origin.Close()
+
+	checker, err := NewAPIKeyChecker(&APIKeyOptions{File: file.Name(), ForwardAs: "key", OriginKey: "origin-secret"})
+	if err != nil {
+		t.Fatalf("Unable to create API key checker: %s", err.Error())
+	}
+	h.check_request = checker.CheckRequest
+	h.rewrite_request = checker.RewriteRequest
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/water/0/0/0.json", http.StatusUnauthorized},
+		{"/water/0/0/0.json?api_key=xyz", http.StatusForbidden},
+		{"/water/0/0/0.json?api_key=%23+customers", http.StatusForbidden},
+		{"/water/0/0/0.json?api_key=def", http.StatusOK},
+	}
+	for _, test := range tests {
+		if rw := serveTile(h, test.path); rw.Code != test.status {
+			t.Fatalf("Expected %s to have status %d, but got %d", test.path, test.status, rw.Code)
+		}
+	}
+	if origin_requests != 1 {
+		t.Fatalf("Expected only the request with a valid key to reach the origin, but it got %d", origin_requests)
+	}
+	if origin_query != "key=origin-secret" {
+		t.Fatalf("Expected the key to be rewritten for the origin, but got query %#v", origin_query)
+	}
+
+	// a changed file is picked up.
+	writeKeyFile(t, file.Name(), "xyz\n")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(file.Name(), later, later)
+	if rw := serveTile(h, "/water/0/0/0.json?api_key=xyz"); rw.Code != http.StatusOK {
+		t.Fatalf("Expected key added to the file to be valid, but got status %d", rw.Code)
+	}
+	if rw := serveTile(h, "/water/0/0/0.json?api_key=def"); rw.Code != http.StatusForbidden {
+		t.Fatalf("Expected key removed from the file to be invalid, but got status %d", rw.Code)
+	}
+}
+
+func TestAPIKeyAuthService(t *testing.T) {
+	auth_requests := 0
+	auth := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		auth_requests++
+		switch req.URL.Query().Get("key") {
+		case "good":
+		case "broken":
+			rw.WriteHeader(http.StatusInternalServerError)
+		default:
+			rw.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer auth.Close()
+
+	var origin_query string
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		origin_query = req.URL.RawQuery
+		rw.Write([]byte(`{"water":{}}`))
+	})
+	defer origin.Close()
+
+	checker, err := NewAPIKeyChecker(&APIKeyOptions{AuthURL: auth.URL, Param: "key", Strip: true, NegativeCacheTTL: "10s"})
+	if err != nil {
+		t.Fatalf("Unable to create API key checker: %s", err.Error())
+	}
+	now := time.Unix(1000, 0)
+	checker.now = func() time.Time { return now }
+	h.check_request = checker.CheckRequest
+	h.rewrite_request = checker.RewriteRequest
+
+	tests := []struct {
+		path          string
+		status        int
+		auth_requests int
+	}{
+		{"/water/0/0/0.json?key=good", http.StatusOK, 1},
+		{"/water/0/0/0.json?key=good", http.StatusOK, 1},
+		{"/water/0/0/0.json?key=bad", http.StatusForbidden, 2},
+		{"/water/0/0/0.json?key=bad", http.StatusForbidden, 2},
+		// errors from the auth service aren't cached.
+		{"/water/0/0/0.json?key=broken", http.StatusBadGateway, 3},
+		{"/water/0/0/0.json?key=broken", http.StatusBadGateway, 4},
+	}
+	for _, test := range tests {
+		if rw := serveTile(h, test.path); rw.Code != test.status || auth_requests != test.auth_requests {
+			t.Fatalf("Expected %s to have status %d after %d auth requests, but got %d after %d", test.path, test.status, test.auth_requests, rw.Code, auth_requests)
+		}
+	}
+	if origin_query != "" {
+		t.Fatalf("Expected the key to be stripped from the origin request, but got query %#v", origin_query)
+	}
+
+	// the negative verdict expires sooner than the positive one.
+	now = now.Add(30 * time.Second)
+	serveTile(h, "/water/0/0/0.json?key=good")
+	serveTile(h, "/water/0/0/0.json?key=bad")
+	if auth_requests != 5 {
+		t.Fatalf("Expected only the expired negative verdict to be checked again, but got %d auth requests", auth_requests)
+	}
+}
+
+func TestNewAPIKeyCheckerInvalidOptions(t *testing.T) {
+	tests := []*APIKeyOptions{
+		{},
+		{AuthURL: "/auth"},
+		{AuthURL: "http://localhost/auth", CacheTTL: "soon"},
+		{File: "/does/not/exist"},
+	}
+
+	for _, options := range tests {
+		if _, err := NewAPIKeyChecker(options); err == nil {
+			t.Fatalf("Expected options %#v to be invalid", options)
+		}
+	}
+}
+
+func TestAPIKeyTileJSON(t *testing.T) {
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("Expected the cached TileJSON to be served without asking the origin, but got %s", req.URL)
+	})
+	defer origin.Close()
+
+	checker, err := NewAPIKeyChecker(&APIKeyOptions{AuthURL: "http://auth.example.com/check"})
+	if err != nil {
+		t.Fatalf("Unable to create API key checker: %s", err.Error())
+	}
+	checker.cache["good"] = verdict{valid: true, expires: time.Now().Add(time.Hour)}
+	checker.cache["bad"] = verdict{valid: false, expires: time.Now().Add(time.Hour)}
+	h.check_request = checker.CheckRequest
+	h.rewrite_request = checker.RewriteRequest
+
+	tj, err := NewTileJSONHandler(h, "/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", &TileJSONOptions{Path: "/{layers}/tilejson.{fmt}.json"})
+	if err != nil {
+		t.Fatalf("Unable to create TileJSON handler: %s", err.Error())
+	}
+	tj.docs["json"] = &xonacatl.TileJSON{VectorLayers: []xonacatl.VectorLayer{}}
+	r := mux.NewRouter()
+	r.Handle(tj.options.Path, tj).Methods("GET")
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/all/tilejson.json.json", http.StatusUnauthorized},
+		{"/all/tilejson.json.json?api_key=bad", http.StatusForbidden},
+		{"/all/tilejson.json.json?api_key=good", http.StatusOK},
+	}
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, httptest.NewRequest("GET", test.path, nil))
+		if rw.Code != test.status {
+			t.Fatalf("Expected %s to have status %d, but got %d", test.path, test.status, rw.Code)
+		}
+	}
+}
+
+func TestAPIKeyAuthServiceConcurrent(t *testing.T) {
+	started := make(chan bool, 10)
+	release := make(chan bool)
+	var mutex sync.Mutex
+	auth_requests := 0
+	auth := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		auth_requests++
+		mutex.Unlock()
+		started <- true
+		<-release
+	}))
+	defer auth.Close()
+
+	checker, err := NewAPIKeyChecker(&APIKeyOptions{AuthURL: auth.URL})
+	if err != nil {
+		t.Fatalf("Unable to create API key checker: %s", err.Error())
+	}
+
+	// the first lookup is held up by the auth service while the others arrive.
+	results := make(chan bool, 5)
+	lookup := func() {
+		valid, err := checker.valid("good")
+		results <- valid && err == nil
+	}
+	go lookup()
+	<-started
+	for i := 0; i < 4; i++ {
+		go lookup()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 5; i++ {
+		if !<-results {
+			t.Fatalf("Expected every lookup of a valid key to succeed")
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if auth_requests != 1 {
+		t.Fatalf("Expected concurrent lookups of a key to share one auth request, but got %d", auth_requests)
+	}
+}
@@ -0,0 +1,317 @@
+package handler
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultMinCompressSize is the size below which responses aren't compressed if CompressionOptions doesn't say, as the saving on small responses isn't worth the time it takes.
+const DefaultMinCompressSize = 1400
+
+// DefaultEncodings are the content encodings supported by CompressHandler, in order of preference when a client accepts more than one equally.
+var DefaultEncodings = []string{"br", "zstd", "gzip"}
+
+// default compression levels, which trade off size against speed about the same way for each encoding.
+var defaultLevels = map[string]int{
+	"br":   5,
+	"zstd": 3,
+	"gzip": gzip.DefaultCompression,
+}
+
+// CompressionOptions configures a CompressHandler.
+//
+// Encodings are the content encodings to offer, from "br", "zstd" and "gzip", in order of preference when a client accepts more than one equally, or DefaultEncodings if it's empty. Levels are the compression level for each encoding: 0-11 for "br", 1-22 for "zstd" and 1-9 for "gzip", or a moderate default for encodings not in it. Responses smaller than MinSize bytes aren't compressed, or DefaultMinCompressSize if it's zero.
+type CompressionOptions struct {
+	Encodings []string       `json:"encodings"`
+	Levels    map[string]int `json:"levels"`
+	MinSize   int            `json:"min_size"`
+}
+
+// encoder is the interface shared by the compressed writers for each encoding, so that they can be pooled and reused.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// newEncoderFunc returns a function which makes writers for the encoding at the compression level, or an error if the encoding is unknown or the level is out of range for it.
+func newEncoderFunc(encoding string, level int) (func() encoder, error) {
+	switch encoding {
+	case "br":
+		if level < brotli.BestSpeed || level > brotli.BestCompression {
+			return nil, fmt.Errorf("Invalid compression level %d for \"br\", expected %d-%d", level, brotli.BestSpeed, brotli.BestCompression)
+		}
+		return func() encoder { return brotli.NewWriterLevel(nil, level) }, nil
+
+	case "zstd":
+		if level < 1 || level > 22 {
+			return nil, fmt.Errorf("Invalid compression level %d for \"zstd\", expected 1-22", level)
+		}
+		zstd_level := zstd.EncoderLevelFromZstd(level)
+		return func() encoder {
+			// a single goroutine per response, as there are already plenty of responses going on at once.
+			z, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd_level), zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				// the options are fixed, and the level was checked above, so this can't happen.
+				panic(err)
+			}
+			return z
+		}, nil
+
+	case "gzip":
+		if level != gzip.DefaultCompression && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+			return nil, fmt.Errorf("Invalid compression level %d for \"gzip\", expected %d-%d", level, gzip.BestSpeed, gzip.BestCompression)
+		}
+		return func() encoder {
+			gw, _ := gzip.NewWriterLevel(nil, level)
+			return gw
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown content encoding %#v, expected one of %s", encoding, strings.Join(DefaultEncodings, ", "))
+}
+
+// CompressHandler compresses the responses of the handler it wraps, with the best content encoding which the client accepts.
+//
+// Responses which already have a Content-Encoding, such as a tile passed through still compressed from the origin, aren't compressed again. Neither are images, other than SVG, as they're compressed already. Responses always have "Vary: Accept-Encoding", and compressed responses have the encoding appended to their ETag, so that caches can keep each compressed variant alongside the uncompressed one.
+type CompressHandler struct {
+	handler   http.Handler
+	encodings []string
+	min_size  int
+	pools     map[string]*sync.Pool
+}
+
+// NewCompressHandler returns a CompressHandler wrapping the handler, or an error if the options aren't valid.
+func NewCompressHandler(h http.Handler, options *CompressionOptions) (*CompressHandler, error) {
+	encodings := options.Encodings
+	if len(encodings) == 0 {
+		encodings = DefaultEncodings
+	}
+
+	min_size := options.MinSize
+	if min_size < 0 {
+		return nil, fmt.Errorf("Invalid minimum compression size %d, must not be negative", min_size)
+	} else if min_size == 0 {
+		min_size = DefaultMinCompressSize
+	}
+
+	for encoding := range options.Levels {
+		if _, ok := defaultLevels[encoding]; !ok {
+			return nil, fmt.Errorf("Unknown content encoding %#v, expected one of %s", encoding, strings.Join(DefaultEncodings, ", "))
+		}
+	}
+
+	pools := make(map[string]*sync.Pool)
+	for _, encoding := range encodings {
+		level, ok := options.Levels[encoding]
+		if !ok {
+			level = defaultLevels[encoding]
+		}
+		new_encoder, err := newEncoderFunc(encoding, level)
+		if err != nil {
+			return nil, err
+		}
+		pools[encoding] = &sync.Pool{New: func() interface{} { return new_encoder() }}
+	}
+
+	return &CompressHandler{
+		handler:   h,
+		encodings: encodings,
+		min_size:  min_size,
+		pools:     pools,
+	}, nil
+}
+
+// negotiateEncoding returns the encoding with the highest quality in the Accept-Encoding header, breaking ties by the order of encodings, or an empty string if none of them are acceptable.
+func negotiateEncoding(accept string, encodings []string) string {
+	qualities := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(name) == 0 {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if name == "*" {
+			wildcard = q
+		} else {
+			qualities[name] = q
+		}
+	}
+
+	best, best_q := "", 0.0
+	for _, encoding := range encodings {
+		q, ok := qualities[encoding]
+		if !ok {
+			q = wildcard
+		}
+		if q > best_q {
+			best, best_q = encoding, q
+		}
+	}
+	return best
+}
+
+func (h *CompressHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	addVary(rw.Header(), "Accept-Encoding")
+
+	encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"), h.encodings)
+	if len(encoding) == 0 {
+		h.handler.ServeHTTP(rw, req)
+		return
+	}
+
+	cw := &compressWriter{ResponseWriter: rw, handler: h, encoding: encoding, head: req.Method == "HEAD"}
+	defer cw.close()
+	h.handler.ServeHTTP(cw, req)
+}
+
+// compressWriter buffers the start of a response until it knows whether the response is big enough to compress, and then compresses the rest of it on the way to the client if so.
+type compressWriter struct {
+	http.ResponseWriter
+	handler  *CompressHandler
+	encoding string
+	head     bool
+	status   int
+	started  bool
+	buf      []byte
+	enc      encoder
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.handler.min_size {
+			return len(b), nil
+		}
+		w.start()
+		return len(b), w.flushBuffer()
+	}
+
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// compressible returns true if the response should be compressed, based on what's known about it so far.
+func (w *compressWriter) compressible() bool {
+	header := w.Header()
+	if len(header.Get("Content-Encoding")) > 0 {
+		return false
+	}
+	if w.status == http.StatusNoContent || w.status == http.StatusNotModified || w.status == http.StatusPartialContent {
+		return false
+	}
+	if ct := header.Get("Content-Type"); strings.HasPrefix(ct, "image/") && !strings.HasPrefix(ct, "image/svg+xml") {
+		return false
+	}
+
+	if cl := header.Get("Content-Length"); len(cl) > 0 {
+		n, err := strconv.Atoi(cl)
+		return err == nil && n >= w.handler.min_size
+	}
+	// without a length, a HEAD response which hasn't written a body can't say how big the GET would be, so it's assumed big enough, the same as a filtered tile would be. otherwise a response is only as big as it's got before finishing, which is the same for HEAD responses that write a body.
+	if w.head && len(w.buf) == 0 {
+		return true
+	}
+	return len(w.buf) >= w.handler.min_size
+}
+
+// start decides whether to compress the response, and sends the response header.
+func (w *compressWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	header := w.Header()
+	// net/http would sniff the compressed bytes, so sniff the uncompressed ones instead, which also means images without a Content-Type aren't compressed.
+	if _, ok := header["Content-Type"]; !ok && len(w.buf) > 0 && len(header.Get("Content-Encoding")) == 0 {
+		header.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	if w.compressible() {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		encodingETag(header, w.encoding)
+		if !w.head {
+			w.enc = w.handler.pools[w.encoding].Get().(encoder)
+			w.enc.Reset(w.ResponseWriter)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// encodingETag appends the encoding to the ETag in the header, if there is one, so that it's different from the ETag of the uncompressed response, as a strong ETag must be for each different body.
+func encodingETag(header http.Header, encoding string) {
+	if etag := header.Get("Etag"); strings.HasSuffix(etag, `"`) {
+		header.Set("Etag", etag[:len(etag)-1]+"-"+encoding+`"`)
+	}
+}
+
+// flushBuffer writes out anything buffered before the response was started.
+func (w *compressWriter) flushBuffer() error {
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.enc != nil {
+		_, err := w.enc.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// Flush sends everything written so far to the client, which means deciding whether to compress the response if that hasn't happened yet.
+func (w *compressWriter) Flush() {
+	w.start()
+	w.flushBuffer()
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close finishes the response, sending anything still buffered, and returns the encoder to its pool. The encoder goes back even if the client has gone away and the writes failed, so that it isn't lost to the pool.
+func (w *compressWriter) close() {
+	w.start()
+	w.flushBuffer()
+	if w.enc != nil {
+		w.enc.Close()
+		// don't hold on to the ResponseWriter while the encoder is in the pool.
+		w.enc.Reset(nil)
+		w.handler.pools[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept, expected string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, zstd", "zstd"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, *", "zstd"},
+		{"*;q=0", ""},
+		{"GZIP", "gzip"},
+	}
+
+	for _, test := range tests {
+		if encoding := negotiateEncoding(test.accept, DefaultEncodings); encoding != test.expected {
+			t.Fatalf("Expected Accept-Encoding %#v to choose %#v, but got %#v", test.accept, test.expected, encoding)
+		}
+	}
+}
+
+func decompress(t *testing.T, encoding string, body []byte) string {
+	var rd io.Reader
+	switch encoding {
+	case "br":
+		rd = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		z, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Unable to read zstd body: %s", err.Error())
+		}
+		defer z.Close()
+		rd = z
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Unable to read gzip body: %s", err.Error())
+		}
+		rd = gr
+	default:
+		return string(body)
+	}
+
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatalf("Unable to decompress %s body: %s", encoding, err.Error())
+	}
+	return string(data)
+}
+
+func TestCompressHandler(t *testing.T) {
+	large := strings.Repeat(`{"water":{}}`, 200)
+	small := `{"water":{}}`
+
+	var body, content_encoding string
+	h, err := NewCompressHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Etag", `"abc"`)
+		if len(content_encoding) > 0 {
+			rw.Header().Set("Content-Encoding", content_encoding)
+		}
+		// write in pieces, so that the buffering is exercised.
+		for i := 0; i < len(body); i += 100 {
+			end := i + 100
+			if end > len(body) {
+				end = len(body)
+			}
+			rw.Write([]byte(body[i:end]))
+		}
+	}), &CompressionOptions{Levels: map[string]int{"gzip": 1}})
+	if err != nil {
+		t.Fatalf("Unable to create compress handler: %s", err.Error())
+	}
+
+	tests := []struct {
+		accept, body, content_encoding, expected_encoding, expected_etag string
+	}{
+		{"gzip, br", large, "", "br", `"abc-br"`},
+		{"zstd", large, "", "zstd", `"abc-zstd"`},
+		{"gzip", large, "", "gzip", `"abc-gzip"`},
+		{"", large, "", "", `"abc"`},
+		// too small to be worth compressing.
+		{"gzip, br", small, "", "", `"abc"`},
+		// already compressed, so passed through as it is.
+		{"gzip, br", large, "gzip", "gzip", `"abc"`},
+	}
+
+	for _, test := range tests {
+		body, content_encoding = test.body, test.content_encoding
+		req := httptest.NewRequest("GET", "/water/0/0/0.json", nil)
+		req.Header.Set("Accept-Encoding", test.accept)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if ce := rw.Header().Get("Content-Encoding"); ce != test.expected_encoding {
+			t.Fatalf("Expected Accept-Encoding %#v to get Content-Encoding %#v, but got %#v", test.accept, test.expected_encoding, ce)
+		}
+		if etag := rw.Header().Get("Etag"); etag != test.expected_etag {
+			t.Fatalf("Expected ETag %#v, but got %#v", test.expected_etag, etag)
+		}
+		if vary := rw.Header().Get("Vary"); vary != "Accept-Encoding" {
+			t.Fatalf("Expected Vary: Accept-Encoding, but got %#v", vary)
+		}
+		if len(test.content_encoding) == 0 {
+			if got := decompress(t, test.expected_encoding, rw.Body.Bytes()); got != test.body {
+				t.Fatalf("Expected body to decompress to the original, but got %d bytes", len(got))
+			}
+		}
+	}
+}
+
+func TestCompressHandlerSniffAndHead(t *testing.T) {
+	large := strings.Repeat(`{"water":{}}`, 200)
+	png := "\x89PNG\x0d\x0a\x1a\x0a" + large
+
+	var body, content_length string
+	h, err := NewCompressHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if len(content_length) > 0 {
+			rw.Header().Set("Content-Length", content_length)
+		}
+		rw.Write([]byte(body))
+	}), &CompressionOptions{})
+	if err != nil {
+		t.Fatalf("Unable to create compress handler: %s", err.Error())
+	}
+
+	tests := []struct {
+		method, body, content_length, expected_type, expected_encoding string
+	}{
+		// the uncompressed body is sniffed, not the compressed one.
+		{"GET", large, "", "text/plain; charset=utf-8", "br"},
+		{"GET", png, "", "image/png", ""},
+		// HEAD responses are only compressed if they would be big enough for a GET, which is assumed when there's neither a body nor a length.
+		{"HEAD", large, "", "text/plain; charset=utf-8", "br"},
+		{"HEAD", "", "", "", "br"},
+		{"HEAD", "", "10", "", ""},
+		{"HEAD", "", "100000", "", "br"},
+	}
+
+	for _, test := range tests {
+		body, content_length = test.body, test.content_length
+		req := httptest.NewRequest(test.method, "/all/tilejson.json", nil)
+		req.Header.Set("Accept-Encoding", "br")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if ct := rw.Header().Get("Content-Type"); ct != test.expected_type {
+			t.Fatalf("Expected %s of %d bytes to have Content-Type %#v, but got %#v", test.method, len(test.body), test.expected_type, ct)
+		}
+		if ce := rw.Header().Get("Content-Encoding"); ce != test.expected_encoding {
+			t.Fatalf("Expected %s of %d bytes with Content-Length %#v to have Content-Encoding %#v, but got %#v", test.method, len(test.body), test.content_length, test.expected_encoding, ce)
+		}
+	}
+}
+
+// failingEncoder is an encoder which can't write, as when the client has gone away, and which records what's done with it.
+type failingEncoder struct {
+	closed bool
+	w      io.Writer
+}
+
+func (e *failingEncoder) Write(b []byte) (int, error) { return 0, errors.New("client went away") }
+func (e *failingEncoder) Close() error                { e.closed = true; return nil }
+func (e *failingEncoder) Flush() error                { return nil }
+func (e *failingEncoder) Reset(w io.Writer)           { e.w = w }
+
+func TestCompressHandlerWriteError(t *testing.T) {
+	h, err := NewCompressHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Length", "100000")
+		rw.Write([]byte(`{"water":{}}`))
+	}), &CompressionOptions{Encodings: []string{"br"}})
+	if err != nil {
+		t.Fatalf("Unable to create compress handler: %s", err.Error())
+	}
+	enc := &failingEncoder{}
+	h.pools["br"] = &sync.Pool{New: func() interface{} { return enc }}
+
+	req := httptest.NewRequest("GET", "/water/0/0/0.json", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !enc.closed || enc.w != nil {
+		t.Fatalf("Expected the encoder to be closed and released after a failed write, but it was closed=%v, writing to %#v", enc.closed, enc.w)
+	}
+}
+
+func TestNewCompressHandlerInvalidOptions(t *testing.T) {
+	tests := []*CompressionOptions{
+		{Encodings: []string{"deflate"}},
+		{Levels: map[string]int{"br": 12}},
+		{Levels: map[string]int{"zstd": 0}},
+		{Levels: map[string]int{"lz4": 1}},
+		{MinSize: -1},
+	}
+
+	for _, options := range tests {
+		if _, err := NewCompressHandler(http.NotFoundHandler(), options); err == nil {
+			t.Fatalf("Expected options %#v to be invalid", options)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORSPolicy configures cross-origin resource sharing, so that browsers allow web maps on other sites to fetch tiles.
+//
+// AllowedOrigins are the origins which may fetch tiles, such as "https://maps.example.com". An origin may have a single "*" wildcard, such as "https://*.example.com", and "*" on its own allows any origin. AllowedMethods and AllowedHeaders are what preflight requests may ask for, defaulting to GET and HEAD, and no extra headers. ExposedHeaders are response headers which scripts may read, in addition to the simple ones. MaxAge is the number of seconds browsers may cache preflight responses for, or zero to leave it to the browser.
+//
+// The policy replaces any CORS headers from the origin.
+type CORSPolicy struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+	AllowedMethods []string `json:"allowed_methods"`
+	AllowedHeaders []string `json:"allowed_headers"`
+	ExposedHeaders []string `json:"exposed_headers"`
+	MaxAge         int      `json:"max_age"`
+}
+
+// allowsOrigin returns true if the origin matches any of the allowed origins.
+func (c *CORSPolicy) allowsOrigin(origin string) bool {
+	if len(origin) == 0 {
+		return false
+	}
+
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if idx := strings.Index(allowed, "*"); idx >= 0 {
+			prefix, suffix := strings.ToLower(allowed[:idx]), strings.ToLower(allowed[idx+1:])
+			lower := strings.ToLower(origin)
+			if len(lower) > len(prefix)+len(suffix) && strings.HasPrefix(lower, prefix) && strings.HasSuffix(lower, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *CORSPolicy) allowedMethods() []string {
+	if len(c.AllowedMethods) == 0 {
+		return []string{"GET", "HEAD"}
+	}
+	return c.AllowedMethods
+}
+
+// allowsHeaders returns true if every header in the comma-separated list from a preflight request is allowed.
+func (c *CORSPolicy) allowsHeaders(headers string) bool {
+	for _, h := range strings.Split(headers, ",") {
+		h = strings.TrimSpace(h)
+		if len(h) == 0 {
+			continue
+		}
+		allowed := false
+		for _, a := range c.AllowedHeaders {
+			if a == "*" || strings.EqualFold(a, h) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// isPreflight returns true if the request is a CORS preflight request, rather than an ordinary OPTIONS request.
+func isPreflight(req *http.Request) bool {
+	return req.Method == "OPTIONS" && len(req.Header.Get("Origin")) > 0 && len(req.Header.Get("Access-Control-Request-Method")) > 0
+}
+
+// removeCORSHeaders removes the CORS headers from a response header, such as those from the origin, so that they don't conflict with the policy.
+func removeCORSHeaders(header http.Header) {
+	for k := range header {
+		if strings.HasPrefix(k, "Access-Control-") {
+			delete(header, k)
+		}
+	}
+}
+
+// addVary adds a value to the Vary header, unless it's already there.
+func addVary(header http.Header, value string) {
+	for _, v := range header["Vary"] {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if part == "*" || strings.EqualFold(part, value) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", value)
+}
+
+// setHeaders sets the CORS headers for an ordinary request. Responses vary by the request's origin, so Vary always includes Origin, even if the origin isn't allowed, so that caches don't serve one origin's response to another.
+func (c *CORSPolicy) setHeaders(req *http.Request, header http.Header) {
+	removeCORSHeaders(header)
+	addVary(header, "Origin")
+
+	origin := req.Header.Get("Origin")
+	if !c.allowsOrigin(origin) {
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	if len(c.ExposedHeaders) > 0 {
+		header.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+	}
+}
+
+// servePreflight answers a CORS preflight request. If the request isn't allowed, then the response has no CORS headers, and the browser won't make the actual request.
+func (c *CORSPolicy) servePreflight(rw http.ResponseWriter, req *http.Request) {
+	header := rw.Header()
+	addVary(header, "Origin")
+	addVary(header, "Access-Control-Request-Method")
+	addVary(header, "Access-Control-Request-Headers")
+
+	method := req.Header.Get("Access-Control-Request-Method")
+	method_allowed := false
+	for _, m := range c.allowedMethods() {
+		if strings.EqualFold(m, method) {
+			method_allowed = true
+			break
+		}
+	}
+
+	request_headers := req.Header.Get("Access-Control-Request-Headers")
+	origin := req.Header.Get("Origin")
+	if c.allowsOrigin(origin) && method_allowed && c.allowsHeaders(request_headers) {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Methods", strings.Join(c.allowedMethods(), ", "))
+		if len(request_headers) > 0 {
+			header.Set("Access-Control-Allow-Headers", request_headers)
+		}
+		if c.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+		}
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCORSAllowsOrigin(t *testing.T) {
+	cors := &CORSPolicy{AllowedOrigins: []string{"https://maps.example.com", "https://*.example.org", "http://localhost:*"}}
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://maps.example.com", true},
+		{"HTTPS://Maps.Example.com", true},
+		{"https://other.example.com", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"http://localhost:8080", true},
+		{"http://localhost", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if allowed := cors.allowsOrigin(test.origin); allowed != test.allowed {
+			t.Fatalf("Expected origin %#v to be allowed=%v, but got %v", test.origin, test.allowed, allowed)
+		}
+	}
+
+	any := &CORSPolicy{AllowedOrigins: []string{"*"}}
+	if !any.allowsOrigin("https://anywhere.example.net") {
+		t.Fatalf("Expected \"*\" to allow any origin")
+	}
+}
+
+func TestCORSHeaders(t *testing.T) {
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Access-Control-Allow-Origin", "*")
+		rw.Header().Set("Vary", "Accept-Encoding")
+		rw.Write([]byte(`{"water":{},"roads":{}}`))
+	})
+	defer origin.Close()
+	h.cors = &CORSPolicy{AllowedOrigins: []string{"https://*.example.com"}, ExposedHeaders: []string{"X-Xonacatl-Dropped-Layers"}}
+
+	r := mux.NewRouter()
+	r.Handle("/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", h).Methods("GET", "OPTIONS")
+
+	req := httptest.NewRequest("GET", "/water/0/0/0.json", nil)
+	req.Header.Set("Origin", "https://maps.example.com")
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected tile to be OK, but got status %d", rw.Code)
+	}
+	if allow := rw.Header().Get("Access-Control-Allow-Origin"); allow != "https://maps.example.com" {
+		t.Fatalf("Expected the origin's CORS header to be replaced by the policy's, but got %#v", allow)
+	}
+	if expose := rw.Header().Get("Access-Control-Expose-Headers"); expose != "X-Xonacatl-Dropped-Layers" {
+		t.Fatalf("Expected exposed headers, but got %#v", expose)
+	}
+	if vary := rw.Header()["Vary"]; len(vary) != 2 || vary[0] != "Accept-Encoding" || vary[1] != "Origin" {
+		t.Fatalf("Expected Origin to be merged into the origin's Vary header, but got %#v", vary)
+	}
+
+	// a disallowed origin gets no CORS headers at all, not even the origin server's.
+	req.Header.Set("Origin", "https://evil.example.net")
+	rw = httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+	if allow, ok := rw.Header()["Access-Control-Allow-Origin"]; ok {
+		t.Fatalf("Expected no CORS headers for a disallowed origin, but got %#v", allow)
+	}
+
+	// preflights are answered without going to the origin.
+	req = httptest.NewRequest("OPTIONS", "/water/0/0/0.json", nil)
+	req.Header.Set("Origin", "https://maps.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	before := proxiedRequests.Value()
+	rw = httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+	if rw.Code != http.StatusNoContent || proxiedRequests.Value() != before {
+		t.Fatalf("Expected preflight to be answered with 204 and not proxied, but got status %d", rw.Code)
+	}
+	if methods := rw.Header().Get("Access-Control-Allow-Methods"); methods != "GET, HEAD" {
+		t.Fatalf("Expected default allowed methods, but got %#v", methods)
+	}
+
+	// a preflight asking for a header which isn't allowed isn't approved.
+	req.Header.Set("Access-Control-Request-Headers", "X-Custom")
+	rw = httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+	if allow, ok := rw.Header()["Access-Control-Allow-Origin"]; ok {
+		t.Fatalf("Expected preflight with a disallowed header to be refused, but got %#v", allow)
+	}
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"expvar"
+	"github.com/tilezen/xonacatl"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	vars *expvar.Map
+
+	parseFormErrors    *expvar.Int
+	parseRequestErrors *expvar.Int
+	proxyErrors        *expvar.Int
+	copyErrors         *expvar.Int
+	cancelledCopies    *expvar.Int
+
+	bytesRead    *expvar.Int
+	bytesWritten *expvar.Int
+	featuresKept *expvar.Int
+	layerBytes   *expvar.Map
+
+	numRequests        *expvar.Int
+	proxiedRequests    *expvar.Int
+	canonicalRedirects *expvar.Int
+	corsPreflights     *expvar.Int
+	headRequests       *expvar.Int
+	gzipPassThroughs   *expvar.Int
+	throttledRequests  *expvar.Int
+	rateLimitEvictions *expvar.Int
+	apiKeyRejections   *expvar.Int
+	apiKeyCacheHits    *expvar.Int
+	apiKeyAuthErrors   *expvar.Int
+
+	avgUpstreamTime *expvar.Float
+	avgTotalTime    *expvar.Float
+
+	upstreamRequestTime int64
+	totalRequestTime    int64
+)
+
+// the counters are published with expvar when the package is initialised, so they appear at /debug/vars wherever the handler is mounted. they're kept together in a single "xonacatl" map, so that they don't clash with any of the embedding program's own variables, as publishing the same name twice panics.
+func init() {
+	vars = expvar.NewMap("xonacatl")
+
+	parseFormErrors = newInt("parseFormErrors")
+	parseRequestErrors = newInt("parseRequestErrors")
+	proxyErrors = newInt("proxyErrors")
+	copyErrors = newInt("copyErrors")
+	cancelledCopies = newInt("cancelledCopies")
+
+	bytesRead = newInt("bytesRead")
+	bytesWritten = newInt("bytesWritten")
+	featuresKept = newInt("featuresKept")
+	layerBytes = newMap("layerBytes")
+
+	numRequests = newInt("numRequests")
+	proxiedRequests = newInt("proxiedRequests")
+	canonicalRedirects = newInt("canonicalRedirects")
+	corsPreflights = newInt("corsPreflights")
+	headRequests = newInt("headRequests")
+	gzipPassThroughs = newInt("gzipPassThroughs")
+	throttledRequests = newInt("throttledRequests")
+	rateLimitEvictions = newInt("rateLimitEvictions")
+	apiKeyRejections = newInt("apiKeyRejections")
+	apiKeyCacheHits = newInt("apiKeyCacheHits")
+	apiKeyAuthErrors = newInt("apiKeyAuthErrors")
+
+	avgUpstreamTime = newFloat("avgUpstreamTime")
+	avgTotalTime = newFloat("avgTotalTime")
+
+	upstreamRequestTime = 0
+	totalRequestTime = 0
+}
+
+// newInt returns a new counter published in vars.
+func newInt(name string) *expvar.Int {
+	v := new(expvar.Int)
+	vars.Set(name, v)
+	return v
+}
+
+// newFloat returns a new float published in vars.
+func newFloat(name string) *expvar.Float {
+	v := new(expvar.Float)
+	vars.Set(name, v)
+	return v
+}
+
+// newMap returns a new map published in vars.
+func newMap(name string) *expvar.Map {
+	v := new(expvar.Map).Init()
+	vars.Set(name, v)
+	return v
+}
+
+func milliseconds(t time.Duration) int64 {
+	ns := t.Nanoseconds()
+	ms := ns / (int64(time.Millisecond) / int64(time.Nanosecond))
+	return ms
+}
+
+func updateCounters(total, proxy time.Duration) {
+	proxy_time := atomic.AddInt64(&upstreamRequestTime, milliseconds(proxy))
+	total_time := atomic.AddInt64(&totalRequestTime, milliseconds(total))
+
+	req, err := strconv.ParseFloat(proxiedRequests.String(), 64)
+	if err != nil {
+		return
+	}
+
+	avgUpstreamTime.Set(float64(proxy_time) / req)
+	avgTotalTime.Set(float64(total_time) / req)
+}
+
+// updateCopyStats adds the statistics from copying a tile to the counters. layerBytes has the total size of each layer in the tiles read from the origin, which shows how much each contributes.
+func updateCopyStats(stats *xonacatl.CopyStats) {
+	bytesRead.Add(stats.BytesRead)
+	bytesWritten.Add(stats.BytesWritten)
+	featuresKept.Add(int64(stats.FeaturesKept))
+	for name, n := range stats.LayerBytes {
+		layerBytes.Add(name, n)
+	}
+}
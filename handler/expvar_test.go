@@ -0,0 +1,19 @@
+package handler
+
+import (
+	"expvar"
+	"testing"
+)
+
+func TestExpvarNamespace(t *testing.T) {
+	vars, ok := expvar.Get("xonacatl").(*expvar.Map)
+	if !ok {
+		t.Fatalf("Expected the counters to be published in a \"xonacatl\" map, but got %#v", expvar.Get("xonacatl"))
+	}
+	if vars.Get("numRequests") != numRequests {
+		t.Fatalf("Expected numRequests to be in the \"xonacatl\" map, but got %#v", vars.Get("numRequests"))
+	}
+	if v := expvar.Get("numRequests"); v != nil {
+		t.Fatalf("Expected numRequests not to be published globally, but got %#v", v)
+	}
+}
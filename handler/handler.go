@@ -0,0 +1,873 @@
+// Package handler provides the xonacatl layers proxy as an http.Handler, so that it can be mounted in other Go HTTP services as well as run by xonacatl_server.
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/tilezen/xonacatl"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LayersHandler proxies requests to an origin server and filters the response layers.
+//
+// It does this by matching the request against a given route pattern, and proxies that to the origin using the http_client. It adds custom headers to that request, but strips out any header keys matching do_not_forward_headers.
+//
+// If zoom_rules is set, then requested layers outside their zoom range are dropped, and reported in the X-Xonacatl-Dropped-Layers response header.
+//
+// If overzoom is set, then requests for tiles beyond its maximum zoom are served by fetching the ancestor tile at the maximum zoom from the origin, and cutting the requested tile out of it.
+//
+// If precision is set, it is the default for the "precision" query parameter, which is either a number of decimal places or "auto" to pick one to suit the zoom, and which rounds the coordinates of GeoJSON responses.
+//
+// If masks is set, then the layers in it are restricted to the regions covered by their masks: dropped from tiles entirely outside, and clipped in tiles crossing the boundary.
+//
+// Origin requests ask for gzip. If a response doesn't need filtering, such as one for the "all" layer, and the client accepts gzip, then the compressed body is passed straight through. Otherwise it's decompressed on the way.
+//
+// HEAD requests are made to the origin as HEAD requests too, so that the tile isn't fetched just to be thrown away, and get the headers which a GET would, without the body.
+//
+// If stats_metrics is set, then statistics about the layers and features kept are added to the expvar counters. If stats_headers is set, then responses include X-Xonacatl-* headers with them, for debugging. Collecting the statistics costs extra parsing, so it's only done for tiles if one of them is set.
+//
+// If cors is set, then responses have CORS headers for the origins it allows, and preflight OPTIONS requests are answered without going to the origin.
+//
+// If styles is set, then requests with a "style" query parameter only get the layers and features which that style uses at the requested zoom.
+//
+// If canonical_redirect is set, then requests for a layer list which isn't in canonical form are redirected to the canonical URL instead of being proxied. Layers not in known_layers are removed from the canonical form, unless known_layers is nil.
+//
+// The check_request, rewrite_request, rewrite_response and on_error hooks are described in Options.
+type LayersHandler struct {
+	origin                 *url.URL
+	route                  *mux.Route
+	custom_headers         *http.Header
+	do_not_forward_headers []*regexp.Regexp
+	http_client            *http.Client
+	canonical_redirect     bool
+	known_layers           map[string]bool
+	styles                 *StyleRegistry
+	zoom_rules             xonacatl.ZoomRules
+	overzoom               *OverzoomOptions
+	precision              string
+	masks                  map[string]*xonacatl.Mask
+	stats_metrics          bool
+	stats_headers          bool
+	cors                   *CORSPolicy
+	check_request          func(req *http.Request) error
+	rewrite_request        func(origin_req, req *http.Request) error
+	rewrite_response       func(resp *http.Response, req *http.Request) error
+	on_error               func(req *http.Request, status int, err error)
+}
+
+// Options configures a LayersHandler.
+//
+// Origin is the URL of the origin server, with a path which is a gorilla/mux route pattern for tiles on the origin, such as "/{layers}/{z}/{x}/{y}.{fmt}". The handler must be mounted on a mux route with the same variables, so that they can be filled in from the request. The layers variable is replaced with "all" in origin requests.
+//
+// Headers are added to origin requests, and client request headers matching any of DoNotForward aren't forwarded. Client is used to make the origin requests, or http.DefaultClient if it's nil. The other options are described in LayersHandler.
+//
+// CheckRequest, if set, is called with each client request before anything is served for it, including TileJSON documents which have already been fetched, for example to check an API key. RewriteRequest, if set, is called with each origin request before it is made, and the client request it was made from, for example to add credentials. Origin requests for TileJSON documents are shared by all clients, so they're made from an empty request, with no query parameters or headers of its own. RewriteResponse, if set, is called with each origin response before it is copied to the client, and may change its status or headers. If any of them returns an error, the client gets an error response instead, with the status from the error if it's an *HTTPError, or 500 Internal Server Error otherwise.
+//
+// OnError, if set, is called whenever the handler fails a request, with the status sent to the client. The status is zero if the error happened after the response had started, for example when the origin response body couldn't be read.
+type Options struct {
+	Origin            *url.URL
+	Headers           http.Header
+	DoNotForward      []*regexp.Regexp
+	Client            *http.Client
+	CanonicalRedirect bool
+	KnownLayers       map[string]bool
+	Styles            *StyleRegistry
+	ZoomRules         xonacatl.ZoomRules
+	Overzoom          *OverzoomOptions
+	Precision         string
+	Masks             map[string]*xonacatl.Mask
+	StatsMetrics      bool
+	StatsHeaders      bool
+	CORS              *CORSPolicy
+
+	CheckRequest    func(req *http.Request) error
+	RewriteRequest  func(origin_req, req *http.Request) error
+	RewriteResponse func(resp *http.Response, req *http.Request) error
+	OnError         func(req *http.Request, status int, err error)
+}
+
+// New returns a LayersHandler configured by the options, or an error if they aren't valid.
+func New(options *Options) (*LayersHandler, error) {
+	if options.Origin == nil {
+		return nil, fmt.Errorf("Unable to create a layers handler without an origin")
+	}
+
+	if len(options.Precision) > 0 {
+		_, err := parsePrecision(options.Precision, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid precision: %s", err.Error())
+		}
+	}
+
+	origin_router := mux.NewRouter()
+	route := origin_router.NewRoute().Path(options.Origin.Path).BuildOnly()
+	if err := route.GetError(); err != nil {
+		return nil, fmt.Errorf("Unable to parse origin path %#v: %s", options.Origin.Path, err.Error())
+	}
+
+	var headers *http.Header
+	if len(options.Headers) > 0 {
+		headers = &options.Headers
+	}
+
+	client := options.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &LayersHandler{
+		origin:                 options.Origin,
+		route:                  route,
+		custom_headers:         headers,
+		do_not_forward_headers: options.DoNotForward,
+		http_client:            client,
+		canonical_redirect:     options.CanonicalRedirect,
+		known_layers:           options.KnownLayers,
+		styles:                 options.Styles,
+		zoom_rules:             options.ZoomRules,
+		overzoom:               options.Overzoom,
+		precision:              options.Precision,
+		masks:                  options.Masks,
+		stats_metrics:          options.StatsMetrics,
+		stats_headers:          options.StatsHeaders,
+		cors:                   options.CORS,
+		check_request:          options.CheckRequest,
+		rewrite_request:        options.RewriteRequest,
+		rewrite_response:       options.RewriteResponse,
+		on_error:               options.OnError,
+	}, nil
+}
+
+// HTTPError is an error with the HTTP status to respond to the client with. The CheckRequest, RewriteRequest and RewriteResponse hooks can return one to reject a request, for example with 403 Forbidden.
+type HTTPError struct {
+	Status  int
+	Message string
+}
+
+func (e *HTTPError) Error() string {
+	return e.Message
+}
+
+// errorStatus returns the status to respond with for an error from a hook, and whether the hook chose it.
+func errorStatus(err error) (int, bool) {
+	if http_err, ok := err.(*HTTPError); ok {
+		return http_err.Status, true
+	}
+	return http.StatusInternalServerError, false
+}
+
+// fail responds to the client with an error, after telling the on_error hook about it.
+func (h *LayersHandler) fail(rw http.ResponseWriter, req *http.Request, status int, err error) {
+	if h.on_error != nil {
+		h.on_error(req, status, err)
+	}
+	http.Error(rw, err.Error(), status)
+}
+
+// checkRequest calls the check_request hook, failing the request and returning false if it rejects it. The form must have been parsed first.
+func (h *LayersHandler) checkRequest(rw http.ResponseWriter, req *http.Request) bool {
+	if h.check_request == nil {
+		return true
+	}
+	err := h.check_request(req)
+	if err != nil {
+		status, _ := errorStatus(err)
+		h.fail(rw, req, status, err)
+		return false
+	}
+	return true
+}
+
+// OverzoomOptions configures serving tiles beyond the origin's maximum zoom. Buffer is in pixels of a 256 pixel tile.
+type OverzoomOptions struct {
+	MaxZoom int     `json:"maxzoom"`
+	Buffer  float64 `json:"buffer"`
+}
+
+// localParams are the query parameters which are handled by xonacatl, and not forwarded to the origin.
+var localParams = map[string]bool{
+	"style":           true,
+	"style_source":    true,
+	"precision":       true,
+	"simplify":        true,
+	"simplify_method": true,
+	"bbox":            true,
+	"bbox_clip":       true,
+}
+
+// copyAll is a simple implementation of xonacatl.LayerCopier which copies the whole response back to the client. This is useful when the server receives a request for a format it does not understand, or a request for the "all" layer, and allows it to act as a pure proxy in that case.
+type copyAll struct{}
+
+func (_ *copyAll) CopyLayers(reader io.Reader, writer io.Writer) error {
+	_, err := io.Copy(writer, reader)
+	return err
+}
+
+// forwardHeader returns true if the header should be forwarded to the origin.
+//
+// It figures that out by looking at whether header key matches any of the regular expressions in the "do not forward" list.
+func (h *LayersHandler) forwardHeader(k string) bool {
+	for _, re := range h.do_not_forward_headers {
+		if re.MatchString(k) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRequestPath parses the request path to extract the set of layers and format of the request, as well as forming the origin request path from the variables in the route pattern. Any variables in overrides replace those from the request when forming the origin path.
+func (h *LayersHandler) parseRequestPath(req *http.Request, overrides map[string]string) (map[string]bool, string, *url.URL, error) {
+	var request_layers, format string
+	var pairs []string
+
+	for k, v := range mux.Vars(req) {
+		if o, ok := overrides[k]; ok {
+			v = o
+		}
+
+		// override the layers, save the old value
+		if k == "layers" {
+			request_layers = v
+			v = "all"
+
+		} else if k == "fmt" {
+			format = v
+		}
+
+		pairs = append(pairs, k, v)
+	}
+
+	origin_path, err := h.route.URLPath(pairs...)
+
+	return xonacatl.LayerNames(request_layers), format, origin_path, err
+}
+
+// canonicalURL returns the URL of the canonical form of the request, or nil if the request is already canonical.
+//
+// The canonical URL is built from the route which matched the request, with the layers variable replaced by its canonical form. Query parameters are preserved.
+func (h *LayersHandler) canonicalURL(req *http.Request) (*url.URL, error) {
+	vars := mux.Vars(req)
+	request_layers, ok := vars["layers"]
+	if !ok {
+		return nil, nil
+	}
+
+	canonical := xonacatl.CanonicalLayers(request_layers, h.known_layers)
+	// don't redirect to an empty layer list, as that would make a URL which the route doesn't match.
+	if canonical == request_layers || len(canonical) == 0 {
+		return nil, nil
+	}
+
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return nil, nil
+	}
+
+	var pairs []string
+	for k, v := range vars {
+		if k == "layers" {
+			v = canonical
+		}
+		pairs = append(pairs, k, v)
+	}
+
+	canonical_url, err := route.URL(pairs...)
+	if err != nil {
+		return nil, err
+	}
+	canonical_url.RawQuery = req.URL.RawQuery
+
+	return canonical_url, nil
+}
+
+// overzoomFor returns the overzoom to use for the request, or nil if the requested tile can be fetched from the origin directly. Only formats which xonacatl can clip are overzoomed. It returns an error if the tile is too deep to overzoom.
+func (h *LayersHandler) overzoomFor(req *http.Request) (*xonacatl.Overzoom, error) {
+	if h.overzoom == nil {
+		return nil, nil
+	}
+
+	if f, ok := xonacatl.FormatFor(mux.Vars(req)["fmt"]); !ok || !f.Transforms {
+		return nil, nil
+	}
+
+	tile, ok := requestTile(req)
+	if !ok {
+		return nil, nil
+	}
+	return xonacatl.NewOverzoom(tile, h.overzoom.MaxZoom, h.overzoom.Buffer)
+}
+
+// requestTile returns the requested tile from the "z", "x" and "y" route variables, or false if the route doesn't have them all.
+func requestTile(req *http.Request) (xonacatl.TileCoord, bool) {
+	vars := mux.Vars(req)
+
+	var coord [3]int
+	for i, k := range []string{"z", "x", "y"} {
+		v, err := strconv.Atoi(vars[k])
+		if err != nil {
+			return xonacatl.TileCoord{}, false
+		}
+		coord[i] = v
+	}
+
+	return xonacatl.TileCoord{Z: coord[0], X: coord[1], Y: coord[2]}, true
+}
+
+// parsePrecision parses a precision, which is either a number of decimal places or "auto" to use the precision for zoom z.
+func parsePrecision(value string, z int) (int, error) {
+	if value == "auto" {
+		if z < 0 {
+			return 0, fmt.Errorf("Unable to use automatic precision without a zoom")
+		}
+		return xonacatl.ZoomPrecision(z), nil
+	}
+
+	digits, err := strconv.Atoi(value)
+	if err != nil || digits < 0 || digits > xonacatl.MaxPrecision {
+		return 0, fmt.Errorf("Precision %#v should be \"auto\" or a number of decimal places from 0 to %d", value, xonacatl.MaxPrecision)
+	}
+	return digits, nil
+}
+
+// parseSimplify parses the "simplify" and "simplify_method" query parameters. The tolerance is in tile units for MVT and degrees for GeoJSON, or in pixels if it has a "px" suffix. The method is either "dp" for Douglas-Peucker, the default, or "vw" for Visvalingam-Whyatt.
+func parseSimplify(tolerance, method string, z int) (*xonacatl.Simplify, error) {
+	s := &xonacatl.Simplify{Zoom: z}
+
+	if strings.HasSuffix(tolerance, "px") {
+		if z < 0 {
+			return nil, fmt.Errorf("Unable to simplify in pixels without a zoom")
+		}
+		s.Pixels = true
+		tolerance = strings.TrimSuffix(tolerance, "px")
+	}
+
+	var err error
+	s.Tolerance, err = strconv.ParseFloat(tolerance, 64)
+	if err != nil || s.Tolerance < 0 {
+		return nil, fmt.Errorf("Simplify tolerance %#v should be a non-negative number", tolerance)
+	}
+
+	switch method {
+	case "", "dp":
+	case "vw":
+		s.Visvalingam = true
+	default:
+		return nil, fmt.Errorf("Simplify method %#v should be \"dp\" or \"vw\"", method)
+	}
+
+	return s, nil
+}
+
+// parseClip parses the "bbox" and "bbox_clip" query parameters. The box is "min_lon,min_lat,max_lon,max_lat", and geometries are only clipped to it if clip is true.
+func parseClip(bbox, clip string, req *http.Request) (*xonacatl.Clip, error) {
+	tile, ok := requestTile(req)
+	if !ok {
+		return nil, fmt.Errorf("Unable to use a bbox without a tile coordinate")
+	}
+
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("Bbox %#v should be min_lon,min_lat,max_lon,max_lat", bbox)
+	}
+
+	var coords [4]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bbox %#v should be min_lon,min_lat,max_lon,max_lat", bbox)
+		}
+		coords[i] = v
+	}
+
+	box := xonacatl.Box{MinX: coords[0], MinY: coords[1], MaxX: coords[2], MaxY: coords[3]}
+	if box.MinX > box.MaxX || box.MinY > box.MaxY {
+		return nil, fmt.Errorf("Bbox %#v has its minimum greater than its maximum", bbox)
+	}
+
+	c := &xonacatl.Clip{Tile: tile, Box: box}
+	if len(clip) > 0 {
+		var err error
+		c.Geometries, err = strconv.ParseBool(clip)
+		if err != nil {
+			return nil, fmt.Errorf("Bbox clip %#v should be true or false", clip)
+		}
+	}
+
+	return c, nil
+}
+
+// requestOptions adds the copy options which come from the request's layer list, query parameters and the handler's defaults to options, which may be nil. It returns nil if there are no options.
+func (h *LayersHandler) requestOptions(req *http.Request, options *xonacatl.CopyOptions, overzoom *xonacatl.Overzoom) (*xonacatl.CopyOptions, error) {
+	result := &xonacatl.CopyOptions{}
+	if options != nil {
+		*result = *options
+	}
+	empty := options == nil
+
+	if overzoom != nil {
+		result.Overzoom = overzoom
+		empty = false
+	}
+
+	types, err := xonacatl.ParseGeometryTypes(mux.Vars(req)["layers"])
+	if err != nil {
+		return nil, err
+	}
+	if len(types) > 0 {
+		result.GeometryTypes = types
+		empty = false
+	}
+
+	precision := h.precision
+	if p := req.Form.Get("precision"); len(p) > 0 {
+		precision = p
+	}
+	if len(precision) > 0 {
+		digits, err := parsePrecision(precision, requestZoom(req))
+		if err != nil {
+			return nil, err
+		}
+		// only set for formats which round coordinates, as any options at all stop a tile being passed through unfiltered.
+		if f, ok := xonacatl.FormatFor(mux.Vars(req)["fmt"]); ok && f.Rounds {
+			result.Precision = &digits
+			empty = false
+		}
+	}
+
+	if tolerance := req.Form.Get("simplify"); len(tolerance) > 0 {
+		simplify, err := parseSimplify(tolerance, req.Form.Get("simplify_method"), requestZoom(req))
+		if err != nil {
+			return nil, err
+		}
+		result.Simplify = simplify
+		empty = false
+	}
+
+	if len(h.masks) > 0 {
+		tile, ok := requestTile(req)
+		if !ok {
+			return nil, fmt.Errorf("Unable to apply masks without a tile coordinate")
+		}
+		result.Masks = &xonacatl.Masks{Tile: tile, Layers: h.masks}
+		empty = false
+	}
+
+	if bbox := req.Form.Get("bbox"); len(bbox) > 0 {
+		clip, err := parseClip(bbox, req.Form.Get("bbox_clip"), req)
+		if err != nil {
+			return nil, err
+		}
+		result.Clip = clip
+		empty = false
+	}
+
+	if empty {
+		return nil, nil
+	}
+	return result, nil
+}
+
+// requestZoom returns the zoom level of the request from the "z" route variable, or -1 if there isn't one.
+func requestZoom(req *http.Request) int {
+	z, err := strconv.Atoi(mux.Vars(req)["z"])
+	if err != nil {
+		return -1
+	}
+	return z
+}
+
+// styleLayers restricts the set of layers to those which the style referred to by the request uses at the requested zoom, and returns the options to filter the features to those the style uses.
+func (h *LayersHandler) styleLayers(layers map[string]bool, req *http.Request) (map[string]bool, *xonacatl.CopyOptions, error) {
+	style_id := req.Form.Get("style")
+	if h.styles == nil || len(style_id) == 0 {
+		return layers, nil, nil
+	}
+
+	style, ok := h.styles.Get(style_id)
+	if !ok {
+		return nil, nil, fmt.Errorf("Unknown style %#v", style_id)
+	}
+
+	style_layers, filters := style.LayersAt(req.Form.Get("style_source"), requestZoom(req))
+
+	result := make(map[string]bool)
+	for l := range style_layers {
+		if xonacatl.KeepLayer(layers, l) {
+			result[l] = true
+		}
+	}
+
+	return result, &xonacatl.CopyOptions{Filters: filters}, nil
+}
+
+// makeProxyRequest makes a proxy request with the method using the layers HTTP client. This is the client request's method for tiles, but GET for documents which xonacatl reads itself, whatever the client request was.
+//
+// Note that the request's ParseForm() must have been called before this point. It is not called here so that the error can be handled separately (i.e: as a bad request, not internal server error).
+func (h *LayersHandler) makeProxyRequest(method, origin_path string, req *http.Request) (*http.Response, error) {
+	origin_url := *h.origin
+	origin_url.Path = origin_path
+	// copy request paramters, as this might include API key. an APIKeyChecker used as the rewrite_request hook can strip or replace it first.
+	values := make(url.Values)
+	for k, vs := range req.Form {
+		if localParams[k] {
+			continue
+		}
+		for _, v := range vs {
+			values.Add(k, v)
+		}
+	}
+	origin_url.RawQuery = values.Encode()
+
+	new_req, err := http.NewRequest(method, origin_url.String(), req.Body)
+	if err != nil {
+		return nil, err
+	}
+	// if the client goes away, there's no point carrying on with the origin request.
+	new_req = new_req.WithContext(req.Context())
+
+	for k, v := range req.Header {
+		if h.forwardHeader(k) {
+			new_req.Header[k] = v
+		}
+	}
+
+	// if there's a custom header, add it
+	if h.custom_headers != nil {
+		for k, vs := range *h.custom_headers {
+			new_req.Header[k] = vs
+		}
+	}
+
+	// ask for gzip explicitly, rather than leaving it to the transport, so that a compressed tile can be passed straight through to the client when it doesn't need filtering. see decodeBody.
+	new_req.Header.Set("Accept-Encoding", "gzip")
+
+	if h.rewrite_request != nil {
+		err = h.rewrite_request(new_req, req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return h.http_client.Do(new_req)
+}
+
+func (h *LayersHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if h.cors != nil {
+		if isPreflight(req) {
+			corsPreflights.Add(1)
+			h.cors.servePreflight(rw, req)
+			return
+		}
+		// set before anything else, so that browsers can read error responses and redirects too.
+		h.cors.setHeaders(req, rw.Header())
+	}
+
+	numRequests.Add(1)
+	start_time := time.Now()
+
+	// parse form to ensure that query parameters are available.
+	err := req.ParseForm()
+	if err != nil {
+		parseFormErrors.Add(1)
+		h.fail(rw, req, http.StatusBadRequest, err)
+		return
+	}
+
+	if !h.checkRequest(rw, req) {
+		return
+	}
+
+	if h.canonical_redirect {
+		canonical_url, err := h.canonicalURL(req)
+		if err != nil {
+			parseRequestErrors.Add(1)
+			h.fail(rw, req, http.StatusInternalServerError, err)
+			return
+		}
+		if canonical_url != nil {
+			canonicalRedirects.Add(1)
+			http.Redirect(rw, req, canonical_url.String(), http.StatusMovedPermanently)
+			return
+		}
+	}
+
+	overzoom, err := h.overzoomFor(req)
+	if err != nil {
+		parseRequestErrors.Add(1)
+		h.fail(rw, req, http.StatusBadRequest, err)
+		return
+	}
+	var overrides map[string]string
+	if overzoom != nil {
+		overrides = map[string]string{
+			"z": strconv.Itoa(overzoom.Source.Z),
+			"x": strconv.Itoa(overzoom.Source.X),
+			"y": strconv.Itoa(overzoom.Source.Y),
+		}
+	}
+
+	layers, format, origin_path, err := h.parseRequestPath(req, overrides)
+	if err != nil {
+		parseRequestErrors.Add(1)
+		h.fail(rw, req, http.StatusInternalServerError, err)
+		return
+	}
+
+	if z := requestZoom(req); h.zoom_rules != nil && z >= 0 {
+		dropped := h.zoom_rules.Apply(layers, z)
+		if len(dropped) > 0 {
+			rw.Header().Set("X-Xonacatl-Dropped-Layers", strings.Join(dropped, ","))
+		}
+	}
+
+	layers, options, err := h.styleLayers(layers, req)
+	if err != nil {
+		parseRequestErrors.Add(1)
+		h.fail(rw, req, http.StatusNotFound, err)
+		return
+	}
+
+	options, err = h.requestOptions(req, options, overzoom)
+	if err != nil {
+		parseRequestErrors.Add(1)
+		h.fail(rw, req, http.StatusBadRequest, err)
+		return
+	}
+
+	proxy_start_time := time.Now()
+	resp, err := h.makeProxyRequest(req.Method, origin_path.Path, req)
+	proxy_time := time.Since(proxy_start_time)
+	if err != nil {
+		status, rejected := errorStatus(err)
+		if !rejected {
+			proxyErrors.Add(1)
+		}
+		h.fail(rw, req, status, err)
+		return
+	}
+
+	proxiedRequests.Add(1)
+	// update counters when the function exits
+	defer func() {
+		updateCounters(time.Since(start_time), proxy_time)
+	}()
+
+	// the policy replaces whatever the origin said about CORS, so that the two don't conflict.
+	if h.cors != nil {
+		h.cors.setHeaders(req, resp.Header)
+	}
+
+	if h.rewrite_response != nil {
+		err = h.rewrite_response(resp, req)
+		if err != nil {
+			resp.Body.Close()
+			status, _ := errorStatus(err)
+			h.fail(rw, req, status, err)
+			return
+		}
+	}
+
+	accepts_gzip := negotiateEncoding(req.Header.Get("Accept-Encoding"), []string{"gzip"}) == "gzip"
+
+	if resp.StatusCode != http.StatusOK {
+		decodeBody(resp, accepts_gzip)
+		h.copyResponse(req, &copyAll{}, resp, rw, false, false)
+		return
+	}
+
+	// get the appropriate copier for the layers and format
+	copier := copierFor(layers, format, options)
+	_, pass_through := copier.(*copyAll)
+	decodeBody(resp, pass_through && accepts_gzip)
+
+	// if we're about to modify the content, then any existing Content-Length header is very likely to be wrong. a copy of the whole tile is the same length though.
+	if !pass_through || overzoom != nil {
+		delete(resp.Header, "Content-Length")
+	}
+	// an overzoomed tile is cut from a tile shared with its siblings, so the origin's ETag doesn't identify it.
+	if overzoom != nil {
+		delete(resp.Header, "Etag")
+	}
+
+	// fill in the content type if the origin didn't send one, so that it isn't sniffed from the altered body.
+	if f, ok := xonacatl.FormatFor(format); ok && len(f.ContentType) > 0 && len(resp.Header.Get("Content-Type")) == 0 {
+		resp.Header.Set("Content-Type", f.ContentType)
+	}
+
+	if req.Method == "HEAD" {
+		headRequests.Add(1)
+		serveHead(resp, rw)
+		return
+	}
+
+	h.copyResponse(req, copier, resp, rw, h.stats_metrics, h.stats_headers)
+}
+
+// gzipBody decompresses a gzipped response body. The gzip reader is only created on the first read, as it reads the gzip header straight away, and some responses, such as those to HEAD requests, have no body at all.
+type gzipBody struct {
+	body io.ReadCloser
+	gr   *gzip.Reader
+	err  error
+}
+
+func (g *gzipBody) Read(p []byte) (int, error) {
+	if g.gr == nil && g.err == nil {
+		g.gr, g.err = gzip.NewReader(g.body)
+	}
+	if g.err != nil {
+		return 0, g.err
+	}
+	return g.gr.Read(p)
+}
+
+func (g *gzipBody) Close() error {
+	return g.body.Close()
+}
+
+// decodeBody decompresses the response body if the origin gzipped it, so that it can be filtered, unless keep is set, in which case the compressed body is passed through to the client as it is. Either way, the response varies by Accept-Encoding.
+func decodeBody(resp *http.Response, keep bool) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return
+	}
+	addVary(resp.Header, "Accept-Encoding")
+
+	if keep {
+		gzipPassThroughs.Add(1)
+		// the same as CompressHandler does, so that the gzipped tile has a different ETag from the one decompressed for clients which don't accept gzip.
+		encodingETag(resp.Header, "gzip")
+		return
+	}
+
+	resp.Body = &gzipBody{body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+}
+
+// serveHead responds to a HEAD request with the headers from the origin's response to a HEAD request, adjusted as they would be for a GET. The origin doesn't send a body, so there's nothing to filter, which means there are no statistics headers, and no Content-Length unless the tile would have been passed through whole.
+func serveHead(resp *http.Response, rw http.ResponseWriter) {
+	resp.Body.Close()
+
+	for k, v := range resp.Header {
+		rw.Header()[k] = v
+	}
+	rw.WriteHeader(resp.StatusCode)
+}
+
+// copyResponse copies the response to the client, telling the on_error hook about any error.
+func (h *LayersHandler) copyResponse(req *http.Request, copier xonacatl.LayerCopier, resp *http.Response, rw http.ResponseWriter, stats_metrics, stats_headers bool) {
+	status, err := copyResponse(req.Context(), copier, resp, rw, stats_metrics, stats_headers)
+	if err != nil && h.on_error != nil {
+		h.on_error(req, status, err)
+	}
+}
+
+// copierFor returns the appropriate xonacatl.LayerCopier instance for the given set of layers, tile format and copy options, using the format registered for the extension.
+func copierFor(layers map[string]bool, format string, options *xonacatl.CopyOptions) xonacatl.LayerCopier {
+	if layers["all"] && options == nil && !excludesLayers(layers) {
+		return &copyAll{}
+	}
+
+	if f, ok := xonacatl.FormatFor(format); ok {
+		return f.NewCopier(layers, options)
+	}
+
+	// fall back to just copying the request as-is
+	return &copyAll{}
+}
+
+// excludesLayers returns true if any layers have been excluded from "all", for example by a zoom rule, so that the response needs filtering.
+func excludesLayers(layers map[string]bool) bool {
+	for _, keep := range layers {
+		if !keep {
+			return true
+		}
+	}
+	return false
+}
+
+// copyResponse copies an HTTP response back to the client via a xonacatl.LayerCopier, which may alter the body contents. The copy stops early if the context is cancelled, for example when the client disconnects. The response body is closed afterwards.
+//
+// Statistics are only collected if the copier can report them, and stats_metrics or stats_headers is set. With stats_metrics, they are added to the expvar counters. With stats_headers, they are sent to the client in X-Xonacatl-* response headers, which means buffering the body, as they aren't known until the copy has finished.
+//
+// Any error copying the response is returned, unless it was because the context was cancelled, along with the error status sent to the client, or zero if the response had already started.
+func copyResponse(ctx context.Context, copier xonacatl.LayerCopier, resp *http.Response, rw http.ResponseWriter, stats_metrics, stats_headers bool) (int, error) {
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		rw.Header()[k] = v
+	}
+
+	stats_copier, has_stats := copier.(xonacatl.StatsLayerCopier)
+	if !has_stats || (!stats_metrics && !stats_headers) {
+		rw.WriteHeader(resp.StatusCode)
+		err := xonacatl.WithContext(copier).CopyLayersContext(ctx, resp.Body, rw)
+		return 0, copyFinished(ctx, err)
+	}
+
+	if !stats_headers {
+		rw.WriteHeader(resp.StatusCode)
+		stats, err := stats_copier.CopyLayersStats(ctx, resp.Body, rw)
+		if err == nil && stats_metrics {
+			updateCopyStats(stats)
+		}
+		return 0, copyFinished(ctx, err)
+	}
+
+	var body bytes.Buffer
+	stats, err := stats_copier.CopyLayersStats(ctx, resp.Body, &body)
+	if err != nil {
+		err = copyFinished(ctx, err)
+		if err == nil {
+			return 0, nil
+		}
+		// nothing has been sent yet, so the client can be told about the error, but without the origin's headers, which describe the tile.
+		for k := range resp.Header {
+			rw.Header().Del(k)
+		}
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return http.StatusInternalServerError, err
+	}
+
+	if stats_metrics {
+		updateCopyStats(stats)
+	}
+	setStatsHeaders(rw.Header(), stats)
+	rw.WriteHeader(resp.StatusCode)
+	_, err = body.WriteTo(rw)
+	return 0, copyFinished(ctx, err)
+}
+
+// setStatsHeaders adds the copy statistics to the response headers.
+func setStatsHeaders(header http.Header, stats *xonacatl.CopyStats) {
+	header.Set("X-Xonacatl-Layers-Kept", strings.Join(stats.LayersKept, ","))
+	header.Set("X-Xonacatl-Features-Kept", strconv.Itoa(stats.FeaturesKept))
+	header.Set("X-Xonacatl-Bytes-Read", strconv.FormatInt(stats.BytesRead, 10))
+	header.Set("X-Xonacatl-Bytes-Written", strconv.FormatInt(stats.BytesWritten, 10))
+}
+
+// copyFinished updates the counters and logs any error after copying a response. It returns the error, unless it was because the context was cancelled.
+func copyFinished(ctx context.Context, err error) error {
+	// possibly can't return this to the client, as we've already written the
+	// response header. a write failure at this stage also could be an error
+	// writing _to_ the client.
+	if err != nil && ctx.Err() != nil {
+		// the client has gone away, so this isn't a problem with the tile.
+		cancelledCopies.Add(1)
+		return nil
+	} else if err != nil {
+		copyErrors.Add(1)
+		log.Printf("WARNING: Problem while writing response body: %s", err.Error())
+	}
+	return err
+}
@@ -0,0 +1,589 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/tilezen/xonacatl"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func doNotForward(t *testing.T, h *LayersHandler, header string) {
+	if h.forwardHeader(header) {
+		t.Fatalf("Should not forward header %#v, but h.forwardHeader returned true.", header)
+	}
+}
+
+func doForward(t *testing.T, h *LayersHandler, header string) {
+	if !h.forwardHeader(header) {
+		t.Fatalf("Should forward header %#v, but h.forwardHeader returned false.", header)
+	}
+}
+
+func TestForwardHeader(t *testing.T) {
+	h := &LayersHandler{
+		do_not_forward_headers: []*regexp.Regexp{regexp.MustCompile("(?i)X-Mz-*")},
+	}
+
+	doNotForward(t, h, "x-mz-foo")
+	doNotForward(t, h, "X-MZ-FOO")
+
+	doForward(t, h, "xmz-foo")
+}
+
+func assertRedirect(t *testing.T, h http.Handler, path, expected string) {
+	r := mux.NewRouter()
+	r.Handle("/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", h).Methods("GET")
+
+	req := httptest.NewRequest("GET", path, nil)
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusMovedPermanently {
+		t.Fatalf("Expected request for %#v to redirect, but got status %d", path, rw.Code)
+	}
+	location := rw.Header().Get("Location")
+	if location != expected {
+		t.Fatalf("Expected request for %#v to redirect to %#v, but redirected to %#v", path, expected, location)
+	}
+}
+
+func TestCanonicalRedirect(t *testing.T) {
+	h := &LayersHandler{
+		canonical_redirect: true,
+		known_layers:       map[string]bool{"roads": true, "water": true},
+	}
+
+	assertRedirect(t, h, "/water,roads/0/0/0.json", "/roads,water/0/0/0.json")
+	assertRedirect(t, h, "/roads,roads,water/0/0/0.json", "/roads,water/0/0/0.json")
+	assertRedirect(t, h, "/roads,foo/0/0/0.mvt?api_key=abc", "/roads/0/0/0.mvt?api_key=abc")
+}
+
+func TestStyleLayers(t *testing.T) {
+	styles := NewStyleRegistry(1)
+	style, err := xonacatl.ParseStyle(strings.NewReader(`{"layers":[{"id":"water","source":"osm","source-layer":"water"},{"id":"buildings","source":"osm","source-layer":"buildings","minzoom":13}]}`))
+	if err != nil {
+		t.Fatalf("Unable to parse style: %s", err.Error())
+	}
+	styles.addPosted("test", style)
+
+	h := &LayersHandler{styles: styles}
+	var layers map[string]bool
+	r := mux.NewRouter()
+	r.HandleFunc("/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", func(rw http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		layers, _, err = h.styleLayers(map[string]bool{"all": true}, req)
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/all/12/0/0.mvt?style=test", nil))
+	if err != nil || !reflect.DeepEqual(layers, map[string]bool{"water": true}) {
+		t.Fatalf("Expected only water layer at zoom 12, but got %#v (error %v)", layers, err)
+	}
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/all/13/0/0.mvt?style=test", nil))
+	if err != nil || !reflect.DeepEqual(layers, map[string]bool{"water": true, "buildings": true}) {
+		t.Fatalf("Expected water and buildings layers at zoom 13, but got %#v (error %v)", layers, err)
+	}
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/all/13/0/0.mvt?style=unknown", nil))
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown style.")
+	}
+}
+
+// testOrigin starts an origin server using the handler, and returns a LayersHandler which proxies to it.
+func testOrigin(origin_handler http.HandlerFunc) (*LayersHandler, *httptest.Server) {
+	origin := httptest.NewServer(origin_handler)
+
+	origin_url, _ := url.Parse(origin.URL + "/{layers}/{z}/{x}/{y}.{fmt}")
+	h, err := New(&Options{Origin: origin_url})
+	if err != nil {
+		panic(err)
+	}
+	return h, origin
+}
+
+// serveTile makes a request to the handler through a router with the usual tile pattern.
+func serveTile(h http.Handler, path string) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	r.Handle("/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", h).Methods("GET")
+
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+	return rw
+}
+
+func TestZoomRulesHeader(t *testing.T) {
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"water":{},"buildings":{}}`))
+	})
+	defer origin.Close()
+
+	minzoom := 13
+	h.zoom_rules = xonacatl.ZoomRules{"buildings": xonacatl.ZoomRange{MinZoom: &minzoom}}
+
+	rw := serveTile(h, "/buildings,water/12/0/0.json")
+
+	if dropped := rw.Header().Get("X-Xonacatl-Dropped-Layers"); dropped != "buildings" {
+		t.Fatalf("Expected buildings layer to be reported as dropped, but header was %#v", dropped)
+	}
+	if body := rw.Body.String(); body != "{}" {
+		t.Fatalf("Expected only the water layer in the response, but got %#v", body)
+	}
+}
+
+func TestZoomRulesAll(t *testing.T) {
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"water":{"type":"FeatureCollection","features":[]},"buildings":{"type":"FeatureCollection","features":[]}}`))
+	})
+	defer origin.Close()
+
+	minzoom := 13
+	h.zoom_rules = xonacatl.ZoomRules{"buildings": xonacatl.ZoomRange{MinZoom: &minzoom}}
+
+	rw := serveTile(h, "/all/12/0/0.json")
+
+	if dropped := rw.Header().Get("X-Xonacatl-Dropped-Layers"); dropped != "buildings" {
+		t.Fatalf("Expected buildings layer to be reported as dropped, but header was %#v", dropped)
+	}
+	if body := rw.Body.String(); strings.Contains(body, "buildings") || !strings.Contains(body, "water") {
+		t.Fatalf("Expected only the water layer in the response, but got %#v", body)
+	}
+}
+
+func TestOverzoomRequestsAncestor(t *testing.T) {
+	var origin_path string
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		origin_path = req.URL.Path
+		rw.Header().Set("ETag", "parent")
+		rw.Write([]byte(`{"water":{"type":"FeatureCollection","features":[]}}`))
+	})
+	defer origin.Close()
+
+	h.overzoom = &OverzoomOptions{MaxZoom: 16}
+
+	rw := serveTile(h, "/all/18/77203/98541.json")
+	if origin_path != "/all/16/19300/24635.json" {
+		t.Fatalf("Expected overzoomed request to fetch ancestor tile, but fetched %#v", origin_path)
+	}
+	if etag := rw.Header().Get("ETag"); etag != "" {
+		t.Fatalf("Expected ancestor's ETag to be removed, but was %#v", etag)
+	}
+
+	serveTile(h, "/all/16/19300/24635.json")
+	if origin_path != "/all/16/19300/24635.json" {
+		t.Fatalf("Expected tile at maximum zoom to be fetched directly, but fetched %#v", origin_path)
+	}
+}
+
+func TestOverzoomTooDeep(t *testing.T) {
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("Expected a tile too deep to overzoom not to be fetched, but got %s", req.URL)
+	})
+	defer origin.Close()
+
+	h.overzoom = &OverzoomOptions{MaxZoom: 0}
+
+	rw := serveTile(h, "/all/80/0/0.json")
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a tile too deep to overzoom to be a bad request, but got status %d", rw.Code)
+	}
+}
+
+func TestPrecisionParam(t *testing.T) {
+	var origin_query string
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		origin_query = req.URL.RawQuery
+		rw.Write([]byte(`{"pois":{"type":"FeatureCollection","features":[{"geometry":{"type":"Point","coordinates":[1.23456,2.34567]}}]},"water":{}}`))
+	})
+	defer origin.Close()
+
+	rw := serveTile(h, "/pois/10/0/0.json?precision=2&api_key=abc")
+	if origin_query != "api_key=abc" {
+		t.Fatalf("Expected precision parameter not to be forwarded, but origin query was %#v", origin_query)
+	}
+	expected := `{"type":"FeatureCollection","features":[{"geometry":{"type":"Point","coordinates":[1.23,2.35]}}]}`
+	if body := rw.Body.String(); body != expected {
+		t.Fatalf("Expected rounded response %#v, but got %#v", expected, body)
+	}
+
+	rw = serveTile(h, "/pois/10/0/0.json?precision=lots")
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected bad precision to be rejected, but got status %d", rw.Code)
+	}
+}
+
+func TestGeometryTypeLayers(t *testing.T) {
+	var origin_path string
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		origin_path = req.URL.Path
+		rw.Write([]byte(`{"places":{"type":"FeatureCollection","features":[{"geometry":{"type":"Point","coordinates":[1,2]}},{"geometry":{"type":"Polygon","coordinates":[]}}]},"water":{}}`))
+	})
+	defer origin.Close()
+
+	rw := serveTile(h, "/places:point/10/0/0.json")
+	if origin_path != "/all/10/0/0.json" {
+		t.Fatalf("Expected all layers to be requested from the origin, but fetched %#v", origin_path)
+	}
+	expected := `{"features":[{"geometry":{"type":"Point","coordinates":[1,2]}}],"type":"FeatureCollection"}`
+	if body := rw.Body.String(); body != expected {
+		t.Fatalf("Expected only points in response %#v, but got %#v", expected, body)
+	}
+
+	rw = serveTile(h, "/places:circle/10/0/0.json")
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected unknown geometry type to be rejected, but got status %d", rw.Code)
+	}
+}
+
+func TestBboxParam(t *testing.T) {
+	var origin_query string
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		origin_query = req.URL.RawQuery
+		rw.Write([]byte(`{"pois":{"type":"FeatureCollection","features":[{"geometry":{"type":"Point","coordinates":[1,1]}},{"geometry":{"type":"Point","coordinates":[50,50]}}]}}`))
+	})
+	defer origin.Close()
+
+	rw := serveTile(h, "/pois/0/0/0.json?bbox=0,0,10,10&bbox_clip=true")
+	if origin_query != "" {
+		t.Fatalf("Expected bbox parameters not to be forwarded, but origin query was %#v", origin_query)
+	}
+	expected := `{"features":[{"geometry":{"coordinates":[1,1],"type":"Point"}}],"type":"FeatureCollection"}`
+	if body := rw.Body.String(); body != expected {
+		t.Fatalf("Expected only the point in the bbox in response %#v, but got %#v", expected, body)
+	}
+
+	for _, bad := range []string{"bbox=1,2,3", "bbox=10,0,0,10", "bbox=0,0,1,1&bbox_clip=maybe"} {
+		rw = serveTile(h, "/pois/0/0/0.json?"+bad)
+		if rw.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %#v to be rejected, but got status %d", bad, rw.Code)
+		}
+	}
+}
+
+func TestMasks(t *testing.T) {
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"buildings":{"type":"FeatureCollection","features":[]},"water":{"type":"FeatureCollection","features":[]}}`))
+	})
+	defer origin.Close()
+
+	// buildings may only be served in the western hemisphere.
+	mask, err := xonacatl.ParseMask(strings.NewReader(`{"type":"Polygon","coordinates":[[[-180,-80],[0,-80],[0,80],[-180,80],[-180,-80]]]}`))
+	if err != nil {
+		t.Fatalf("Unable to parse mask: %s", err.Error())
+	}
+	h.masks = map[string]*xonacatl.Mask{"buildings": mask}
+
+	expected := `{"buildings":{"type":"FeatureCollection","features":[]},"water":{"type":"FeatureCollection","features":[]}}`
+	if body := serveTile(h, "/buildings,water/4/2/6.json").Body.String(); body != expected {
+		t.Fatalf("Expected buildings in the western hemisphere, giving %#v, but got %#v", expected, body)
+	}
+
+	expected = `{"water":{"type":"FeatureCollection","features":[]}}`
+	if body := serveTile(h, "/buildings,water/4/12/6.json").Body.String(); body != expected {
+		t.Fatalf("Expected no buildings in the eastern hemisphere, giving %#v, but got %#v", expected, body)
+	}
+}
+
+func TestCopyResponseCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader(`{"water":{}}`)),
+	}
+
+	before := cancelledCopies.Value()
+	rw := httptest.NewRecorder()
+	copyResponse(ctx, xonacatl.NewCopyLayers(map[string]bool{"water": true}), resp, rw, false, false)
+
+	if cancelledCopies.Value() != before+1 {
+		t.Fatalf("Expected cancelled copy to be counted")
+	}
+	if rw.Body.Len() != 0 {
+		t.Fatalf("Expected nothing to be copied after cancellation, but got %#v", rw.Body.String())
+	}
+}
+
+func TestStatsHeaders(t *testing.T) {
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"water":{"type":"FeatureCollection","features":[{},{}]},"roads":{"type":"FeatureCollection","features":[{}]},"pois":{}}`))
+	})
+	defer origin.Close()
+
+	before := featuresKept.Value()
+	rw := serveTile(h, "/roads,water/0/0/0.json")
+	if kept := rw.Header().Get("X-Xonacatl-Layers-Kept"); kept != "" {
+		t.Fatalf("Expected no stats headers unless enabled, but got %#v", kept)
+	}
+	if featuresKept.Value() != before {
+		t.Fatalf("Expected no stats to be collected unless enabled")
+	}
+
+	h.stats_metrics = true
+	h.stats_headers = true
+	rw = serveTile(h, "/roads,water/0/0/0.json")
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected OK response, but got status %d", rw.Code)
+	}
+	if kept := rw.Header().Get("X-Xonacatl-Layers-Kept"); kept != "roads,water" {
+		t.Fatalf("Expected layers kept header to be %#v, but got %#v", "roads,water", kept)
+	}
+	if features := rw.Header().Get("X-Xonacatl-Features-Kept"); features != "3" {
+		t.Fatalf("Expected features kept header to be %#v, but got %#v", "3", features)
+	}
+	if written := rw.Header().Get("X-Xonacatl-Bytes-Written"); written != strconv.Itoa(rw.Body.Len()) {
+		t.Fatalf("Expected bytes written header to be the body length %d, but got %#v", rw.Body.Len(), written)
+	}
+	if featuresKept.Value() != before+3 {
+		t.Fatalf("Expected features kept counter to increase by 3, but it increased by %d", featuresKept.Value()-before)
+	}
+}
+
+func TestNewInvalidOptions(t *testing.T) {
+	origin_url, _ := url.Parse("http://localhost/{layers}/{z}/{x}/{y}.{fmt}")
+
+	if _, err := New(&Options{}); err == nil {
+		t.Fatalf("Expected options without an origin to be rejected")
+	}
+	if _, err := New(&Options{Origin: origin_url, Precision: "lots"}); err == nil {
+		t.Fatalf("Expected invalid precision to be rejected")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var origin_auth string
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		origin_auth = req.Header.Get("Authorization")
+		rw.Write([]byte(`{"water":{},"roads":{}}`))
+	})
+	defer origin.Close()
+
+	h.rewrite_request = func(origin_req, req *http.Request) error {
+		if req.Form.Get("key") != "secret" {
+			return &HTTPError{Status: http.StatusForbidden, Message: "Invalid key"}
+		}
+		origin_req.Header.Set("Authorization", "Bearer origin")
+		return nil
+	}
+	h.rewrite_response = func(resp *http.Response, req *http.Request) error {
+		resp.Header.Set("Cache-Control", "max-age=60")
+		return nil
+	}
+	var errors []int
+	h.on_error = func(req *http.Request, status int, err error) {
+		errors = append(errors, status)
+	}
+
+	rw := serveTile(h, "/water/0/0/0.json?key=secret")
+	if rw.Code != http.StatusOK || origin_auth != "Bearer origin" {
+		t.Fatalf("Expected request to be rewritten with origin credentials, but got status %d and origin auth %#v", rw.Code, origin_auth)
+	}
+	if cc := rw.Header().Get("Cache-Control"); cc != "max-age=60" {
+		t.Fatalf("Expected response to be rewritten with Cache-Control %#v, but got %#v", "max-age=60", cc)
+	}
+	if body := rw.Body.String(); body != `{}` {
+		t.Fatalf("Expected only the water layer's contents, but got %#v", body)
+	}
+
+	rw = serveTile(h, "/water/0/0/0.json?key=wrong")
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("Expected request with the wrong key to be forbidden, but got status %d", rw.Code)
+	}
+	if !reflect.DeepEqual(errors, []int{http.StatusForbidden}) {
+		t.Fatalf("Expected error callback with status 403, but got %#v", errors)
+	}
+}
+
+func TestHead(t *testing.T) {
+	var origin_method string
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		origin_method = req.Method
+		rw.Header().Set("Etag", `"abc"`)
+		rw.Header().Set("Content-Length", "23")
+		if req.Method != "HEAD" {
+			rw.Write([]byte(`{"water":{},"roads":{}}`))
+		}
+	})
+	defer origin.Close()
+
+	r := mux.NewRouter()
+	r.Handle("/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", h).Methods("GET", "HEAD")
+
+	tests := []struct {
+		path, content_length string
+	}{
+		// the whole tile is passed through, so it's the same length as the origin's.
+		{"/all/0/0/0.json", "23"},
+		// the layers are filtered, so the length isn't known without fetching the tile.
+		{"/water/0/0/0.json", ""},
+	}
+
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, httptest.NewRequest("HEAD", test.path, nil))
+
+		if rw.Code != http.StatusOK || origin_method != "HEAD" {
+			t.Fatalf("Expected HEAD %s to be OK via a HEAD to the origin, but got status %d via %s", test.path, rw.Code, origin_method)
+		}
+		if rw.Body.Len() != 0 {
+			t.Fatalf("Expected HEAD %s to have no body, but got %#v", test.path, rw.Body.String())
+		}
+		if cl := rw.Header().Get("Content-Length"); cl != test.content_length {
+			t.Fatalf("Expected HEAD %s to have Content-Length %#v, but got %#v", test.path, test.content_length, cl)
+		}
+		if rw.Header().Get("Etag") != `"abc"` || rw.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("Expected HEAD %s to have the headers a GET would, but got %#v", test.path, rw.Header())
+		}
+	}
+}
+
+func TestHeadCompressed(t *testing.T) {
+	tile := `{"water":{"name":"` + strings.Repeat("water", 400) + `"},"roads":{}}`
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Etag", `"abc"`)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Content-Length", strconv.Itoa(len(tile)))
+		if req.Method != "HEAD" {
+			rw.Write([]byte(tile))
+		}
+	})
+	defer origin.Close()
+
+	r := mux.NewRouter()
+	r.Handle("/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", h).Methods("GET", "HEAD")
+	ch, err := NewCompressHandler(r, &CompressionOptions{})
+	if err != nil {
+		t.Fatalf("Unable to create compress handler: %s", err.Error())
+	}
+
+	headers := make(map[string]http.Header)
+	for _, method := range []string{"GET", "HEAD"} {
+		req := httptest.NewRequest(method, "/water/0/0/0.json", nil)
+		req.Header.Set("Accept-Encoding", "br")
+		rw := httptest.NewRecorder()
+		ch.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Expected %s to be OK, but got status %d", method, rw.Code)
+		}
+		headers[method] = rw.Header()
+	}
+
+	if ce := headers["GET"].Get("Content-Encoding"); ce != "br" {
+		t.Fatalf("Expected the filtered tile to be compressed, but got Content-Encoding %#v", ce)
+	}
+	for _, k := range []string{"Content-Encoding", "Etag", "Content-Type", "Vary"} {
+		if get, head := headers["GET"].Get(k), headers["HEAD"].Get(k); get != head {
+			t.Fatalf("Expected HEAD to have the same %s as GET, %#v, but got %#v", k, get, head)
+		}
+	}
+}
+
+func TestGzipPassThrough(t *testing.T) {
+	tile := `{"water":{},"roads":{}}`
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte(tile))
+	gw.Close()
+
+	var origin_accept string
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		origin_accept = req.Header.Get("Accept-Encoding")
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Etag", `"abc"`)
+		rw.Write(gzipped.Bytes())
+	})
+	defer origin.Close()
+
+	r := mux.NewRouter()
+	r.Handle("/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", h).Methods("GET")
+
+	tests := []struct {
+		path, accept, content_encoding, body, etag string
+	}{
+		// nothing to filter, and the client accepts gzip, so the origin's bytes go straight through.
+		{"/all/0/0/0.json", "gzip, br", "gzip", gzipped.String(), `"abc-gzip"`},
+		{"/all/0/0/0.json", "", "", tile, `"abc"`},
+		// filtering needs the tile decompressed.
+		{"/water/0/0/0.json", "gzip", "", `{}`, `"abc"`},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.Header.Set("Accept-Encoding", test.accept)
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusOK || origin_accept != "gzip" {
+			t.Fatalf("Expected %s to be OK via a gzip origin request, but got status %d via Accept-Encoding %#v", test.path, rw.Code, origin_accept)
+		}
+		if ce := rw.Header().Get("Content-Encoding"); ce != test.content_encoding {
+			t.Fatalf("Expected %s with Accept-Encoding %#v to have Content-Encoding %#v, but got %#v", test.path, test.accept, test.content_encoding, ce)
+		}
+		if body := rw.Body.String(); body != test.body {
+			t.Fatalf("Expected %s with Accept-Encoding %#v to have body %#v, but got %#v", test.path, test.accept, test.body, body)
+		}
+		if vary := rw.Header().Get("Vary"); vary != "Accept-Encoding" {
+			t.Fatalf("Expected response to vary by Accept-Encoding, but got %#v", vary)
+		}
+		if etag := rw.Header().Get("Etag"); etag != test.etag {
+			t.Fatalf("Expected %s with Accept-Encoding %#v to have ETag %#v, but got %#v", test.path, test.accept, test.etag, etag)
+		}
+	}
+}
+
+func TestPrecisionDefaultPassThrough(t *testing.T) {
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte(`{"type":"Topology","objects":{},"arcs":[]}`))
+	gw.Close()
+
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.Write(gzipped.Bytes())
+	})
+	defer origin.Close()
+	h.precision = "auto"
+
+	r := mux.NewRouter()
+	r.Handle("/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", h).Methods("GET")
+	req := httptest.NewRequest("GET", "/all/0/0/0.topojson", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+
+	// TopoJSON isn't rounded, so the precision mustn't stop the tile going straight through.
+	if ce := rw.Header().Get("Content-Encoding"); ce != "gzip" || rw.Body.String() != gzipped.String() {
+		t.Fatalf("Expected the gzipped tile to be passed through, but got Content-Encoding %#v", ce)
+	}
+}
+
+func TestParseSimplify(t *testing.T) {
+	s, err := parseSimplify("2px", "vw", 10)
+	if err != nil || !s.Pixels || !s.Visvalingam || s.Tolerance != 2 || s.Zoom != 10 {
+		t.Fatalf("Unexpected result parsing simplify options: %#v (error %v)", s, err)
+	}
+
+	s, err = parseSimplify("0.5", "", -1)
+	if err != nil || s.Pixels || s.Visvalingam || s.Tolerance != 0.5 {
+		t.Fatalf("Unexpected result parsing simplify options: %#v (error %v)", s, err)
+	}
+
+	for _, bad := range [][2]string{{"lots", ""}, {"-1", ""}, {"1", "magic"}} {
+		if _, err := parseSimplify(bad[0], bad[1], 10); err == nil {
+			t.Fatalf("Expected simplify options %#v to be rejected.", bad)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimitClients is the number of clients a RateLimiter keeps track of if RateLimitOptions doesn't say.
+const DefaultRateLimitClients = 10000
+
+// RateLimitOptions configures a RateLimiter.
+//
+// Rate is the number of requests per second each client may make on average, and Burst is how many it may make at once, defaulting to the rate rounded up. Key is what identifies a client: "ip" for the address of the connection, which is the default, "forwarded_for" for the last address in X-Forwarded-For, as added by the nearest proxy, "query:<name>" for a query parameter such as an API key, or "header:<name>" for a request header. Requests without a value for the key are identified by their address instead.
+//
+// At most MaxClients are tracked, or DefaultRateLimitClients if it's zero. When there are more, the least recently seen client is forgotten, which gives it a full burst again if it comes back.
+type RateLimitOptions struct {
+	Rate       float64 `json:"rate"`
+	Burst      int     `json:"burst"`
+	Key        string  `json:"key"`
+	MaxClients int     `json:"max_clients"`
+}
+
+// bucket is the token bucket for a single client.
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits the rate of requests from each client with a token bucket, responding with 429 Too Many Requests to clients which go over their limit.
+type RateLimiter struct {
+	rate        float64
+	burst       float64
+	key         func(req *http.Request) string
+	max_clients int
+	now         func() time.Time
+
+	mutex   sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+// NewRateLimiter returns a RateLimiter configured by the options, or an error if they aren't valid.
+func NewRateLimiter(options *RateLimitOptions) (*RateLimiter, error) {
+	if options.Rate <= 0 {
+		return nil, fmt.Errorf("Invalid rate %v, must be a positive number of requests per second", options.Rate)
+	}
+
+	burst := options.Burst
+	if burst < 0 {
+		return nil, fmt.Errorf("Invalid burst %d, must not be negative", burst)
+	} else if burst == 0 {
+		burst = int(math.Ceil(options.Rate))
+	}
+
+	max_clients := options.MaxClients
+	if max_clients < 0 {
+		return nil, fmt.Errorf("Invalid max_clients %d, must not be negative", max_clients)
+	} else if max_clients == 0 {
+		max_clients = DefaultRateLimitClients
+	}
+
+	key, err := parseRateLimitKey(options.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RateLimiter{
+		rate:        options.Rate,
+		burst:       float64(burst),
+		key:         key,
+		max_clients: max_clients,
+		now:         time.Now,
+		buckets:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}, nil
+}
+
+// parseRateLimitKey returns a function which identifies the client making a request, as described by the key option.
+func parseRateLimitKey(key string) (func(req *http.Request) string, error) {
+	switch {
+	case len(key) == 0 || key == "ip":
+		return remoteIP, nil
+
+	case key == "forwarded_for":
+		return func(req *http.Request) string {
+			forwarded := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+			if addr := strings.TrimSpace(forwarded[len(forwarded)-1]); len(addr) > 0 {
+				return "ip:" + addr
+			}
+			return remoteIP(req)
+		}, nil
+
+	case strings.HasPrefix(key, "query:") && len(key) > len("query:"):
+		name := key[len("query:"):]
+		return func(req *http.Request) string {
+			if v := req.URL.Query().Get(name); len(v) > 0 {
+				return "query:" + v
+			}
+			return remoteIP(req)
+		}, nil
+
+	case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+		name := key[len("header:"):]
+		return func(req *http.Request) string {
+			if v := req.Header.Get(name); len(v) > 0 {
+				return "header:" + v
+			}
+			return remoteIP(req)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Invalid rate limit key %#v, expected \"ip\", \"forwarded_for\", \"query:<name>\" or \"header:<name>\"", key)
+}
+
+// remoteIP identifies a client by the address of its connection, without the port, which changes from connection to connection.
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// allow takes a token from the client's bucket, returning true if there was one. If not, it returns how long until there will be.
+func (l *RateLimiter) allow(key string) (bool, time.Duration) {
+	now := l.now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var b *bucket
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	} else {
+		if l.lru.Len() >= l.max_clients {
+			oldest := l.lru.Back()
+			delete(l.buckets, oldest.Value.(*bucket).key)
+			l.lru.Remove(oldest)
+			rateLimitEvictions.Add(1)
+		}
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// Handler returns a handler which passes requests on to h, unless the client has gone over its limit. CORS preflight requests are always passed on, without using up a token, so that h can answer them. If cors is set, then it's the policy h applies, which is also applied to 429 responses so that browsers can tell the client was throttled.
+func (l *RateLimiter) Handler(h http.Handler, cors *CORSPolicy) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if cors != nil && isPreflight(req) {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		ok, wait := l.allow(l.key(req))
+		if !ok {
+			throttledRequests.Add(1)
+			if cors != nil {
+				cors.setHeaders(req, rw.Header())
+			}
+			// Retry-After is in whole seconds, so round up rather than telling the client to come back too soon.
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(rw, "Too many requests, please slow down", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
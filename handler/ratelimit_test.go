@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func assertThrottled(t *testing.T, h http.Handler, req *http.Request, retry_after string) {
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if len(retry_after) == 0 && rw.Code != http.StatusOK {
+		t.Fatalf("Expected request for %s to be allowed, but got status %d", req.URL, rw.Code)
+	}
+	if len(retry_after) > 0 && (rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") != retry_after) {
+		t.Fatalf("Expected request for %s to be throttled with Retry-After %#v, but got status %d and %#v", req.URL, retry_after, rw.Code, rw.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l, err := NewRateLimiter(&RateLimitOptions{Rate: 0.5, Burst: 2, Key: "query:api_key"})
+	if err != nil {
+		t.Fatalf("Unable to create rate limiter: %s", err.Error())
+	}
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+	h := l.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), nil)
+
+	app := httptest.NewRequest("GET", "/all/18/0/0.mvt?api_key=app", nil)
+	other := httptest.NewRequest("GET", "/all/18/0/0.mvt?api_key=other", nil)
+
+	before := throttledRequests.Value()
+	assertThrottled(t, h, app, "")
+	assertThrottled(t, h, app, "")
+	assertThrottled(t, h, app, "2")
+	if throttledRequests.Value() != before+1 {
+		t.Fatalf("Expected throttled request to be counted")
+	}
+
+	// each key has its own bucket.
+	assertThrottled(t, h, other, "")
+
+	// a token comes back every two seconds.
+	now = now.Add(1500 * time.Millisecond)
+	assertThrottled(t, h, app, "1")
+	now = now.Add(500 * time.Millisecond)
+	assertThrottled(t, h, app, "")
+}
+
+func TestRateLimiterCORS(t *testing.T) {
+	l, err := NewRateLimiter(&RateLimitOptions{Rate: 1, Burst: 1})
+	if err != nil {
+		t.Fatalf("Unable to create rate limiter: %s", err.Error())
+	}
+	l.now = func() time.Time { return time.Unix(1000, 0) }
+	cors := &CORSPolicy{AllowedOrigins: []string{"*"}}
+	h := l.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if isPreflight(req) {
+			cors.servePreflight(rw, req)
+		}
+	}), cors)
+
+	preflight := httptest.NewRequest("OPTIONS", "/all/0/0/0.mvt", nil)
+	preflight.Header.Set("Origin", "https://map.example.com")
+	preflight.Header.Set("Access-Control-Request-Method", "GET")
+	get := httptest.NewRequest("GET", "/all/0/0/0.mvt", nil)
+	get.Header.Set("Origin", "https://map.example.com")
+
+	// preflights don't use up the client's only token.
+	for i := 0; i < 3; i++ {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, preflight)
+		if rw.Code != http.StatusNoContent {
+			t.Fatalf("Expected preflight to be answered, but got status %d", rw.Code)
+		}
+	}
+	assertThrottled(t, h, get, "")
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, get)
+	if rw.Code != http.StatusTooManyRequests || rw.Header().Get("Access-Control-Allow-Origin") != "https://map.example.com" {
+		t.Fatalf("Expected throttled request to get CORS headers, but got status %d and %#v", rw.Code, rw.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestRateLimiterMaxClients(t *testing.T) {
+	l, err := NewRateLimiter(&RateLimitOptions{Rate: 1, MaxClients: 2})
+	if err != nil {
+		t.Fatalf("Unable to create rate limiter: %s", err.Error())
+	}
+
+	for _, key := range []string{"a", "b", "a", "c"} {
+		l.allow(key)
+	}
+	if len(l.buckets) != 2 || l.lru.Len() != 2 {
+		t.Fatalf("Expected only 2 clients to be tracked, but got %d", len(l.buckets))
+	}
+	if _, ok := l.buckets["b"]; ok {
+		t.Fatalf("Expected least recently seen client to be forgotten")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "/all/0/0/0.mvt?key=secret", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+	req.Header.Set("X-Api-Key", "header-secret")
+
+	tests := []struct {
+		key, expected string
+	}{
+		{"", "ip:192.0.2.1"},
+		{"ip", "ip:192.0.2.1"},
+		{"forwarded_for", "ip:198.51.100.7"},
+		{"query:key", "query:secret"},
+		{"query:missing", "ip:192.0.2.1"},
+		{"header:X-Api-Key", "header:header-secret"},
+	}
+
+	for _, test := range tests {
+		key, err := parseRateLimitKey(test.key)
+		if err != nil {
+			t.Fatalf("Unable to parse rate limit key %#v: %s", test.key, err.Error())
+		}
+		if k := key(req); k != test.expected {
+			t.Fatalf("Expected rate limit key %#v to identify the client as %#v, but got %#v", test.key, test.expected, k)
+		}
+	}
+
+	for _, invalid := range []string{"cookie", "query:", "header:"} {
+		if _, err := parseRateLimitKey(invalid); err == nil {
+			t.Fatalf("Expected rate limit key %#v to be invalid", invalid)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/tilezen/xonacatl"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// maxStyleSize is the largest style document which clients may POST.
+const maxStyleSize = 4 << 20
+
+// StyleRegistry holds the styles which tile requests may refer to with the "style" query parameter. These are either configured when the server starts, or POSTed by clients. To bound memory use, only the most recent max_posted styles POSTed by clients are kept.
+type StyleRegistry struct {
+	mutex      sync.RWMutex
+	styles     map[string]*xonacatl.Style
+	posted     []string
+	max_posted int
+}
+
+// NewStyleRegistry returns an empty registry, which keeps at most max_posted styles POSTed by clients.
+func NewStyleRegistry(max_posted int) *StyleRegistry {
+	return &StyleRegistry{
+		styles:     make(map[string]*xonacatl.Style),
+		max_posted: max_posted,
+	}
+}
+
+// Get returns the style with the given ID, or false if there isn't one.
+func (s *StyleRegistry) Get(id string) (*xonacatl.Style, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	style, ok := s.styles[id]
+	return style, ok
+}
+
+// LoadFile reads a style from a file, registering it under the given ID.
+func (s *StyleRegistry) LoadFile(id, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	style, err := xonacatl.ParseStyle(file)
+	if err != nil {
+		return fmt.Errorf("Unable to parse style %#v: %s", path, err.Error())
+	}
+
+	s.mutex.Lock()
+	s.styles[id] = style
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// addPosted registers a style POSTed by a client, evicting the oldest POSTed style if there are too many.
+func (s *StyleRegistry) addPosted(id string, style *xonacatl.Style) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.styles[id]; ok {
+		return
+	}
+
+	if len(s.posted) >= s.max_posted && len(s.posted) > 0 {
+		delete(s.styles, s.posted[0])
+		s.posted = s.posted[1:]
+	}
+
+	s.styles[id] = style
+	s.posted = append(s.posted, id)
+}
+
+// ServeHTTP accepts a POSTed style, and responds with the ID which tile requests can use to refer to it. The ID is derived from the content of the style, so POSTing the same style again returns the same ID.
+func (s *StyleRegistry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxStyleSize+1))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxStyleSize {
+		http.Error(rw, "Style document too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	style, err := xonacatl.ParseStyle(bytes.NewReader(body))
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Unable to parse style: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	sum := sha1.Sum(body)
+	id := hex.EncodeToString(sum[:])
+	s.addPosted(id, style)
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]string{"id": id})
+}
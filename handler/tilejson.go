@@ -0,0 +1,329 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/tilezen/xonacatl"
+	"golang.org/x/sync/singleflight"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TileJSONOptions configures the TileJSON endpoint for a single pattern.
+//
+// Path is the route pattern for the TileJSON endpoint, which may contain the same "layers" and "fmt" variables as the tile pattern. If there is no "fmt" variable, then Format is used. If OriginPath is set, then the vector layers are read from the origin's own TileJSON document at that path on the origin server, otherwise they are discovered by requesting the "all" layer for each of the Samples tile coordinates from the origin. Any zoom, bounds or description given here override those from the origin.
+//
+// CacheTTL is how long the description is kept before it's fetched from the origin again, as a duration such as "1h". If it's empty, the description is kept for as long as the handler is.
+type TileJSONOptions struct {
+	Path        string    `json:"path"`
+	Format      string    `json:"format"`
+	OriginPath  string    `json:"origin_path"`
+	Samples     []string  `json:"samples"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Attribution string    `json:"attribution"`
+	MinZoom     *int      `json:"minzoom"`
+	MaxZoom     *int      `json:"maxzoom"`
+	Bounds      []float64 `json:"bounds"`
+	CacheTTL    string    `json:"cache_ttl"`
+}
+
+// TileJSONHandler serves a TileJSON document describing the tiles served by a LayersHandler.
+//
+// The description of the layers is fetched from the origin on first request for each format, and cached after that, until the CacheTTL runs out. If it can't be fetched again then, the old one is kept until it can. Concurrent first requests for a format share a single fetch, which is made without holding the lock on the cache, so that a slow origin doesn't hold up requests for documents which have already been fetched.
+type TileJSONHandler struct {
+	layers       *LayersHandler
+	tile_pattern string
+	options      *TileJSONOptions
+	ttl          time.Duration
+	now          func() time.Time
+	fetches      singleflight.Group
+
+	mutex   sync.Mutex
+	docs    map[string]*xonacatl.TileJSON
+	fetched map[string]time.Time
+}
+
+// NewTileJSONHandler returns a TileJSONHandler describing the tiles served by layers at tile_pattern, or an error if the options aren't valid.
+func NewTileJSONHandler(layers *LayersHandler, tile_pattern string, options *TileJSONOptions) (*TileJSONHandler, error) {
+	var ttl time.Duration
+	if len(options.CacheTTL) > 0 {
+		var err error
+		ttl, err = time.ParseDuration(options.CacheTTL)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("Invalid cache_ttl %#v, expected a duration such as \"1h\"", options.CacheTTL)
+		}
+	}
+
+	return &TileJSONHandler{
+		layers:       layers,
+		tile_pattern: tile_pattern,
+		options:      options,
+		ttl:          ttl,
+		now:          time.Now,
+		docs:         make(map[string]*xonacatl.TileJSON),
+		fetched:      make(map[string]time.Time),
+	}, nil
+}
+
+// fillPattern replaces the variables in a mux route pattern with their values from vars. Variables without a value are replaced with a "{name}" placeholder, as used in TileJSON URL templates.
+func fillPattern(pattern string, vars map[string]string) string {
+	var buf bytes.Buffer
+	depth := 0
+	start := 0
+
+	for i, c := range pattern {
+		if c == '{' {
+			if depth == 0 {
+				start = i
+			}
+			depth += 1
+
+		} else if c == '}' && depth > 0 {
+			depth -= 1
+			if depth == 0 {
+				name := pattern[start+1 : i]
+				if idx := strings.Index(name, ":"); idx >= 0 {
+					name = name[:idx]
+				}
+				if v, ok := vars[name]; ok {
+					buf.WriteString(v)
+				} else {
+					buf.WriteString("{" + name + "}")
+				}
+			}
+
+		} else if depth == 0 {
+			buf.WriteRune(c)
+		}
+	}
+
+	return buf.String()
+}
+
+// baseURL returns the scheme and host which the client used to make the request.
+func baseURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host
+}
+
+// tileJSONFetchTimeout limits how long fetching the description from the origin can take, as the fetch isn't tied to any one client's request.
+const tileJSONFetchTimeout = 30 * time.Second
+
+// originRequest returns the request which the description is fetched from the origin on behalf of. it isn't any client's, as the description is shared by all of them, so only the headers and parameters configured for the origin are sent, and the fetch is limited by a timeout rather than by a client going away.
+func originRequest() (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), tileJSONFetchTimeout)
+	req := (&http.Request{Method: "GET", Header: make(http.Header), Form: make(url.Values)}).WithContext(ctx)
+	return req, cancel
+}
+
+// fetchOriginTileJSON reads the origin's own TileJSON document.
+func (h *TileJSONHandler) fetchOriginTileJSON(req *http.Request) (*xonacatl.TileJSON, error) {
+	resp, err := h.layers.makeProxyRequest("GET", h.options.OriginPath, req)
+	if err != nil {
+		return nil, err
+	}
+	decodeBody(resp, false)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Origin TileJSON request returned status %d", resp.StatusCode)
+	}
+
+	var doc xonacatl.TileJSON
+	err = json.NewDecoder(resp.Body).Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+// sampleVectorLayers requests the "all" layer for each of the sample tiles from the origin, and merges the layers found in them.
+func (h *TileJSONHandler) sampleVectorLayers(format string, req *http.Request) ([]xonacatl.VectorLayer, error) {
+	samples := h.options.Samples
+	if len(samples) == 0 {
+		samples = []string{"0/0/0"}
+	}
+
+	var result []xonacatl.VectorLayer
+	for _, sample := range samples {
+		coord := strings.Split(sample, "/")
+		if len(coord) != 3 {
+			return nil, fmt.Errorf("Unable to parse sample tile %#v, expected z/x/y", sample)
+		}
+
+		origin_path, err := h.layers.route.URLPath("layers", "all", "z", coord[0], "x", coord[1], "y", coord[2], "fmt", format)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := h.layers.makeProxyRequest("GET", origin_path.Path, req)
+		if err != nil {
+			return nil, err
+		}
+		decodeBody(resp, false)
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Origin request for sample tile %#v returned status %d", sample, resp.StatusCode)
+		}
+
+		layers, err := xonacatl.VectorLayersFor(format, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		result = xonacatl.MergeVectorLayers(result, layers)
+	}
+
+	return result, nil
+}
+
+// document returns the TileJSON document for all layers in the given format, fetching it from the origin if it hasn't been already.
+func (h *TileJSONHandler) document(format string) (*xonacatl.TileJSON, error) {
+	h.mutex.Lock()
+	old, ok := h.docs[format]
+	fresh := ok && (h.ttl == 0 || h.now().Sub(h.fetched[format]) < h.ttl)
+	h.mutex.Unlock()
+	if fresh {
+		return old, nil
+	}
+
+	v, err, _ := h.fetches.Do(format, func() (interface{}, error) {
+		origin_req, cancel := originRequest()
+		defer cancel()
+		doc, err := h.fetchDocument(format, origin_req)
+		if err != nil {
+			return nil, err
+		}
+
+		h.mutex.Lock()
+		h.docs[format] = doc
+		h.fetched[format] = h.now()
+		h.mutex.Unlock()
+		return doc, nil
+	})
+	if err != nil {
+		if ok {
+			log.Printf("WARNING: Unable to refresh the %s TileJSON, keeping the old one: %s", format, err.Error())
+			return old, nil
+		}
+		return nil, err
+	}
+	return v.(*xonacatl.TileJSON), nil
+}
+
+// fetchDocument builds the TileJSON document for all layers in the given format from the origin and the options, making the origin requests on behalf of req.
+func (h *TileJSONHandler) fetchDocument(format string, req *http.Request) (*xonacatl.TileJSON, error) {
+	doc := &xonacatl.TileJSON{
+		MinZoom: 0,
+		MaxZoom: 30,
+	}
+
+	if len(h.options.OriginPath) > 0 {
+		origin_doc, err := h.fetchOriginTileJSON(req)
+		if err != nil {
+			return nil, err
+		}
+		doc = origin_doc
+
+	} else {
+		layers, err := h.sampleVectorLayers(format, req)
+		if err != nil {
+			return nil, err
+		}
+		doc.VectorLayers = layers
+	}
+
+	doc.TileJSON = xonacatl.TileJSONVersion
+	doc.Scheme = "xyz"
+	if len(h.options.Name) > 0 {
+		doc.Name = h.options.Name
+	}
+	if len(h.options.Description) > 0 {
+		doc.Description = h.options.Description
+	}
+	if len(h.options.Attribution) > 0 {
+		doc.Attribution = h.options.Attribution
+	}
+	if h.options.MinZoom != nil {
+		doc.MinZoom = *h.options.MinZoom
+	}
+	if h.options.MaxZoom != nil {
+		doc.MaxZoom = *h.options.MaxZoom
+	}
+	if len(h.options.Bounds) > 0 {
+		doc.Bounds = h.options.Bounds
+	}
+	if doc.VectorLayers == nil {
+		doc.VectorLayers = []xonacatl.VectorLayer{}
+	}
+
+	return doc, nil
+}
+
+func (h *TileJSONHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// the TileJSON is fetched by the same web maps as the tiles, so it has the same CORS policy.
+	if cors := h.layers.cors; cors != nil {
+		if isPreflight(req) {
+			corsPreflights.Add(1)
+			cors.servePreflight(rw, req)
+			return
+		}
+		cors.setHeaders(req, rw.Header())
+	}
+
+	// parse form to ensure that query parameters are available to forward to the origin.
+	err := req.ParseForm()
+	if err != nil {
+		parseFormErrors.Add(1)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// checked before the cache, so that a document fetched for one client isn't served to another which the tiles would be refused to.
+	if !h.layers.checkRequest(rw, req) {
+		return
+	}
+
+	vars := mux.Vars(req)
+	request_layers, ok := vars["layers"]
+	if !ok {
+		request_layers = "all"
+	}
+	format, ok := vars["fmt"]
+	if !ok {
+		format = h.options.Format
+	}
+
+	doc, err := h.document(format)
+	if err != nil {
+		proxyErrors.Add(1)
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	request_layers = xonacatl.CanonicalLayers(request_layers, nil)
+	// the tiles URL keeps any geometry type restrictions, but the vector layers are described by name.
+	subset := doc.Subset(xonacatl.LayerNames(request_layers))
+	tiles_path := fillPattern(h.tile_pattern, map[string]string{"layers": request_layers, "fmt": format})
+	subset.Tiles = []string{baseURL(req) + tiles_path}
+
+	rw.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(rw).Encode(subset)
+	if err != nil {
+		copyErrors.Add(1)
+	}
+}
@@ -0,0 +1,292 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/tilezen/xonacatl"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFillPattern(t *testing.T) {
+	pattern := "/{layers}/{z:[0-9]+}/{x:[0-9]{1,7}}/{y:[0-9]+}.{fmt}"
+	out := fillPattern(pattern, map[string]string{"layers": "roads,water", "fmt": "mvt"})
+	expected := "/roads,water/{z}/{x}/{y}.mvt"
+	if out != expected {
+		t.Fatalf("Expected fillPattern(%#v) to be %#v, but was %#v", pattern, expected, out)
+	}
+}
+
+func TestTileJSONSubset(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/all/0/0/0.json" {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Write([]byte(`{"water":{"type":"FeatureCollection","features":[{"type":"Feature","properties":{"kind":"ocean"}}]},"roads":{"type":"FeatureCollection","features":[]}}`))
+	}))
+	defer origin.Close()
+
+	origin_url, _ := url.Parse(origin.URL + "/{layers}/{z}/{x}/{y}.{fmt}")
+	origin_router := mux.NewRouter()
+	origin_router.NewRoute().Path(origin_url.Path).BuildOnly().Name("origin")
+
+	pattern := "/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}"
+	h := &LayersHandler{
+		origin:      origin_url,
+		route:       origin_router.GetRoute("origin"),
+		http_client: &http.Client{},
+	}
+	tj, err := NewTileJSONHandler(h, pattern, &TileJSONOptions{Path: "/{layers}/tilejson.{fmt}.json"})
+	if err != nil {
+		t.Fatalf("Unable to create TileJSON handler: %s", err.Error())
+	}
+
+	r := mux.NewRouter()
+	r.Handle(tj.options.Path, tj).Methods("GET")
+
+	req := httptest.NewRequest("GET", "http://tiles.example.com/water/tilejson.json.json", nil)
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected TileJSON request to succeed, but got status %d: %s", rw.Code, rw.Body.String())
+	}
+
+	var doc xonacatl.TileJSON
+	err = json.Unmarshal(rw.Body.Bytes(), &doc)
+	if err != nil {
+		t.Fatalf("Unable to parse TileJSON response: %s", err.Error())
+	}
+
+	expected_tiles := "http://tiles.example.com/water/{z}/{x}/{y}.json"
+	if len(doc.Tiles) != 1 || doc.Tiles[0] != expected_tiles {
+		t.Fatalf("Expected tiles to be [%#v], but was %#v", expected_tiles, doc.Tiles)
+	}
+	if len(doc.VectorLayers) != 1 || doc.VectorLayers[0].ID != "water" || doc.VectorLayers[0].Fields["kind"] != "String" {
+		t.Fatalf("Expected only the water layer, but vector_layers was %#v", doc.VectorLayers)
+	}
+}
+
+func TestTileJSONHeadFirst(t *testing.T) {
+	var methods []string
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		methods = append(methods, req.Method)
+		if req.Method != "GET" {
+			return
+		}
+		rw.Write([]byte(`{"water":{"type":"FeatureCollection","features":[{"type":"Feature","properties":{"kind":"ocean"}}]}}`))
+	})
+	defer origin.Close()
+
+	tj, err := NewTileJSONHandler(h, "/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", &TileJSONOptions{Path: "/{layers}/tilejson.{fmt}.json"})
+	if err != nil {
+		t.Fatalf("Unable to create TileJSON handler: %s", err.Error())
+	}
+	r := mux.NewRouter()
+	r.Handle(tj.options.Path, tj).Methods("GET", "HEAD")
+
+	// the first request being a HEAD mustn't leave an empty description cached.
+	for _, method := range []string{"HEAD", "GET"} {
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, httptest.NewRequest(method, "http://tiles.example.com/all/tilejson.json.json", nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Expected TileJSON %s to succeed, but got status %d: %s", method, rw.Code, rw.Body.String())
+		}
+		if method != "GET" {
+			continue
+		}
+
+		var doc xonacatl.TileJSON
+		if err := json.Unmarshal(rw.Body.Bytes(), &doc); err != nil {
+			t.Fatalf("Unable to parse TileJSON response: %s", err.Error())
+		}
+		if len(doc.VectorLayers) != 1 || doc.VectorLayers[0].ID != "water" {
+			t.Fatalf("Expected the water layer, but vector_layers was %#v", doc.VectorLayers)
+		}
+	}
+
+	for _, m := range methods {
+		if m != "GET" {
+			t.Fatalf("Expected the origin to be sampled with GET, but got %#v", methods)
+		}
+	}
+}
+
+func TestTileJSONFetchOutsideLock(t *testing.T) {
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	var mutex sync.Mutex
+	origin_requests := 0
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		origin_requests++
+		mutex.Unlock()
+		started <- true
+		<-release
+		rw.Write([]byte(`{"water":{"type":"FeatureCollection","features":[]}}`))
+	})
+	defer origin.Close()
+
+	tj, err := NewTileJSONHandler(h, "/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", &TileJSONOptions{Path: "/{layers}/tilejson.{fmt}.json"})
+	if err != nil {
+		t.Fatalf("Unable to create TileJSON handler: %s", err.Error())
+	}
+	tj.docs["mvt"] = &xonacatl.TileJSON{VectorLayers: []xonacatl.VectorLayer{}}
+	r := mux.NewRouter()
+	r.Handle(tj.options.Path, tj).Methods("GET")
+
+	serve := func(path string, codes chan int) {
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		codes <- rw.Code
+	}
+
+	// two first requests for the JSON document, while the origin is slow.
+	json_codes := make(chan int, 2)
+	go serve("http://tiles.example.com/all/tilejson.json.json", json_codes)
+	<-started
+	go serve("http://tiles.example.com/all/tilejson.json.json", json_codes)
+
+	// a document which has already been fetched is served without waiting for the origin.
+	mvt_codes := make(chan int, 1)
+	go serve("http://tiles.example.com/all/tilejson.mvt.json", mvt_codes)
+	select {
+	case code := <-mvt_codes:
+		if code != http.StatusOK {
+			t.Fatalf("Expected cached TileJSON request to succeed, but got status %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected cached TileJSON request not to wait for the origin")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-json_codes; code != http.StatusOK {
+			t.Fatalf("Expected TileJSON request to succeed, but got status %d", code)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if origin_requests != 1 {
+		t.Fatalf("Expected concurrent requests to share one fetch from the origin, but it got %d requests", origin_requests)
+	}
+}
+
+func TestTileJSONCacheTTL(t *testing.T) {
+	origin_requests := 0
+	failing := false
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		origin_requests++
+		if failing {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.Write([]byte(`{"water":{"type":"FeatureCollection","features":[]}}`))
+	})
+	defer origin.Close()
+
+	tj, err := NewTileJSONHandler(h, "/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", &TileJSONOptions{Path: "/{layers}/tilejson.{fmt}.json", CacheTTL: "1h"})
+	if err != nil {
+		t.Fatalf("Unable to create TileJSON handler: %s", err.Error())
+	}
+	now := time.Unix(1000, 0)
+	tj.now = func() time.Time { return now }
+	r := mux.NewRouter()
+	r.Handle(tj.options.Path, tj).Methods("GET")
+
+	tests := []struct {
+		later           time.Duration
+		failing         bool
+		origin_requests int
+	}{
+		{0, false, 1},
+		{30 * time.Minute, false, 1},
+		{time.Hour, false, 2},
+		// a document which can't be fetched again is kept.
+		{time.Hour, true, 3},
+	}
+	for _, test := range tests {
+		now = now.Add(test.later)
+		failing = test.failing
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, httptest.NewRequest("GET", "http://tiles.example.com/all/tilejson.json.json", nil))
+		if rw.Code != http.StatusOK || origin_requests != test.origin_requests {
+			t.Fatalf("Expected TileJSON to succeed after %d origin requests, but got status %d after %d", test.origin_requests, rw.Code, origin_requests)
+		}
+	}
+
+	if _, err = NewTileJSONHandler(h, "", &TileJSONOptions{CacheTTL: "soon"}); err == nil {
+		t.Fatalf("Expected invalid cache_ttl to be rejected")
+	}
+}
+
+func TestTileJSONFetchNotTiedToClient(t *testing.T) {
+	var origin_query, origin_header string
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		origin_query = req.URL.RawQuery
+		origin_header = req.Header.Get("X-Client")
+		rw.Write([]byte(`{"water":{"type":"FeatureCollection","features":[]}}`))
+	})
+	defer origin.Close()
+
+	tj, err := NewTileJSONHandler(h, "/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", &TileJSONOptions{Path: "/{layers}/tilejson.{fmt}.json"})
+	if err != nil {
+		t.Fatalf("Unable to create TileJSON handler: %s", err.Error())
+	}
+	r := mux.NewRouter()
+	r.Handle(tj.options.Path, tj).Methods("GET")
+
+	// the first client has already gone away, which mustn't stop the fetch.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "http://tiles.example.com/all/tilejson.json.json?api_key=secret", nil).WithContext(ctx)
+	req.Header.Set("X-Client", "first")
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected TileJSON request to succeed, but got status %d: %s", rw.Code, rw.Body.String())
+	}
+	if len(origin_query) > 0 || len(origin_header) > 0 {
+		t.Fatalf("Expected the shared fetch not to carry the client's parameters or headers, but the origin got query %#v and X-Client %#v", origin_query, origin_header)
+	}
+}
+
+func TestTileJSONTypedLayers(t *testing.T) {
+	h, origin := testOrigin(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"water":{"type":"FeatureCollection","features":[]},"roads":{"type":"FeatureCollection","features":[]}}`))
+	})
+	defer origin.Close()
+
+	tj, err := NewTileJSONHandler(h, "/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", &TileJSONOptions{Path: "/{layers}/tilejson.{fmt}.json"})
+	if err != nil {
+		t.Fatalf("Unable to create TileJSON handler: %s", err.Error())
+	}
+	r := mux.NewRouter()
+	r.Handle(tj.options.Path, tj).Methods("GET")
+
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest("GET", "http://tiles.example.com/water:polygon/tilejson.json.json", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected TileJSON request to succeed, but got status %d: %s", rw.Code, rw.Body.String())
+	}
+
+	var doc xonacatl.TileJSON
+	if err := json.Unmarshal(rw.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Unable to parse TileJSON response: %s", err.Error())
+	}
+	if len(doc.VectorLayers) != 1 || doc.VectorLayers[0].ID != "water" {
+		t.Fatalf("Expected the water layer to be described, but vector_layers was %#v", doc.VectorLayers)
+	}
+	expected_tiles := "http://tiles.example.com/water:polygon/{z}/{x}/{y}.json"
+	if len(doc.Tiles) != 1 || doc.Tiles[0] != expected_tiles {
+		t.Fatalf("Expected tiles to be [%#v], but was %#v", expected_tiles, doc.Tiles)
+	}
+}
@@ -0,0 +1,146 @@
+package xonacatl
+
+import (
+	"math"
+	"sort"
+)
+
+// boxIndexNodeSize is the maximum number of children of each node in a boxIndex.
+const boxIndexNodeSize = 16
+
+// boxIndexNode is a node in a boxIndex, covering the entries first to first+count-1 of the level below, or of the items for the lowest level.
+type boxIndexNode struct {
+	box   Box
+	first int
+	count int
+}
+
+// boxIndex is a static R-tree over a list of boxes, bulk loaded with the Sort-Tile-Recursive algorithm. It can't be changed after it's built, but that means the tree is packed full and queries visit as few nodes as possible.
+type boxIndex struct {
+	// items are the indices of the original boxes, in the order of the lowest level of nodes.
+	items []int
+	boxes []Box
+	// levels of nodes, from the leaves at levels[0] up to the single root node.
+	levels [][]boxIndexNode
+}
+
+func newBoxIndex(boxes []Box) *boxIndex {
+	idx := &boxIndex{boxes: boxes, items: make([]int, len(boxes))}
+	for i := range idx.items {
+		idx.items[i] = i
+	}
+	if len(boxes) == 0 {
+		return idx
+	}
+
+	entries := make([]boxIndexNode, len(boxes))
+	for i, b := range boxes {
+		entries[i] = boxIndexNode{box: b, first: i, count: 1}
+	}
+
+	for {
+		entries = strSort(entries)
+		if len(idx.levels) == 0 {
+			// the leaf entries are the items themselves, so remember the order they were sorted into.
+			for i, e := range entries {
+				idx.items[i] = e.first
+			}
+		}
+
+		var level []boxIndexNode
+		for i := 0; i < len(entries); i += boxIndexNodeSize {
+			end := i + boxIndexNodeSize
+			if end > len(entries) {
+				end = len(entries)
+			}
+			node := boxIndexNode{box: entries[i].box, first: i, count: end - i}
+			for _, e := range entries[i+1 : end] {
+				node.box = unionBox(node.box, e.box)
+			}
+			level = append(level, node)
+		}
+
+		if len(idx.levels) > 0 {
+			// renumber the children of the level below in the order they were sorted into.
+			below := idx.levels[len(idx.levels)-1]
+			sorted := make([]boxIndexNode, len(entries))
+			for i, e := range entries {
+				sorted[i] = below[e.first]
+			}
+			idx.levels[len(idx.levels)-1] = sorted
+		}
+
+		idx.levels = append(idx.levels, level)
+		if len(level) == 1 {
+			return idx
+		}
+
+		entries = make([]boxIndexNode, len(level))
+		for i, n := range level {
+			entries[i] = boxIndexNode{box: n.box, first: i, count: 1}
+		}
+	}
+}
+
+// strSort orders the entries so that consecutive runs of boxIndexNodeSize entries are close together: they are sorted into vertical slices by the X of their centres, and each slice is sorted by the Y of their centres.
+func strSort(entries []boxIndexNode) []boxIndexNode {
+	sort.Slice(entries, func(i, j int) bool {
+		return centreX(entries[i].box) < centreX(entries[j].box)
+	})
+
+	num_nodes := (len(entries) + boxIndexNodeSize - 1) / boxIndexNodeSize
+	slice_size := int(math.Ceil(math.Sqrt(float64(num_nodes)))) * boxIndexNodeSize
+	for i := 0; i < len(entries); i += slice_size {
+		end := i + slice_size
+		if end > len(entries) {
+			end = len(entries)
+		}
+		slice := entries[i:end]
+		sort.Slice(slice, func(i, j int) bool {
+			return centreY(slice[i].box) < centreY(slice[j].box)
+		})
+	}
+
+	return entries
+}
+
+func centreX(b Box) float64 { return (b.MinX + b.MaxX) / 2 }
+func centreY(b Box) float64 { return (b.MinY + b.MaxY) / 2 }
+
+func unionBox(a, b Box) Box {
+	return Box{
+		MinX: math.Min(a.MinX, b.MinX),
+		MinY: math.Min(a.MinY, b.MinY),
+		MaxX: math.Max(a.MaxX, b.MaxX),
+		MaxY: math.Max(a.MaxY, b.MaxY),
+	}
+}
+
+// Search calls fn with the index of each box which intersects b.
+func (idx *boxIndex) Search(b Box, fn func(i int)) {
+	if len(idx.levels) == 0 {
+		return
+	}
+	top := len(idx.levels) - 1
+	for i := range idx.levels[top] {
+		idx.search(top, i, b, fn)
+	}
+}
+
+func (idx *boxIndex) search(level, i int, b Box, fn func(i int)) {
+	node := idx.levels[level][i]
+	if !node.box.Intersects(b) {
+		return
+	}
+
+	for c := node.first; c < node.first+node.count; c++ {
+		if level == 0 {
+			item := idx.items[c]
+			if idx.boxes[item].Intersects(b) {
+				fn(item)
+			}
+		} else {
+			idx.search(level-1, c, b, fn)
+		}
+	}
+}
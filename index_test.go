@@ -0,0 +1,49 @@
+package xonacatl
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestBoxIndexSearch(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	randomBox := func(size float64) Box {
+		x, y := rnd.Float64()*100, rnd.Float64()*100
+		return Box{x, y, x + rnd.Float64()*size, y + rnd.Float64()*size}
+	}
+
+	boxes := make([]Box, 1000)
+	for i := range boxes {
+		boxes[i] = randomBox(5)
+	}
+	idx := newBoxIndex(boxes)
+
+	for n := 0; n < 100; n++ {
+		query := randomBox(20)
+
+		var expected, found []int
+		for i, b := range boxes {
+			if b.Intersects(query) {
+				expected = append(expected, i)
+			}
+		}
+		idx.Search(query, func(i int) { found = append(found, i) })
+		sort.Ints(found)
+
+		if len(found) != len(expected) {
+			t.Fatalf("Expected search for %#v to find %v, but found %v", query, expected, found)
+		}
+		for i := range found {
+			if found[i] != expected[i] {
+				t.Fatalf("Expected search for %#v to find %v, but found %v", query, expected, found)
+			}
+		}
+	}
+}
+
+func TestBoxIndexEmpty(t *testing.T) {
+	newBoxIndex(nil).Search(Box{0, 0, 1, 1}, func(i int) {
+		t.Fatalf("Expected empty index not to find anything, but found %d", i)
+	})
+}
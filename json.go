@@ -1,6 +1,7 @@
 package xonacatl
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -88,19 +89,195 @@ func (w *LayersWriter) writeDelim(s string) error {
 }
 
 type geoJSONCopier struct {
-	layers map[string]bool
+	layers  map[string]bool
+	options *CopyOptions
+}
+
+func init() {
+	RegisterFormat(&Format{
+		Extension:   "json",
+		ContentType: "application/json",
+		NewCopier: func(layers map[string]bool, options *CopyOptions) LayerCopier {
+			return NewCopyLayersWithOptions(layers, options)
+		},
+		VectorLayers: geoJSONVectorLayers,
+		Transforms:   true,
+		Rounds:       true,
+	})
 }
 
 func NewCopyLayers(layers map[string]bool) *geoJSONCopier {
-	return &geoJSONCopier{layers: layers}
+	return NewCopyLayersWithOptions(layers, nil)
+}
+
+func NewCopyLayersWithOptions(layers map[string]bool, options *CopyOptions) *geoJSONCopier {
+	return &geoJSONCopier{layers: layers, options: options}
+}
+
+// geoJSONFeature is the part of a GeoJSON feature needed to make a Feature for filtering. The rest of the feature isn't parsed, so it can be copied through unchanged.
+type geoJSONFeature struct {
+	Geometry *struct {
+		Type string `json:"type"`
+	} `json:"geometry"`
+	Id         interface{}            `json:"id"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// processLayer returns the layer's FeatureCollection with any feature-level options applied. If there are none for this layer, the original is returned unmodified.
+func (c *geoJSONCopier) processLayer(ctx context.Context, name string, m json.RawMessage) (json.RawMessage, error) {
+	m, err := c.processFeatures(ctx, name, m)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.options != nil && c.options.Precision != nil {
+		m = roundCoordinates(m, *c.options.Precision)
+	}
+
+	return m, nil
+}
+
+// processFeatures applies the geometry type restriction, feature filter and geometry transforms, if any, to each feature in the layer.
+func (c *geoJSONCopier) processFeatures(ctx context.Context, name string, m json.RawMessage) (json.RawMessage, error) {
+	types := c.options.geometryTypesFor(name)
+	filter := c.options.filterFor(name)
+	transform := c.options.lonLatTransform(name)
+	if types == nil && filter == nil && transform == nil {
+		return m, nil
+	}
+
+	return mapJSONArray(m, "features", func(raw json.RawMessage) (json.RawMessage, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if types != nil || filter != nil {
+			var f geoJSONFeature
+			err := json.Unmarshal(raw, &f)
+			if err != nil {
+				return nil, err
+			}
+
+			if types != nil && (f.Geometry == nil || !types[f.Geometry.Type]) {
+				return nil, nil
+			}
+
+			if filter != nil {
+				feature := Feature{
+					Layer:        name,
+					GeometryType: "Unknown",
+					Id:           f.Id,
+					Properties:   f.Properties,
+				}
+				if f.Geometry != nil {
+					feature.GeometryType = baseGeometryType(f.Geometry.Type)
+				}
+
+				if !filter.KeepFeature(&feature) {
+					return nil, nil
+				}
+			}
+		}
+
+		if transform != nil {
+			return transformGeoJSONFeature(raw, transform)
+		}
+
+		return raw, nil
+	})
+}
+
+// transformGeoJSONFeature applies the transform to the geometry of the feature, returning nil if nothing remains of it. Features with geometries which can't be transformed are returned unchanged.
+func transformGeoJSONFeature(raw json.RawMessage, transform geometryTransform) (json.RawMessage, error) {
+	var f map[string]json.RawMessage
+	err := json.Unmarshal(raw, &f)
+	if err != nil {
+		return nil, err
+	}
+
+	geometry, ok := f["geometry"]
+	if !ok {
+		return raw, nil
+	}
+
+	g, err := decodeGeoJSONGeometry(geometry)
+	if err != nil {
+		return nil, err
+	}
+	if g == nil {
+		return raw, nil
+	}
+
+	g = transform(g)
+	if g == nil {
+		return nil, nil
+	}
+
+	f["geometry"], err = encodeGeoJSONGeometry(g)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(f)
+}
+
+// mapJSONArray returns a copy of the JSON object m with each element of the array under key replaced by the result of calling fn on it, or removed if fn returns nil. If m has no such key, it is returned as-is.
+func mapJSONArray(m json.RawMessage, key string, fn func(json.RawMessage) (json.RawMessage, error)) (json.RawMessage, error) {
+	var obj map[string]json.RawMessage
+	err := json.Unmarshal(m, &obj)
+	if err != nil {
+		return nil, err
+	}
+
+	raw_array, ok := obj[key]
+	if !ok {
+		return m, nil
+	}
+
+	var elements []json.RawMessage
+	err = json.Unmarshal(raw_array, &elements)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make([]json.RawMessage, 0, len(elements))
+	for _, raw := range elements {
+		result, err := fn(raw)
+		if err != nil {
+			return nil, err
+		}
+		if result != nil {
+			kept = append(kept, result)
+		}
+	}
+
+	obj[key], err = json.Marshal(kept)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(obj)
 }
 
 func (c *geoJSONCopier) CopyLayers(rd io.Reader, wr io.Writer) error {
+	return c.CopyLayersContext(context.Background(), rd, wr)
+}
+
+func (c *geoJSONCopier) CopyLayersContext(ctx context.Context, rd io.Reader, wr io.Writer) error {
+	return c.copyLayers(ctx, rd, wr, nil)
+}
+
+func (c *geoJSONCopier) CopyLayersStats(ctx context.Context, rd io.Reader, wr io.Writer) (*CopyStats, error) {
+	return copyWithStats(ctx, rd, wr, c.copyLayers)
+}
+
+// copyLayers copies the layers, collecting statistics if stats is not nil.
+func (c *geoJSONCopier) copyLayers(ctx context.Context, rd io.Reader, wr io.Writer, stats *CopyStats) error {
 	var err error
 	var num_layers int
 
 	// we use a streaming model here to avoid having to Unmarshal the whole document. the upstream server goes to some length to use the right number of digits of precision for the floating point coordinates depending on the zoom level. Unmarshalling and re-Marshalling here would mean treating that very carefully to ensure the same behaviour, whereas a streaming approach means we can ignore it and stream back the bytes of the original document unmodified. also, Unmarshal and Marshal can be quite time and memory consuming because of the size of the JSON tree, so avoiding them is a double benefit.
-	dec := json.NewDecoder(rd)
+	dec := json.NewDecoder(&contextReader{ctx: ctx, rd: rd})
 
 	num_layers = 0
 	for _, v := range c.layers {
@@ -115,7 +292,7 @@ func (c *geoJSONCopier) CopyLayers(rd io.Reader, wr io.Writer) error {
 	}
 	enc := &LayersWriter{
 		wr:          wr,
-		multi_layer: num_layers > 1,
+		multi_layer: num_layers > 1 || c.layers["all"],
 		layer:       0,
 	}
 
@@ -126,6 +303,10 @@ func (c *geoJSONCopier) CopyLayers(rd io.Reader, wr io.Writer) error {
 	}
 
 	for dec.More() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
 		var tok json.Token
 		// the RawMessage value means the document is parsed, but doesn't create an in-memory representation of the JSON document as Unmarshal does. this is both faster and avoids issues around precision of floating point numbers (see longer comment above).
 		var m json.RawMessage
@@ -144,7 +325,17 @@ func (c *geoJSONCopier) CopyLayers(rd io.Reader, wr io.Writer) error {
 			return err
 		}
 
-		if c.layers[k] {
+		stats.seeLayer(k, len(m))
+
+		if KeepLayer(c.layers, k) && !c.options.dropLayer(k) {
+			m, err = c.processLayer(ctx, k, m)
+			if err != nil {
+				return err
+			}
+			if stats != nil {
+				stats.keepLayer(k, countJSONArray(m, "features"))
+			}
+
 			err = enc.WriteLayer(k, &m)
 			if err != nil {
 				return err
@@ -55,3 +55,45 @@ func TestNonEmptyWithLayers(t *testing.T) {
 	json := "{\"foo\":{\"bar\":false},\"zzz\":false}"
 	runCopyAssertOutput(json, map[string]bool{"foo": true, "zzz": true}, json, t)
 }
+
+func TestFilterFeatures(t *testing.T) {
+	json := `{"roads":{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"LineString","coordinates":[[0.123456789,1],[2,3]]},"properties":{"kind":"highway"}},{"type":"Feature","geometry":{"type":"LineString","coordinates":[[0,1],[2,3]]},"properties":{"kind":"path"}}]},"water":{"type":"FeatureCollection","features":[]}}`
+	options := &CopyOptions{
+		Filters: map[string]FeatureFilter{
+			"roads": FeatureFilterFunc(func(f *Feature) bool {
+				return f.GeometryType == "LineString" && f.Properties["kind"] == "highway"
+			}),
+		},
+	}
+
+	var buf bytes.Buffer
+	copier := NewCopyLayersWithOptions(map[string]bool{"roads": true}, options)
+	err := copier.CopyLayers(strings.NewReader(json), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+
+	expected := `{"features":[{"type":"Feature","geometry":{"type":"LineString","coordinates":[[0.123456789,1],[2,3]]},"properties":{"kind":"highway"}}],"type":"FeatureCollection"}`
+	if buf.String() != expected {
+		t.Fatalf("Expected filtered output to be %#v, but was %#v", expected, buf.String())
+	}
+}
+
+func TestGeometryTypes(t *testing.T) {
+	json := `{"places":{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[0,1]},"properties":{}},{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]},"properties":{}},{"type":"Feature","geometry":null,"properties":{}}]}}`
+	options := &CopyOptions{
+		GeometryTypes: map[string]GeometryTypes{"places": {"Point": true, "MultiPoint": true}},
+	}
+
+	var buf bytes.Buffer
+	copier := NewCopyLayersWithOptions(map[string]bool{"places": true}, options)
+	err := copier.CopyLayers(strings.NewReader(json), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+
+	expected := `{"features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[0,1]},"properties":{}}],"type":"FeatureCollection"}`
+	if buf.String() != expected {
+		t.Fatalf("Expected output restricted to points to be %#v, but was %#v", expected, buf.String())
+	}
+}
@@ -1,7 +1,153 @@
 package xonacatl
 
-import "io"
+import (
+	"context"
+	"io"
+)
 
 type LayerCopier interface {
 	CopyLayers(io.Reader, io.Writer) error
 }
+
+// ContextLayerCopier is a LayerCopier which stops early, returning the context's error, if the context is cancelled while it is copying. The copiers in this package check for cancellation between layers and features.
+type ContextLayerCopier interface {
+	LayerCopier
+	CopyLayersContext(context.Context, io.Reader, io.Writer) error
+}
+
+// WithContext returns a ContextLayerCopier for the copier. If the copier doesn't already support contexts, it is wrapped so that the context is checked before each read of the input, which stops it the next time it needs more input.
+func WithContext(c LayerCopier) ContextLayerCopier {
+	if cc, ok := c.(ContextLayerCopier); ok {
+		return cc
+	}
+	return &contextCopier{c}
+}
+
+type contextCopier struct {
+	LayerCopier
+}
+
+func (c *contextCopier) CopyLayersContext(ctx context.Context, rd io.Reader, wr io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.CopyLayers(&contextReader{ctx: ctx, rd: rd}, wr)
+}
+
+// contextReader is a reader which fails with the context's error once the context is cancelled.
+type contextReader struct {
+	ctx context.Context
+	rd  io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.rd.Read(p)
+}
+
+// CopyOptions are the optional settings for a LayerCopier, beyond the set of layers to keep. The zero value keeps every feature in the kept layers unchanged.
+type CopyOptions struct {
+	// Filters maps layer names to a filter deciding which features to keep in that layer. Layers without a filter keep all their features.
+	Filters map[string]FeatureFilter
+
+	// GeometryTypes maps layer names to the geometry types to keep in that layer, with the entry for "all" applying to layers without one of their own. Layers without an entry keep features of every type.
+	GeometryTypes map[string]GeometryTypes
+
+	// Overzoom, if set, means that the input is an ancestor of the requested tile, and geometries are rescaled and clipped to the requested tile.
+	Overzoom *Overzoom
+
+	// Masks, if set, restricts layers to the regions covered by their masks, after any overzoom clipping.
+	Masks *Masks
+
+	// Clip, if set, drops features which don't intersect a bounding box, after any overzoom clipping. TopoJSON geometries are only ever dropped, not clipped, as their arcs may be shared with other geometries.
+	Clip *Clip
+
+	// Simplify, if set, simplifies lines and polygons after any overzoom clipping.
+	Simplify *Simplify
+
+	// Precision, if set, is the number of decimal places to round GeoJSON coordinates to. Property values are not changed.
+	Precision *int
+}
+
+// filterFor returns the feature filter for the layer, or nil if all features in the layer should be kept.
+func (o *CopyOptions) filterFor(layer string) FeatureFilter {
+	if o == nil || o.Filters == nil {
+		return nil
+	}
+	return o.Filters[layer]
+}
+
+// geometryTypesFor returns the geometry types to keep in the layer, or nil if features of every type should be kept.
+func (o *CopyOptions) geometryTypesFor(layer string) GeometryTypes {
+	if o == nil || o.GeometryTypes == nil {
+		return nil
+	}
+	if types, ok := o.GeometryTypes[layer]; ok {
+		return types
+	}
+	return o.GeometryTypes["all"]
+}
+
+// dropLayer returns true if the whole layer should be dropped, because it is entirely outside its mask.
+func (o *CopyOptions) dropLayer(layer string) bool {
+	if o == nil || o.Masks == nil {
+		return false
+	}
+	return o.Masks.layerRelation(layer) == maskOutside
+}
+
+// mvtTransform returns the transform to apply to geometries in the layer, which are in tile units with the given extent, or nil if they should be kept unchanged.
+func (o *CopyOptions) mvtTransform(layer string, extent uint32) geometryTransform {
+	if o == nil {
+		return nil
+	}
+
+	var overzoom, mask, clip, simplify geometryTransform
+	if o.Overzoom != nil {
+		overzoom = o.Overzoom.mvtTransform(extent)
+	}
+	if o.Masks != nil {
+		mask = o.Masks.mvtTransform(layer, extent)
+	}
+	if o.Clip != nil {
+		clip = o.Clip.mvtTransform(extent)
+	}
+	if o.Simplify != nil {
+		simplify = o.Simplify.mvtTransform(extent)
+	}
+
+	return composeTransforms(overzoom, mask, clip, simplify)
+}
+
+// lonLatTransform returns the transform to apply to geometries in the layer, which are in longitude and latitude, or nil if they should be kept unchanged.
+func (o *CopyOptions) lonLatTransform(layer string) geometryTransform {
+	if o == nil {
+		return nil
+	}
+
+	var overzoom, mask, clip, simplify geometryTransform
+	if o.Overzoom != nil {
+		overzoom = o.Overzoom.lonLatTransform()
+	}
+	if o.Masks != nil {
+		mask = o.Masks.lonLatTransform(layer)
+	}
+	if o.Clip != nil {
+		clip = o.Clip.lonLatTransform()
+	}
+	if o.Simplify != nil {
+		simplify = o.Simplify.lonLatTransform()
+	}
+
+	return composeTransforms(overzoom, mask, clip, simplify)
+}
+
+// KeepLayer returns true if the layer is in the set, or the set contains "all" and the layer hasn't been excluded from it by being set to false.
+func KeepLayer(layers map[string]bool, name string) bool {
+	if keep, ok := layers[name]; ok {
+		return keep
+	}
+	return layers["all"]
+}
@@ -0,0 +1,67 @@
+package xonacatl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCopiersCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	layers := map[string]bool{"water": true}
+	tests := []struct {
+		copier ContextLayerCopier
+		input  string
+	}{
+		{NewCopyLayers(layers), `{"water":{"type":"FeatureCollection","features":[]}}`},
+		{NewCopyTopoJSONLayers(layers), `{"type":"Topology","objects":{"water":{}},"arcs":[]}`},
+		{NewCopyMVTLayers(layers), ""},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := test.copier.CopyLayersContext(ctx, strings.NewReader(test.input), &buf)
+		if err != context.Canceled {
+			t.Fatalf("Expected %T to return the context's error, but got %v", test.copier, err)
+		}
+	}
+}
+
+// readAllCopier is a LayerCopier which doesn't support contexts itself.
+type readAllCopier struct{}
+
+func (_ *readAllCopier) CopyLayers(rd io.Reader, wr io.Writer) error {
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	_, err = wr.Write(data)
+	return err
+}
+
+func TestWithContext(t *testing.T) {
+	copier := WithContext(&readAllCopier{})
+
+	var buf bytes.Buffer
+	err := copier.CopyLayersContext(context.Background(), strings.NewReader("tile"), &buf)
+	if err != nil || buf.String() != "tile" {
+		t.Fatalf("Expected adapted copier to copy the input, but got %#v, error %v", buf.String(), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = copier.CopyLayersContext(ctx, strings.NewReader("tile"), &buf)
+	if err != context.Canceled {
+		t.Fatalf("Expected adapted copier to return the context's error, but got %v", err)
+	}
+
+	json_copier := NewCopyLayers(map[string]bool{"water": true})
+	if WithContext(json_copier) != ContextLayerCopier(json_copier) {
+		t.Fatalf("Expected a copier which supports contexts not to be wrapped")
+	}
+}
@@ -0,0 +1,160 @@
+package xonacatl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// GeometryTypes is a set of GeoJSON geometry type names, such as "Point" or "MultiPolygon".
+type GeometryTypes map[string]bool
+
+// geometryTypeNames maps the lower case names usable in layer lists to the geometry types they match. A single geometry type also matches its multi variant.
+var geometryTypeNames = map[string][]string{
+	"point":           {"Point", "MultiPoint"},
+	"multipoint":      {"MultiPoint"},
+	"linestring":      {"LineString", "MultiLineString"},
+	"multilinestring": {"MultiLineString"},
+	"polygon":         {"Polygon", "MultiPolygon"},
+	"multipolygon":    {"MultiPolygon"},
+}
+
+// splitLayer splits an item from a layer list into the layer name and the geometry types part, if any.
+func splitLayer(item string) (string, string) {
+	if idx := strings.Index(item, ":"); idx >= 0 {
+		return item[:idx], item[idx+1:]
+	}
+	return item, ""
+}
+
+// parseGeometryTypes parses a "+" separated list of geometry type names, such as "point+linestring".
+func parseGeometryTypes(s string) (GeometryTypes, error) {
+	types := make(GeometryTypes)
+	for _, name := range strings.Split(s, "+") {
+		matches, ok := geometryTypeNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown geometry type %#v", name)
+		}
+		for _, t := range matches {
+			types[t] = true
+		}
+	}
+	return types, nil
+}
+
+// String returns the canonical form of the geometry types, as used in layer lists.
+func (t GeometryTypes) String() string {
+	var names []string
+	for _, base := range []string{"Point", "LineString", "Polygon"} {
+		if t[base] {
+			names = append(names, strings.ToLower(base))
+		} else if t["Multi"+base] {
+			names = append(names, "multi"+strings.ToLower(base))
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, "+")
+}
+
+// LayerNames returns the set of layer names in a comma-separated list of layers. Each item in the list may restrict the layer to some geometry types with a suffix, such as "pois:point", which is ignored here.
+func LayerNames(layers string) map[string]bool {
+	names := make(map[string]bool)
+	for _, l := range strings.Split(layers, ",") {
+		name, _ := splitLayer(l)
+		names[name] = true
+	}
+	return names
+}
+
+// ParseGeometryTypes returns the geometry types which each layer in a comma-separated list of layers is restricted to, keyed by layer name. For example, "places:point,landuse:polygon+multipolygon,water" restricts places to points and landuse to polygons, but doesn't restrict water.
+//
+// The type names are case-insensitive. A single geometry type, such as "point", also matches its multi variant, whereas a multi type, such as "multipoint", only matches itself. Where a layer appears more than once, the restrictions are combined. A restriction on "all" applies to every layer without a restriction of its own.
+func ParseGeometryTypes(layers string) (map[string]GeometryTypes, error) {
+	result := make(map[string]GeometryTypes)
+	unrestricted := make(map[string]bool)
+
+	for _, l := range strings.Split(layers, ",") {
+		name, types_spec := splitLayer(l)
+		if len(types_spec) == 0 {
+			unrestricted[name] = true
+			continue
+		}
+
+		types, err := parseGeometryTypes(types_spec)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse layer %#v: %s", l, err.Error())
+		}
+
+		if result[name] == nil {
+			result[name] = make(GeometryTypes)
+		}
+		for t := range types {
+			result[name][t] = true
+		}
+	}
+
+	for name := range unrestricted {
+		delete(result, name)
+	}
+
+	return result, nil
+}
+
+// CanonicalLayers returns the canonical form of a comma-separated list of layers.
+//
+// The canonical form has empty and duplicate names removed and is sorted, so that requests for the same set of layers all map to the same URL, which is better for caching. If the known set is non-nil, then any layer not in it is removed too. Since "all" includes every other layer, a list containing it is canonicalised to just "all". Geometry type restrictions are combined and written in a canonical order, and items with invalid restrictions are removed.
+func CanonicalLayers(layers string, known map[string]bool) string {
+	types := make(map[string]GeometryTypes)
+	unrestricted := make(map[string]bool)
+	var names []string
+
+	for _, l := range strings.Split(layers, ",") {
+		name, types_spec := splitLayer(l)
+		if len(types_spec) == 0 && name == "all" {
+			return "all"
+		}
+		if len(name) == 0 {
+			continue
+		}
+		if known != nil && name != "all" && !known[name] {
+			continue
+		}
+
+		if len(types_spec) == 0 {
+			unrestricted[name] = true
+		} else {
+			t, err := parseGeometryTypes(types_spec)
+			if err != nil {
+				continue
+			}
+			if types[name] == nil {
+				types[name] = make(GeometryTypes)
+			}
+			for k := range t {
+				types[name][k] = true
+			}
+		}
+
+		if !unrestricted[name] || len(types_spec) == 0 {
+			names = append(names, name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var items []string
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if t, ok := types[name]; ok && !unrestricted[name] {
+			items = append(items, name+":"+t.String())
+		} else {
+			items = append(items, name)
+		}
+	}
+
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,82 @@
+package xonacatl
+
+import (
+	"testing"
+)
+
+func assertCanonical(input string, known map[string]bool, expected string, t *testing.T) {
+	out := CanonicalLayers(input, known)
+	if out != expected {
+		t.Fatalf("Expected CanonicalLayers(%#v) to be %#v, but instead was %#v", input, expected, out)
+	}
+}
+
+func TestCanonicalAlreadyCanonical(t *testing.T) {
+	assertCanonical("roads,water", nil, "roads,water", t)
+}
+
+func TestCanonicalSorts(t *testing.T) {
+	assertCanonical("water,roads", nil, "roads,water", t)
+}
+
+func TestCanonicalRemovesDuplicates(t *testing.T) {
+	assertCanonical("roads,roads,water", nil, "roads,water", t)
+}
+
+func TestCanonicalRemovesEmpty(t *testing.T) {
+	assertCanonical(",roads,,water,", nil, "roads,water", t)
+}
+
+func TestCanonicalRemovesUnknown(t *testing.T) {
+	known := map[string]bool{"roads": true, "water": true}
+	assertCanonical("water,foo,roads", known, "roads,water", t)
+}
+
+func TestCanonicalAll(t *testing.T) {
+	assertCanonical("water,all,roads", nil, "all", t)
+}
+
+func TestCanonicalGeometryTypes(t *testing.T) {
+	assertCanonical("pois:Point,landuse:multipolygon+polygon", nil, "landuse:polygon,pois:point", t)
+}
+
+func TestCanonicalCombinesGeometryTypes(t *testing.T) {
+	assertCanonical("roads:point,roads:linestring,water:multipolygon", nil, "roads:linestring+point,water:multipolygon", t)
+}
+
+func TestCanonicalUnrestrictedWins(t *testing.T) {
+	assertCanonical("roads:point,roads", nil, "roads", t)
+}
+
+func TestCanonicalRemovesInvalidGeometryTypes(t *testing.T) {
+	known := map[string]bool{"pois": true, "water": true}
+	assertCanonical("water,pois:foo,roads:point", known, "water", t)
+}
+
+func TestLayerNames(t *testing.T) {
+	names := LayerNames("pois:point,water")
+	if len(names) != 2 || !names["pois"] || !names["water"] {
+		t.Fatalf("Expected layer names to be pois and water, but were %#v", names)
+	}
+}
+
+func TestParseGeometryTypes(t *testing.T) {
+	types, err := ParseGeometryTypes("pois:point,landuse:multipolygon,water,roads:point,roads")
+	if err != nil {
+		t.Fatalf("ParseGeometryTypes failed, error: %s", err.Error())
+	}
+	if len(types) != 2 {
+		t.Fatalf("Expected only pois and landuse to be restricted, but got %#v", types)
+	}
+	if !types["pois"]["Point"] || !types["pois"]["MultiPoint"] || types["pois"]["Polygon"] {
+		t.Fatalf("Expected pois to be restricted to points, but got %#v", types["pois"])
+	}
+	if !types["landuse"]["MultiPolygon"] || types["landuse"]["Polygon"] {
+		t.Fatalf("Expected landuse to be restricted to multipolygons, but got %#v", types["landuse"])
+	}
+
+	_, err = ParseGeometryTypes("pois:circle")
+	if err == nil {
+		t.Fatalf("Expected unknown geometry type to be an error")
+	}
+}
@@ -0,0 +1,572 @@
+package xonacatl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// Mask is a region made of polygons in longitude and latitude, used to restrict layers to the areas in which they may be served. Overlapping polygons and holes follow the even-odd rule.
+//
+// The edges of the polygons are kept in a spatial index, so that finding the relation of a tile to the mask and clipping features to it only looks at the parts of the mask near the tile, however large the mask is.
+type Mask struct {
+	// edges are oriented with the interior of the mask on their left.
+	edges  []maskEdge
+	index  *boxIndex
+	bounds Box
+}
+
+type maskEdge struct {
+	a, b Point
+}
+
+func (e maskEdge) box() Box {
+	return Box{math.Min(e.a[0], e.b[0]), math.Min(e.a[1], e.b[1]), math.Max(e.a[0], e.b[0]), math.Max(e.a[1], e.b[1])}
+}
+
+// NewMask returns a mask covering the polygons, which are in longitude and latitude. Each polygon is a list of closed rings, the first of which is the exterior.
+func NewMask(polygons [][][]Point) *Mask {
+	m := &Mask{}
+
+	for _, polygon := range polygons {
+		for _, ring := range orientPolygon(polygon) {
+			for j := 0; j+1 < len(ring); j++ {
+				if ring[j] != ring[j+1] {
+					m.edges = append(m.edges, maskEdge{ring[j], ring[j+1]})
+				}
+			}
+		}
+	}
+
+	boxes := make([]Box, len(m.edges))
+	for i, e := range m.edges {
+		boxes[i] = e.box()
+		if i == 0 {
+			m.bounds = boxes[i]
+		} else {
+			m.bounds = unionBox(m.bounds, boxes[i])
+		}
+	}
+	m.index = newBoxIndex(boxes)
+
+	return m
+}
+
+// ParseMask reads a mask from a GeoJSON document, which may be a FeatureCollection, Feature, GeometryCollection or a bare geometry. All the geometries must be Polygons or MultiPolygons.
+func ParseMask(rd io.Reader) (*Mask, error) {
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry json.RawMessage `json:"geometry"`
+		} `json:"features"`
+		Geometry   json.RawMessage   `json:"geometry"`
+		Geometries []json.RawMessage `json:"geometries"`
+	}
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse mask: %s", err.Error())
+	}
+
+	var raw_geometries []json.RawMessage
+	switch doc.Type {
+	case "FeatureCollection":
+		for _, f := range doc.Features {
+			raw_geometries = append(raw_geometries, f.Geometry)
+		}
+	case "Feature":
+		raw_geometries = append(raw_geometries, doc.Geometry)
+	case "GeometryCollection":
+		raw_geometries = doc.Geometries
+	default:
+		raw_geometries = append(raw_geometries, data)
+	}
+
+	var polygons [][][]Point
+	for _, raw := range raw_geometries {
+		g, err := decodeGeoJSONGeometry(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse mask: %s", err.Error())
+		}
+		if g == nil || baseGeometryType(g.Type) != "Polygon" {
+			return nil, fmt.Errorf("Unable to use a non-polygon geometry as a mask")
+		}
+		polygons = append(polygons, g.Polygons...)
+	}
+
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("Unable to use a mask without any polygons")
+	}
+
+	return NewMask(polygons), nil
+}
+
+// orientPolygon returns a copy of the polygon with the exterior ring wound anti-clockwise, i.e: with a positive area, and the holes wound clockwise, so that the interior is always on the left of each edge.
+func orientPolygon(polygon [][]Point) [][]Point {
+	result := make([][]Point, len(polygon))
+	for i, ring := range polygon {
+		if (i == 0) != (ringArea(ring) > 0) {
+			ring = reverseRing(ring)
+		}
+		result[i] = ring
+	}
+	return result
+}
+
+func reverseRing(ring []Point) []Point {
+	result := make([]Point, len(ring))
+	for i, p := range ring {
+		result[len(ring)-1-i] = p
+	}
+	return result
+}
+
+type maskRelation int
+
+const (
+	maskOutside maskRelation = iota
+	maskInside
+	maskBoundary
+)
+
+// maskProjection converts between longitude and latitude and the coordinates of the geometries being masked. Each axis must depend only on the corresponding axis of longitude and latitude, and monotonically, so that boxes project to boxes.
+type maskProjection interface {
+	project(Point) Point
+	unproject(Point) Point
+	// flipsY is true if the projection reverses the Y axis, which reverses the winding of rings.
+	flipsY() bool
+}
+
+type lonLatProjection struct{}
+
+func (lonLatProjection) project(p Point) Point   { return p }
+func (lonLatProjection) unproject(p Point) Point { return p }
+func (lonLatProjection) flipsY() bool            { return false }
+
+// maxMercatorLat is the latitude of the top edge of the web mercator world, beyond which latitudes can't be projected.
+var maxMercatorLat = tileLat(0, 0)
+
+// tileProjection projects longitude and latitude into the tile units of a tile.
+type tileProjection struct {
+	tile   TileCoord
+	extent float64
+}
+
+func (t tileProjection) project(p Point) Point {
+	lat := math.Max(-maxMercatorLat, math.Min(maxMercatorLat, p[1]))
+	return Point{
+		(lonTileX(p[0], t.tile.Z) - float64(t.tile.X)) * t.extent,
+		(latTileY(lat, t.tile.Z) - float64(t.tile.Y)) * t.extent,
+	}
+}
+
+func (t tileProjection) unproject(p Point) Point {
+	return Point{
+		tileLon(p[0]/t.extent+float64(t.tile.X), t.tile.Z),
+		tileLat(p[1]/t.extent+float64(t.tile.Y), t.tile.Z),
+	}
+}
+
+func (t tileProjection) flipsY() bool { return true }
+
+// maskView is a mask as seen in the coordinates of a projection.
+type maskView struct {
+	mask *Mask
+	proj maskProjection
+}
+
+// lonLatBox returns the box in longitude and latitude covering b. It is grown by a small amount, so that rounding in the projection doesn't miss edges which just touch b.
+func (v *maskView) lonLatBox(b Box) Box {
+	p := v.proj.unproject(Point{b.MinX, b.MinY})
+	q := v.proj.unproject(Point{b.MaxX, b.MaxY})
+	return Box{math.Min(p[0], q[0]), math.Min(p[1], q[1]), math.Max(p[0], q[0]), math.Max(p[1], q[1])}.Expand(1e-9, 1e-9)
+}
+
+// edges calls fn with each of the mask's edges which may intersect b, projected and still oriented with the interior of the mask on their left.
+func (v *maskView) edges(b Box, fn func(a, b Point)) {
+	v.mask.index.Search(v.lonLatBox(b), func(i int) {
+		e := v.mask.edges[i]
+		a, b := v.proj.project(e.a), v.proj.project(e.b)
+		if v.proj.flipsY() {
+			a, b = b, a
+		}
+		fn(a, b)
+	})
+}
+
+// contains returns true if the point is inside the mask, by counting the edges crossed by a ray from the point towards negative X.
+func (v *maskView) contains(p Point) bool {
+	q := v.proj.unproject(p)
+	ray := Box{v.mask.bounds.MinX, q[1], q[0], q[1]}.Expand(1e-9, 1e-9)
+
+	inside := false
+	v.mask.index.Search(ray, func(i int) {
+		e := v.mask.edges[i]
+		a, b := v.proj.project(e.a), v.proj.project(e.b)
+		if (a[1] > p[1]) != (b[1] > p[1]) {
+			x := a[0] + (p[1]-a[1])*(b[0]-a[0])/(b[1]-a[1])
+			if x < p[0] {
+				inside = !inside
+			}
+		}
+	})
+	return inside
+}
+
+// relation returns whether the box is entirely inside the mask, entirely outside it, or crosses its boundary.
+func (v *maskView) relation(b Box) maskRelation {
+	crosses := false
+	v.edges(b, func(p, q Point) {
+		if !crosses {
+			_, _, crosses = clipSegment(p, q, b)
+		}
+	})
+
+	if crosses {
+		return maskBoundary
+	} else if v.contains(Point{(b.MinX + b.MaxX) / 2, (b.MinY + b.MaxY) / 2}) {
+		return maskInside
+	}
+	return maskOutside
+}
+
+// clip returns the part of the geometry inside the mask, or nil if none of it is.
+func (v *maskView) clip(g *Geometry) *Geometry {
+	bounds := g.Bounds()
+	switch v.relation(bounds) {
+	case maskInside:
+		return g
+	case maskOutside:
+		return nil
+	}
+
+	result := &Geometry{Type: g.Type}
+	for _, p := range g.Points {
+		if v.contains(p) {
+			result.Points = append(result.Points, p)
+		}
+	}
+	for _, line := range g.Lines {
+		result.Lines = append(result.Lines, v.clipLine(line)...)
+	}
+	if len(g.Polygons) > 0 {
+		result.Polygons = v.clipPolygons(g.Polygons, bounds)
+	}
+
+	return result.normalise()
+}
+
+// splitPoint is a point where a segment crosses another, at parameter t along it.
+type splitPoint struct {
+	t float64
+	p Point
+}
+
+// splitSegment returns the points of the segment from a to b, split wherever it crosses another segment, in order along it.
+func splitSegment(a, b Point, splits []splitPoint) []Point {
+	sort.Slice(splits, func(i, j int) bool { return splits[i].t < splits[j].t })
+
+	points := []Point{a}
+	for _, s := range splits {
+		if s.p != points[len(points)-1] && s.p != b {
+			points = append(points, s.p)
+		}
+	}
+	return append(points, b)
+}
+
+// segmentIntersection returns the parameters along a-b and c-d of the point where the segments cross, or false if they don't. Parallel segments are treated as not crossing.
+func segmentIntersection(a, b, c, d Point) (float64, float64, bool) {
+	r := Point{b[0] - a[0], b[1] - a[1]}
+	s := Point{d[0] - c[0], d[1] - c[1]}
+	denom := r[0]*s[1] - r[1]*s[0]
+	if denom == 0 {
+		return 0, 0, false
+	}
+
+	ca := Point{c[0] - a[0], c[1] - a[1]}
+	t := (ca[0]*s[1] - ca[1]*s[0]) / denom
+	u := (ca[0]*r[1] - ca[1]*r[0]) / denom
+	if t < 0 || t > 1 || u < 0 || u > 1 {
+		return 0, 0, false
+	}
+	return t, u, true
+}
+
+// crossing returns the point where a-b crosses c-d at parameters t and u. Points very close to the end of either segment are snapped to it, so that the same point is found whichever way round the segments are.
+func crossing(a, b, c, d Point, t, u float64) Point {
+	const epsilon = 1e-12
+	switch {
+	case t < epsilon:
+		return a
+	case t > 1-epsilon:
+		return b
+	case u < epsilon:
+		return c
+	case u > 1-epsilon:
+		return d
+	}
+	return Point{a[0] + t*(b[0]-a[0]), a[1] + t*(b[1]-a[1])}
+}
+
+func midpoint(a, b Point) Point {
+	return Point{(a[0] + b[0]) / 2, (a[1] + b[1]) / 2}
+}
+
+func segmentBox(a, b Point) Box {
+	return maskEdge{a, b}.box()
+}
+
+// clipLine returns the parts of the line inside the mask.
+func (v *maskView) clipLine(line []Point) [][]Point {
+	var result [][]Point
+	var current []Point
+
+	flush := func() {
+		if len(current) >= 2 {
+			result = append(result, current)
+		}
+		current = nil
+	}
+
+	for i := 0; i+1 < len(line); i++ {
+		a, b := line[i], line[i+1]
+
+		var splits []splitPoint
+		v.edges(segmentBox(a, b), func(c, d Point) {
+			if t, u, ok := segmentIntersection(a, b, c, d); ok {
+				splits = append(splits, splitPoint{t, crossing(a, b, c, d, t, u)})
+			}
+		})
+
+		points := splitSegment(a, b, splits)
+		for j := 0; j+1 < len(points); j++ {
+			p, q := points[j], points[j+1]
+			if p == q {
+				continue
+			}
+			if v.contains(midpoint(p, q)) {
+				if len(current) == 0 {
+					current = append(current, p)
+				}
+				current = append(current, q)
+			} else {
+				flush()
+			}
+		}
+	}
+	flush()
+
+	return result
+}
+
+// clipPolygons returns the intersection of the polygons with the mask.
+//
+// This overlays the boundaries of the polygons and the mask: the edges of each are split where they cross, the pieces of the polygons' edges inside the mask and the pieces of the mask's edges inside the polygons are kept, and the kept pieces are joined up end to end into the rings of the result. As the edges of both are oriented with their interior on the left, the joined up rings come out with exteriors wound anti-clockwise and holes clockwise, which is how they are told apart.
+func (v *maskView) clipPolygons(polygons [][][]Point, bounds Box) [][][]Point {
+	// keep the winding order of the input in the output.
+	reverse_output := ringArea(polygons[0][0]) < 0
+
+	var poly_edges, mask_edges []maskEdge
+	for _, polygon := range polygons {
+		for _, ring := range orientPolygon(polygon) {
+			for j := 0; j+1 < len(ring); j++ {
+				if ring[j] != ring[j+1] {
+					poly_edges = append(poly_edges, maskEdge{ring[j], ring[j+1]})
+				}
+			}
+		}
+	}
+	v.edges(bounds, func(a, b Point) {
+		mask_edges = append(mask_edges, maskEdge{a, b})
+	})
+
+	mask_boxes := make([]Box, len(mask_edges))
+	for i, e := range mask_edges {
+		mask_boxes[i] = e.box()
+	}
+	mask_index := newBoxIndex(mask_boxes)
+
+	poly_splits := make([][]splitPoint, len(poly_edges))
+	mask_splits := make([][]splitPoint, len(mask_edges))
+	for i, e := range poly_edges {
+		mask_index.Search(e.box(), func(j int) {
+			m := mask_edges[j]
+			if t, u, ok := segmentIntersection(e.a, e.b, m.a, m.b); ok {
+				p := crossing(e.a, e.b, m.a, m.b, t, u)
+				poly_splits[i] = append(poly_splits[i], splitPoint{t, p})
+				mask_splits[j] = append(mask_splits[j], splitPoint{u, p})
+			}
+		})
+	}
+
+	var kept []maskEdge
+	keep := func(e maskEdge, splits []splitPoint, inside func(Point) bool) {
+		points := splitSegment(e.a, e.b, splits)
+		for k := 0; k+1 < len(points); k++ {
+			p, q := points[k], points[k+1]
+			if p != q && inside(midpoint(p, q)) {
+				kept = append(kept, maskEdge{p, q})
+			}
+		}
+	}
+	for i, e := range poly_edges {
+		keep(e, poly_splits[i], v.contains)
+	}
+	in_polygons := func(p Point) bool { return edgesContain(poly_edges, p) }
+	for j, e := range mask_edges {
+		keep(e, mask_splits[j], in_polygons)
+	}
+
+	var exteriors, holes [][]Point
+	for _, ring := range joinRings(kept) {
+		area := ringArea(ring)
+		if area > 0 {
+			exteriors = append(exteriors, ring)
+		} else if area < 0 {
+			holes = append(holes, ring)
+		}
+	}
+
+	result := make([][][]Point, len(exteriors))
+	for i, ring := range exteriors {
+		result[i] = [][]Point{ring}
+	}
+	for _, hole := range holes {
+		// the hole belongs to the smallest exterior containing it.
+		p := midpoint(hole[0], hole[1])
+		best, best_area := -1, 0.0
+		for i, ring := range exteriors {
+			area := ringArea(ring)
+			if ringContains(ring, p) && (best < 0 || area < best_area) {
+				best, best_area = i, area
+			}
+		}
+		if best >= 0 {
+			result[best] = append(result[best], hole)
+		}
+	}
+
+	if reverse_output {
+		for _, polygon := range result {
+			for i, ring := range polygon {
+				polygon[i] = reverseRing(ring)
+			}
+		}
+	}
+
+	return result
+}
+
+// joinRings joins the edges up end to end into closed rings. Edges which can't be joined into a closed ring are dropped.
+func joinRings(edges []maskEdge) [][]Point {
+	starts := make(map[Point][]int)
+	for i, e := range edges {
+		starts[e.a] = append(starts[e.a], i)
+	}
+	used := make([]bool, len(edges))
+
+	next := func(p Point) int {
+		for _, i := range starts[p] {
+			if !used[i] {
+				return i
+			}
+		}
+		return -1
+	}
+
+	var rings [][]Point
+	for i := range edges {
+		if used[i] {
+			continue
+		}
+
+		ring := []Point{edges[i].a}
+		for e := i; e >= 0; e = next(ring[len(ring)-1]) {
+			used[e] = true
+			ring = append(ring, edges[e].b)
+			if edges[e].b == ring[0] {
+				break
+			}
+		}
+
+		if len(ring) >= 4 && ring[len(ring)-1] == ring[0] {
+			rings = append(rings, ring)
+		}
+	}
+
+	return rings
+}
+
+// edgesContain returns true if the point is inside the region bounded by the edges, using the even-odd rule.
+func edgesContain(edges []maskEdge, p Point) bool {
+	inside := false
+	for _, e := range edges {
+		a, b := e.a, e.b
+		if (a[1] > p[1]) != (b[1] > p[1]) {
+			x := a[0] + (p[1]-a[1])*(b[0]-a[0])/(b[1]-a[1])
+			if x < p[0] {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// ringContains returns true if the point is inside the closed ring.
+func ringContains(ring []Point, p Point) bool {
+	edges := make([]maskEdge, 0, len(ring))
+	for i := 0; i+1 < len(ring); i++ {
+		edges = append(edges, maskEdge{ring[i], ring[i+1]})
+	}
+	return edgesContain(edges, p)
+}
+
+// maskTileMargin is the margin around a tile, as a fraction of its size, within which the tile's relation to a mask is decided. It needs to be larger than the buffer of any features which extend outside the tile, otherwise the parts of them in the buffer might escape the mask.
+const maskTileMargin = 0.5
+
+// Masks restricts layers to the regions covered by their masks. Tile is the requested tile: layers which are entirely outside their mask around the tile are dropped, those entirely inside are left unchanged, and those crossing the boundary of their mask have their features clipped to it.
+//
+// TopoJSON geometries are never clipped, as their arcs may be shared with other geometries. Instead, any geometry which isn't entirely inside the mask is dropped, so that nothing outside it is served, at the cost of losing the parts of geometries crossing the boundary which are inside.
+type Masks struct {
+	Tile   TileCoord
+	Layers map[string]*Mask
+}
+
+// layerRelation returns the relation of the layer's mask to the tile, or maskInside if the layer has no mask.
+func (m *Masks) layerRelation(layer string) maskRelation {
+	mask, ok := m.Layers[layer]
+	if !ok {
+		return maskInside
+	}
+
+	bounds := m.Tile.Bounds()
+	bounds = bounds.Expand((bounds.MaxX-bounds.MinX)*maskTileMargin, (bounds.MaxY-bounds.MinY)*maskTileMargin)
+	view := &maskView{mask: mask, proj: lonLatProjection{}}
+	return view.relation(bounds)
+}
+
+func (m *Masks) transform(layer string, proj maskProjection) geometryTransform {
+	if m.layerRelation(layer) != maskBoundary {
+		return nil
+	}
+	view := &maskView{mask: m.Layers[layer], proj: proj}
+	return view.clip
+}
+
+// mvtTransform returns the transform clipping the layer's geometries in tile units with the given extent to its mask, or nil if they don't need clipping.
+func (m *Masks) mvtTransform(layer string, extent uint32) geometryTransform {
+	return m.transform(layer, tileProjection{tile: m.Tile, extent: float64(extent)})
+}
+
+// lonLatTransform returns the transform clipping the layer's geometries in longitude and latitude to its mask, or nil if they don't need clipping.
+func (m *Masks) lonLatTransform(layer string) geometryTransform {
+	return m.transform(layer, lonLatProjection{})
+}
@@ -0,0 +1,214 @@
+package xonacatl
+
+import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	"github.com/tilezen/xonacatl/mapnik_vector"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// an L-shaped mask covering the square from (0,0) to (10,10) except the top right quarter, with a square hole from (2,2) to (3,3).
+var testMask = NewMask([][][]Point{{
+	{{0, 0}, {10, 0}, {10, 5}, {5, 5}, {5, 10}, {0, 10}, {0, 0}},
+	{{2, 2}, {2, 3}, {3, 3}, {3, 2}, {2, 2}},
+}})
+
+func testMaskView() *maskView {
+	return &maskView{mask: testMask, proj: lonLatProjection{}}
+}
+
+func TestMaskContains(t *testing.T) {
+	v := testMaskView()
+	tests := []struct {
+		p      Point
+		inside bool
+	}{
+		{Point{1, 1}, true},
+		{Point{8, 1}, true},
+		{Point{1, 8}, true},
+		{Point{8, 8}, false},
+		{Point{2.5, 2.5}, false},
+		{Point{-1, 1}, false},
+		{Point{11, 1}, false},
+	}
+	for _, test := range tests {
+		if v.contains(test.p) != test.inside {
+			t.Fatalf("Expected contains(%v) to be %v", test.p, test.inside)
+		}
+	}
+}
+
+func TestMaskRelation(t *testing.T) {
+	v := testMaskView()
+	if r := v.relation(Box{0.5, 0.5, 1.5, 1.5}); r != maskInside {
+		t.Fatalf("Expected box in mask to be inside, but was %v", r)
+	}
+	if r := v.relation(Box{6, 6, 9, 9}); r != maskOutside {
+		t.Fatalf("Expected box in the missing quarter to be outside, but was %v", r)
+	}
+	if r := v.relation(Box{4, 4, 6, 6}); r != maskBoundary {
+		t.Fatalf("Expected box across the corner to be on the boundary, but was %v", r)
+	}
+}
+
+func TestMaskClipLine(t *testing.T) {
+	// runs across the top half, out of the mask at x=5.
+	g := &Geometry{Type: "LineString", Lines: [][]Point{{{1, 8}, {9, 8}}}}
+	expected := &Geometry{Type: "LineString", Lines: [][]Point{{{1, 8}, {5, 8}}}}
+	if out := testMaskView().clip(g); !reflect.DeepEqual(out, expected) {
+		t.Fatalf("Expected clipped line to be %#v, but was %#v", expected, out)
+	}
+}
+
+func TestMaskClipPoints(t *testing.T) {
+	g := &Geometry{Type: "MultiPoint", Points: []Point{{1, 1}, {8, 8}, {2.5, 2.5}}}
+	expected := &Geometry{Type: "Point", Points: []Point{{1, 1}}}
+	if out := testMaskView().clip(g); !reflect.DeepEqual(out, expected) {
+		t.Fatalf("Expected clipped points to be %#v, but was %#v", expected, out)
+	}
+}
+
+// assertPolygonArea checks that the geometry is made of polygons with the given total area, counting holes as negative.
+func assertPolygonArea(g *Geometry, expected float64, t *testing.T) {
+	if g == nil {
+		t.Fatalf("Expected polygons with area %v, but got nothing", expected)
+	}
+	total := 0.0
+	for _, polygon := range g.Polygons {
+		for _, ring := range polygon {
+			total += ringArea(ring)
+		}
+	}
+	if math.Abs(total-expected) > 1e-9 {
+		t.Fatalf("Expected polygons with area %v, but area was %v: %#v", expected, total, g)
+	}
+}
+
+func TestMaskClipPolygon(t *testing.T) {
+	// the square from (4,4) to (6,6) overlaps the mask everywhere apart from its top right quarter.
+	g := &Geometry{Type: "Polygon", Polygons: [][][]Point{{{{4, 4}, {6, 4}, {6, 6}, {4, 6}, {4, 4}}}}}
+	out := testMaskView().clip(g)
+	assertPolygonArea(out, 3, t)
+	if out.Type != "Polygon" || len(out.Polygons[0]) != 1 || len(out.Polygons[0][0]) != 7 {
+		t.Fatalf("Expected an L-shaped polygon, but got %#v", out)
+	}
+}
+
+func TestMaskClipPolygonKeepsWinding(t *testing.T) {
+	// as above, but wound clockwise, as MVT exteriors are in tile units.
+	g := &Geometry{Type: "Polygon", Polygons: [][][]Point{{{{4, 4}, {4, 6}, {6, 6}, {6, 4}, {4, 4}}}}}
+	assertPolygonArea(testMaskView().clip(g), -3, t)
+}
+
+func TestMaskClipPolygonWithMaskHole(t *testing.T) {
+	// the square from (1,1) to (4,4) contains the mask's hole, which becomes a hole in the result.
+	g := &Geometry{Type: "Polygon", Polygons: [][][]Point{{{{1, 1}, {4, 1}, {4, 4}, {1, 4}, {1, 1}}}}}
+	out := testMaskView().clip(g)
+	assertPolygonArea(out, 8, t)
+	if len(out.Polygons) != 1 || len(out.Polygons[0]) != 2 {
+		t.Fatalf("Expected a single polygon with a hole, but got %#v", out)
+	}
+}
+
+func TestMaskClipPolygonWithOwnHole(t *testing.T) {
+	// the square from (4,-1) to (11,4) has a hole from (8,1) to (9,2), and sticks out of the mask on three sides.
+	g := &Geometry{Type: "Polygon", Polygons: [][][]Point{{
+		{{4, -1}, {11, -1}, {11, 4}, {4, 4}, {4, -1}},
+		{{8, 1}, {8, 2}, {9, 2}, {9, 1}, {8, 1}},
+	}}}
+	out := testMaskView().clip(g)
+	assertPolygonArea(out, 6*4-1, t)
+	if len(out.Polygons) != 1 || len(out.Polygons[0]) != 2 {
+		t.Fatalf("Expected a single polygon with a hole, but got %#v", out)
+	}
+}
+
+func TestParseMask(t *testing.T) {
+	_, err := ParseMask(strings.NewReader(`{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}}]}`))
+	if err != nil {
+		t.Fatalf("ParseMask failed, error: %s", err.Error())
+	}
+
+	_, err = ParseMask(strings.NewReader(`{"type":"Point","coordinates":[0,0]}`))
+	if err == nil {
+		t.Fatalf("Expected a point mask to be an error")
+	}
+}
+
+func TestMasksDropLayer(t *testing.T) {
+	input := `{"pois":{"type":"FeatureCollection","features":[]},"water":{"type":"FeatureCollection","features":[]}}`
+	// tile 2/3/0 covers the north east, which is a long way from the mask.
+	options := &CopyOptions{Masks: &Masks{Tile: TileCoord{Z: 2, X: 3, Y: 0}, Layers: map[string]*Mask{"pois": testMask}}}
+
+	var buf bytes.Buffer
+	err := NewCopyLayersWithOptions(map[string]bool{"pois": true, "water": true}, options).CopyLayers(strings.NewReader(input), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+
+	expected := `{"water":{"type":"FeatureCollection","features":[]}}`
+	if buf.String() != expected {
+		t.Fatalf("Expected masked layer to be dropped, giving %#v, but was %#v", expected, buf.String())
+	}
+}
+
+func TestMasksTopoJSON(t *testing.T) {
+	// arc 0 goes around the outside of the missing quarter of the mask, so its bbox overlaps the mask without the line touching it, and arc 1 crosses out of the mask at x=5.
+	input := `{"type":"Topology","objects":{"pois":{"type":"GeometryCollection","geometries":[{"type":"Point","coordinates":[1,1]},{"type":"LineString","arcs":[0]},{"type":"LineString","arcs":[1]},{"type":"GeometryCollection","geometries":[]}]}},"arcs":[[[4,11],[11,11],[11,4]],[[1,8],[9,8]]]}`
+	expected := `{"type":"Topology","objects":{"pois":{"geometries":[{"type":"Point","coordinates":[1,1]}],"type":"GeometryCollection"}},"arcs":[[[4,11],[11,11],[11,4]],[[1,8],[9,8]]]}`
+
+	options := &CopyOptions{Masks: &Masks{Tile: TileCoord{}, Layers: map[string]*Mask{"pois": testMask}}}
+	var buf bytes.Buffer
+	err := NewCopyTopoJSONLayersWithOptions(map[string]bool{"pois": true}, options).CopyLayers(strings.NewReader(input), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+
+	out := strings.TrimSpace(buf.String())
+	if out != expected {
+		t.Fatalf("Expected only the geometry inside the mask to be kept, giving %#v, but was %#v", expected, out)
+	}
+}
+
+func TestMasksMVT(t *testing.T) {
+	// the mask is the western hemisphere, and the feature is a line across the middle of tile 0/0/0.
+	mask := NewMask([][][]Point{{{{-180, -80}, {0, -80}, {0, 80}, {-180, 80}, {-180, -80}}}})
+	layer := &mapnik_vector.TileLayer{
+		Version: proto.Uint32(2),
+		Name:    proto.String("roads"),
+		Extent:  proto.Uint32(4096),
+		Features: []*mapnik_vector.TileFeature{{
+			Type:     mapnik_vector.Tile_LineString.Enum(),
+			Geometry: []uint32{9, 0, 4096, 10, 8192, 0},
+		}},
+	}
+	input, err := proto.Marshal(&mapnik_vector.Tile{Layers: []*mapnik_vector.TileLayer{layer}})
+	if err != nil {
+		t.Fatalf("Unable to marshal test tile: %s", err.Error())
+	}
+
+	options := &CopyOptions{Masks: &Masks{Tile: TileCoord{}, Layers: map[string]*Mask{"roads": mask}}}
+	var buf bytes.Buffer
+	err = NewCopyMVTLayersWithOptions(map[string]bool{"all": true}, options).CopyLayers(bytes.NewReader(input), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+
+	var out mapnik_vector.Tile
+	err = proto.Unmarshal(buf.Bytes(), &out)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal output tile: %s", err.Error())
+	}
+
+	g, err := decodeMVTGeometry(out.Layers[0].Features[0].GetType(), out.Layers[0].Features[0].Geometry)
+	if err != nil {
+		t.Fatalf("Unable to decode output geometry: %s", err.Error())
+	}
+	expected := &Geometry{Type: "LineString", Lines: [][]Point{{{0, 2048}, {2048, 2048}}}}
+	if !reflect.DeepEqual(g, expected) {
+		t.Fatalf("Expected masked geometry to be %#v, but was %#v", expected, g)
+	}
+}
@@ -3,6 +3,7 @@
 package xonacatl
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/tilezen/xonacatl/mapnik_vector"
@@ -11,15 +12,177 @@ import (
 )
 
 type mvtCopier struct {
-	layers map[string]bool
+	layers  map[string]bool
+	options *CopyOptions
+}
+
+func init() {
+	for _, ext := range []string{"mvt", "mvtb"} {
+		RegisterFormat(&Format{
+			Extension:   ext,
+			ContentType: "application/x-protobuf",
+			NewCopier: func(layers map[string]bool, options *CopyOptions) LayerCopier {
+				return NewCopyMVTLayersWithOptions(layers, options)
+			},
+			VectorLayers: mvtVectorLayers,
+			Transforms:   true,
+		})
+	}
 }
 
 func NewCopyMVTLayers(layers map[string]bool) *mvtCopier {
-	return &mvtCopier{layers: layers}
+	return NewCopyMVTLayersWithOptions(layers, nil)
+}
+
+func NewCopyMVTLayersWithOptions(layers map[string]bool, options *CopyOptions) *mvtCopier {
+	return &mvtCopier{layers: layers, options: options}
+}
+
+// mvtValue returns the value as a string, float64 or bool, the same as it would be decoded from JSON.
+func mvtValue(v *mapnik_vector.TileValue) interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.FloatValue != nil:
+		return float64(*v.FloatValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.IntValue != nil:
+		return float64(*v.IntValue)
+	case v.UintValue != nil:
+		return float64(*v.UintValue)
+	case v.SintValue != nil:
+		return float64(*v.SintValue)
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	}
+	return nil
+}
+
+// mvtFeature returns the Feature for filtering an MVT feature in layer l.
+func mvtFeature(l *mapnik_vector.TileLayer, f *mapnik_vector.TileFeature) (*Feature, error) {
+	keys := l.GetKeys()
+	values := l.GetValues()
+	tags := f.GetTags()
+
+	feature := &Feature{
+		Layer:        l.GetName(),
+		GeometryType: f.GetType().String(),
+		Properties:   make(map[string]interface{}, len(tags)/2),
+	}
+	if f.Id != nil {
+		feature.Id = float64(*f.Id)
+	}
+
+	for i := 0; i+1 < len(tags); i += 2 {
+		k, v := int(tags[i]), int(tags[i+1])
+		if k >= len(keys) || v >= len(values) {
+			return nil, fmt.Errorf("Feature tag (%d, %d) out of range in layer %#v", k, v, l.GetName())
+		}
+		feature.Properties[keys[k]] = mvtValue(values[v])
+	}
+
+	return feature, nil
+}
+
+// mvtKeepGeometryType returns true if the type of the feature is one of the types. The feature's type field only gives the single geometry type, so the geometry is decoded only when that isn't enough to tell whether it is a multi-geometry which should be kept.
+func mvtKeepGeometryType(f *mapnik_vector.TileFeature, types GeometryTypes) (bool, error) {
+	base := f.GetType().String()
+	single, multi := types[base], types["Multi"+base]
+	if single == multi {
+		return single, nil
+	}
+
+	g, err := decodeMVTGeometry(f.GetType(), f.Geometry)
+	if err != nil {
+		return false, err
+	}
+	if g == nil {
+		return false, nil
+	}
+	g = g.normalise()
+	return g != nil && types[g.Type], nil
+}
+
+// processLayer applies any feature-level options to the features of the layer.
+func (c *mvtCopier) processLayer(ctx context.Context, l *mapnik_vector.TileLayer) error {
+	types := c.options.geometryTypesFor(l.GetName())
+	filter := c.options.filterFor(l.GetName())
+	transform := c.options.mvtTransform(l.GetName(), l.GetExtent())
+	if types == nil && filter == nil && transform == nil {
+		return nil
+	}
+
+	var kept []*mapnik_vector.TileFeature
+	for _, f := range l.Features {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if types != nil {
+			keep, err := mvtKeepGeometryType(f, types)
+			if err != nil {
+				return err
+			}
+			if !keep {
+				continue
+			}
+		}
+
+		if filter != nil {
+			feature, err := mvtFeature(l, f)
+			if err != nil {
+				return err
+			}
+			if !filter.KeepFeature(feature) {
+				continue
+			}
+		}
+
+		if transform != nil && f.GetType() != mapnik_vector.Tile_Unknown {
+			g, err := decodeMVTGeometry(f.GetType(), f.Geometry)
+			if err != nil {
+				return err
+			}
+			if g == nil {
+				continue
+			}
+
+			g = transform(g)
+			if g == nil {
+				continue
+			}
+
+			typ, geometry, ok := encodeMVTGeometry(g)
+			if !ok {
+				continue
+			}
+			f.Type = typ.Enum()
+			f.Geometry = geometry
+		}
+
+		kept = append(kept, f)
+	}
+
+	l.Features = kept
+	return nil
 }
 
 func (c *mvtCopier) CopyLayers(rd io.Reader, wr io.Writer) error {
-	buf, err := ioutil.ReadAll(rd)
+	return c.CopyLayersContext(context.Background(), rd, wr)
+}
+
+func (c *mvtCopier) CopyLayersContext(ctx context.Context, rd io.Reader, wr io.Writer) error {
+	return c.copyLayers(ctx, rd, wr, nil)
+}
+
+func (c *mvtCopier) CopyLayersStats(ctx context.Context, rd io.Reader, wr io.Writer) (*CopyStats, error) {
+	return copyWithStats(ctx, rd, wr, c.copyLayers)
+}
+
+// copyLayers copies the layers, collecting statistics if stats is not nil.
+func (c *mvtCopier) copyLayers(ctx context.Context, rd io.Reader, wr io.Writer, stats *CopyStats) error {
+	buf, err := ioutil.ReadAll(&contextReader{ctx: ctx, rd: rd})
 	if err != nil {
 		return err
 	}
@@ -32,10 +195,22 @@ func (c *mvtCopier) CopyLayers(rd io.Reader, wr io.Writer) error {
 
 	var new_layers []*mapnik_vector.TileLayer
 	for _, l := range t.GetLayers() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
 		if *l.Version > 2 {
-			return fmt.Errorf("Unable to read layer with version %#q, xonacatl supports versions up to 2 only.", *l.Version)
+			return fmt.Errorf("Unable to read layer with version %d, xonacatl supports versions up to 2 only.", *l.Version)
+		}
+		if stats != nil {
+			stats.seeLayer(l.GetName(), proto.Size(l))
 		}
-		if l.Name != nil && c.layers[*l.Name] {
+
+		if l.Name != nil && KeepLayer(c.layers, *l.Name) && !c.options.dropLayer(*l.Name) {
+			err = c.processLayer(ctx, l)
+			if err != nil {
+				return err
+			}
+			stats.keepLayer(*l.Name, len(l.Features))
 			new_layers = append(new_layers, l)
 		}
 	}
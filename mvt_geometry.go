@@ -0,0 +1,208 @@
+package xonacatl
+
+import (
+	"fmt"
+	"github.com/tilezen/xonacatl/mapnik_vector"
+	"math"
+)
+
+const (
+	mvtMoveTo    = 1
+	mvtLineTo    = 2
+	mvtClosePath = 7
+)
+
+func zigzagDecode(v uint32) int32 {
+	return int32(v>>1) ^ -int32(v&1)
+}
+
+func zigzagEncode(v int32) uint32 {
+	return uint32((v << 1) ^ (v >> 31))
+}
+
+// decodeMVTGeometry decodes the command stream of an MVT feature into a Geometry, in tile units.
+//
+// Polygon rings with the same winding order as the first ring are taken to be exteriors, and those with the opposite winding order to be holes in the preceding exterior. This works for both version 1 and version 2 tiles.
+func decodeMVTGeometry(typ mapnik_vector.Tile_GeomType, cmds []uint32) (*Geometry, error) {
+	var parts [][]Point
+	var current []Point
+	var x, y int32
+	closed := make(map[int]bool)
+
+	for i := 0; i < len(cmds); {
+		cmd := cmds[i] & 0x7
+		count := int(cmds[i] >> 3)
+		i++
+
+		switch cmd {
+		case mvtMoveTo, mvtLineTo:
+			if i+2*count > len(cmds) {
+				return nil, fmt.Errorf("Geometry command stream truncated")
+			}
+			for j := 0; j < count; j++ {
+				x += zigzagDecode(cmds[i])
+				y += zigzagDecode(cmds[i+1])
+				i += 2
+
+				if cmd == mvtMoveTo && (typ != mapnik_vector.Tile_Point || current == nil) {
+					if current != nil {
+						parts = append(parts, current)
+					}
+					current = nil
+				}
+				current = append(current, Point{float64(x), float64(y)})
+			}
+
+		case mvtClosePath:
+			if len(current) > 0 {
+				current = append(current, current[0])
+				closed[len(parts)] = true
+			}
+
+		default:
+			return nil, fmt.Errorf("Unknown geometry command %d", cmd)
+		}
+	}
+	if current != nil {
+		parts = append(parts, current)
+	}
+
+	g := &Geometry{}
+	switch typ {
+	case mapnik_vector.Tile_Point:
+		g.Type = "MultiPoint"
+		for _, part := range parts {
+			g.Points = append(g.Points, part...)
+		}
+
+	case mapnik_vector.Tile_LineString:
+		g.Type = "MultiLineString"
+		g.Lines = parts
+
+	case mapnik_vector.Tile_Polygon:
+		g.Type = "MultiPolygon"
+		var exterior_sign float64
+		for i, ring := range parts {
+			if !closed[i] {
+				return nil, fmt.Errorf("Polygon ring not closed")
+			}
+			area := ringArea(ring)
+			if area == 0 {
+				continue
+			}
+			if exterior_sign == 0 {
+				exterior_sign = math.Copysign(1, area)
+			}
+			if area*exterior_sign > 0 || len(g.Polygons) == 0 {
+				g.Polygons = append(g.Polygons, [][]Point{ring})
+			} else {
+				last := len(g.Polygons) - 1
+				g.Polygons[last] = append(g.Polygons[last], ring)
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("Unable to decode geometry of type %s", typ)
+	}
+
+	return g.normalise(), nil
+}
+
+// mvtEncoder builds an MVT command stream, keeping track of the cursor position.
+type mvtEncoder struct {
+	cmds []uint32
+	x, y int32
+}
+
+func (e *mvtEncoder) command(cmd uint32, count int) {
+	e.cmds = append(e.cmds, cmd|uint32(count)<<3)
+}
+
+func (e *mvtEncoder) point(p [2]int32) {
+	e.cmds = append(e.cmds, zigzagEncode(p[0]-e.x), zigzagEncode(p[1]-e.y))
+	e.x, e.y = p[0], p[1]
+}
+
+// roundPoints rounds the points to integer tile units, removing any consecutive duplicates which that creates.
+func roundPoints(points []Point) [][2]int32 {
+	var result [][2]int32
+	for _, p := range points {
+		q := [2]int32{int32(math.Floor(p[0] + 0.5)), int32(math.Floor(p[1] + 0.5))}
+		if len(result) > 0 && result[len(result)-1] == q {
+			continue
+		}
+		result = append(result, q)
+	}
+	return result
+}
+
+func (e *mvtEncoder) line(points [][2]int32) {
+	e.command(mvtMoveTo, 1)
+	e.point(points[0])
+	e.command(mvtLineTo, len(points)-1)
+	for _, p := range points[1:] {
+		e.point(p)
+	}
+}
+
+// encodeMVTGeometry encodes the geometry as an MVT command stream, rounding coordinates to integer tile units. Parts which become degenerate after rounding are dropped, and false is returned if nothing remains.
+func encodeMVTGeometry(g *Geometry) (mapnik_vector.Tile_GeomType, []uint32, bool) {
+	e := &mvtEncoder{}
+
+	switch baseGeometryType(g.Type) {
+	case "Point":
+		points := make([][2]int32, 0, len(g.Points))
+		for _, p := range g.Points {
+			points = append(points, [2]int32{int32(math.Floor(p[0] + 0.5)), int32(math.Floor(p[1] + 0.5))})
+		}
+		if len(points) == 0 {
+			return mapnik_vector.Tile_Point, nil, false
+		}
+		e.command(mvtMoveTo, len(points))
+		for _, p := range points {
+			e.point(p)
+		}
+		return mapnik_vector.Tile_Point, e.cmds, true
+
+	case "LineString":
+		for _, line := range g.Lines {
+			points := roundPoints(line)
+			if len(points) < 2 {
+				continue
+			}
+			e.line(points)
+		}
+		return mapnik_vector.Tile_LineString, e.cmds, len(e.cmds) > 0
+
+	case "Polygon":
+		for _, polygon := range g.Polygons {
+			for i, ring := range polygon {
+				points := roundPoints(ring)
+				// drop the closing point, as ClosePath implies it.
+				if len(points) > 1 && points[0] == points[len(points)-1] {
+					points = points[:len(points)-1]
+				}
+				if len(points) < 3 || intRingArea(points) == 0 {
+					if i == 0 {
+						break
+					}
+					continue
+				}
+				e.line(points)
+				e.command(mvtClosePath, 1)
+			}
+		}
+		return mapnik_vector.Tile_Polygon, e.cmds, len(e.cmds) > 0
+	}
+
+	return mapnik_vector.Tile_Unknown, nil, false
+}
+
+func intRingArea(ring [][2]int32) int64 {
+	var sum int64
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		sum += int64(ring[i][0])*int64(ring[j][1]) - int64(ring[j][0])*int64(ring[i][1])
+	}
+	return sum
+}
@@ -0,0 +1,65 @@
+package xonacatl
+
+import (
+	"github.com/tilezen/xonacatl/mapnik_vector"
+	"reflect"
+	"testing"
+)
+
+func assertMVTRoundTrip(typ mapnik_vector.Tile_GeomType, cmds []uint32, expected *Geometry, t *testing.T) {
+	g, err := decodeMVTGeometry(typ, cmds)
+	if err != nil {
+		t.Fatalf("decodeMVTGeometry(%#v) failed, error: %s", cmds, err.Error())
+	}
+	if !reflect.DeepEqual(g, expected) {
+		t.Fatalf("Expected decodeMVTGeometry(%#v) to be %#v, but was %#v", cmds, expected, g)
+	}
+
+	out_typ, out, ok := encodeMVTGeometry(g)
+	if !ok || out_typ != typ || !reflect.DeepEqual(out, cmds) {
+		t.Fatalf("Expected encodeMVTGeometry(%#v) to be %#v, but was %#v", g, cmds, out)
+	}
+}
+
+func TestMVTGeometryPoint(t *testing.T) {
+	// MoveTo(25, 17)
+	cmds := []uint32{9, 50, 34}
+	assertMVTRoundTrip(mapnik_vector.Tile_Point, cmds, &Geometry{Type: "Point", Points: []Point{{25, 17}}}, t)
+}
+
+func TestMVTGeometryMultiPoint(t *testing.T) {
+	// MoveTo(5, 7), MoveTo(3, 2)
+	cmds := []uint32{17, 10, 14, 3, 9}
+	assertMVTRoundTrip(mapnik_vector.Tile_Point, cmds, &Geometry{Type: "MultiPoint", Points: []Point{{5, 7}, {3, 2}}}, t)
+}
+
+func TestMVTGeometryMultiLineString(t *testing.T) {
+	// MoveTo(2, 2), LineTo(2, 10), LineTo(10, 10), MoveTo(1, 1), LineTo(3, 5)
+	cmds := []uint32{9, 4, 4, 18, 0, 16, 16, 0, 9, 17, 17, 10, 4, 8}
+	expected := &Geometry{Type: "MultiLineString", Lines: [][]Point{
+		{{2, 2}, {2, 10}, {10, 10}},
+		{{1, 1}, {3, 5}},
+	}}
+	assertMVTRoundTrip(mapnik_vector.Tile_LineString, cmds, expected, t)
+}
+
+func TestMVTGeometryPolygonWithHole(t *testing.T) {
+	// exterior (0,0) (10,0) (10,10) (0,10) and a hole (2,2) (2,8) (8,8) (8,2) with the opposite winding order.
+	cmds := []uint32{
+		9, 0, 0, 26, 20, 0, 0, 20, 19, 0, 15,
+		9, 4, 15, 26, 0, 12, 12, 0, 0, 11, 15,
+	}
+	expected := &Geometry{Type: "Polygon", Polygons: [][][]Point{{
+		{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}},
+		{{2, 2}, {2, 8}, {8, 8}, {8, 2}, {2, 2}},
+	}}}
+	assertMVTRoundTrip(mapnik_vector.Tile_Polygon, cmds, expected, t)
+}
+
+func TestMVTGeometryDropsDegenerate(t *testing.T) {
+	g := &Geometry{Type: "LineString", Lines: [][]Point{{{1.1, 1.1}, {0.9, 0.9}}}}
+	_, _, ok := encodeMVTGeometry(g)
+	if ok {
+		t.Fatalf("Expected line which rounds to a single point to be dropped.")
+	}
+}
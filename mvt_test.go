@@ -66,3 +66,66 @@ func TestMVTNonEmptyWithLayers(t *testing.T) {
 	mvt := []byte{26, 73, 10, 5, 119, 97, 116, 101, 114, 18, 26, 8, 1, 18, 6, 0, 0, 1, 1, 2, 2, 24, 3, 34, 12, 9, 0, 128, 64, 26, 0, 1, 2, 0, 0, 2, 15, 26, 3, 102, 111, 111, 26, 3, 98, 97, 122, 26, 3, 117, 105, 100, 34, 5, 10, 3, 98, 97, 114, 34, 5, 10, 3, 102, 111, 111, 34, 2, 32, 123, 40, 128, 32, 120, 2}
 	runCopyMVTAssertOutput(mvt, map[string]bool{"water": true}, mvt, t)
 }
+
+func TestMVTFilterFeatures(t *testing.T) {
+	// has a water layer with a single feature, with properties foo="bar", baz="foo" and uid=123.
+	mvt := []byte{26, 73, 10, 5, 119, 97, 116, 101, 114, 18, 26, 8, 1, 18, 6, 0, 0, 1, 1, 2, 2, 24, 3, 34, 12, 9, 0, 128, 64, 26, 0, 1, 2, 0, 0, 2, 15, 26, 3, 102, 111, 111, 26, 3, 98, 97, 122, 26, 3, 117, 105, 100, 34, 5, 10, 3, 98, 97, 114, 34, 5, 10, 3, 102, 111, 111, 34, 2, 32, 123, 40, 128, 32, 120, 2}
+	layers := map[string]bool{"water": true}
+
+	var seen *Feature
+	keep := &CopyOptions{Filters: map[string]FeatureFilter{
+		"water": FeatureFilterFunc(func(f *Feature) bool { seen = f; return true }),
+	}}
+	var buf bytes.Buffer
+	err := NewCopyMVTLayersWithOptions(layers, keep).CopyLayers(bytes.NewReader(mvt), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+	if !byteSliceEq(buf.Bytes(), mvt) {
+		t.Fatalf("Expected output with all features kept to be unchanged, but was %#v", buf.Bytes())
+	}
+	if seen == nil || seen.GeometryType != "Polygon" || seen.Properties["foo"] != "bar" || seen.Properties["uid"] != float64(123) {
+		t.Fatalf("Unexpected feature passed to filter: %#v", seen)
+	}
+
+	drop := &CopyOptions{Filters: map[string]FeatureFilter{
+		"water": FeatureFilterFunc(func(f *Feature) bool { return false }),
+	}}
+	buf.Reset()
+	err = NewCopyMVTLayersWithOptions(layers, drop).CopyLayers(bytes.NewReader(mvt), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+	if bytes.Contains(buf.Bytes(), []byte{8, 1, 18, 6}) {
+		t.Fatalf("Expected feature to be removed, but output was %#v", buf.Bytes())
+	}
+}
+
+func TestMVTGeometryTypes(t *testing.T) {
+	// has a water layer with a single polygon feature.
+	mvt := []byte{26, 73, 10, 5, 119, 97, 116, 101, 114, 18, 26, 8, 1, 18, 6, 0, 0, 1, 1, 2, 2, 24, 3, 34, 12, 9, 0, 128, 64, 26, 0, 1, 2, 0, 0, 2, 15, 26, 3, 102, 111, 111, 26, 3, 98, 97, 122, 26, 3, 117, 105, 100, 34, 5, 10, 3, 98, 97, 114, 34, 5, 10, 3, 102, 111, 111, 34, 2, 32, 123, 40, 128, 32, 120, 2}
+	layers := map[string]bool{"water": true}
+
+	tests := []struct {
+		types GeometryTypes
+		kept  bool
+	}{
+		{GeometryTypes{"Polygon": true, "MultiPolygon": true}, true},
+		{GeometryTypes{"Polygon": true}, true},
+		{GeometryTypes{"MultiPolygon": true}, false},
+		{GeometryTypes{"Point": true, "MultiPoint": true}, false},
+	}
+
+	for _, test := range tests {
+		options := &CopyOptions{GeometryTypes: map[string]GeometryTypes{"water": test.types}}
+		var buf bytes.Buffer
+		err := NewCopyMVTLayersWithOptions(layers, options).CopyLayers(bytes.NewReader(mvt), &buf)
+		if err != nil {
+			t.Fatalf("CopyLayers failed, error: %s", err.Error())
+		}
+		kept := bytes.Contains(buf.Bytes(), []byte{8, 1, 18, 6})
+		if kept != test.kept {
+			t.Fatalf("Expected feature kept to be %v with types %#v, but was %v", test.kept, test.types, kept)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package xonacatl
+
+import (
+	"math"
+	"strconv"
+)
+
+// MaxPrecision is the largest number of decimal places which coordinates can usefully be rounded to, as float64 can't represent more than this for longitudes.
+const MaxPrecision = 15
+
+// ZoomPrecision returns the number of decimal places needed for longitude and latitude coordinates at zoom z to be accurate to within a pixel of a 256 pixel tile.
+func ZoomPrecision(z int) int {
+	pixels_per_degree := math.Exp2(float64(z)) * 256 / 360
+	digits := int(math.Ceil(math.Log10(pixels_per_degree)))
+	if digits < 0 {
+		return 0
+	} else if digits > MaxPrecision {
+		return MaxPrecision
+	}
+	return digits
+}
+
+// jsonContainer is an object or array which roundCoordinates is inside of.
+type jsonContainer struct {
+	array bool
+	// key is the key which an array is the value of, so that its elements know what they're in.
+	key string
+	// geometry is true for an object which is a GeoJSON geometry.
+	geometry bool
+	// in_properties is true for anything inside the properties of a feature, which aren't looked into.
+	in_properties bool
+}
+
+// roundCoordinates returns a copy of the JSON document with the numbers in the coordinates of each geometry rounded to the given number of decimal places. A geometry is the value of a "geometry" member, such as a feature's, or an element of a GeometryCollection's "geometries" array, so a "coordinates" member anywhere else, and anything at all in the properties of a feature, is left alone.
+//
+// This works on the bytes of the document as a stream of tokens, rather than decoding it. As well as being faster, this means everything apart from the rounded numbers, including the properties of features, is copied byte-for-byte. The document is assumed to be valid JSON, as it has already been parsed into a json.RawMessage.
+func roundCoordinates(src []byte, digits int) []byte {
+	dst := make([]byte, 0, len(src))
+	scale := math.Pow10(digits)
+
+	// depth is the nesting depth of arrays within a geometry's "coordinates" value, or zero if not inside one.
+	depth := 0
+	// stack holds the objects and arrays outside the current position, not counting those inside coordinates.
+	var stack []jsonContainer
+	// key is the most recent key in the innermost object, whose value is the next thing to start.
+	key := ""
+
+	for i := 0; i < len(src); {
+		c := src[i]
+
+		switch {
+		case c == '"':
+			end := scanJSONString(src, i)
+			dst = append(dst, src[i:end]...)
+			if len(stack) > 0 && !stack[len(stack)-1].array && nextNonSpace(src, end) == ':' {
+				key = string(src[i+1 : end-1])
+			}
+			i = end
+
+		case c == '{' && depth == 0:
+			geometry := key == "geometry"
+			in_properties := key == "properties"
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				if parent.array {
+					geometry = parent.key == "geometries"
+				}
+				if parent.in_properties {
+					geometry, in_properties = false, true
+				}
+			}
+			stack = append(stack, jsonContainer{geometry: geometry, in_properties: in_properties})
+			key = ""
+			dst = append(dst, c)
+			i++
+
+		case c == '[':
+			if depth > 0 {
+				depth += 1
+			} else if len(stack) > 0 && stack[len(stack)-1].geometry && key == "coordinates" {
+				depth = 1
+			} else {
+				array_key := key
+				in_properties := false
+				if len(stack) > 0 {
+					parent := stack[len(stack)-1]
+					if parent.array {
+						array_key = ""
+					}
+					in_properties = parent.in_properties
+				}
+				stack = append(stack, jsonContainer{array: true, key: array_key, in_properties: in_properties})
+			}
+			key = ""
+			dst = append(dst, c)
+			i++
+
+		case c == ']' || (c == '}' && depth == 0):
+			if depth > 0 {
+				depth -= 1
+			} else if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			key = ""
+			dst = append(dst, c)
+			i++
+
+		case depth > 0 && (c == '-' || (c >= '0' && c <= '9')):
+			end := i + 1
+			for end < len(src) && isJSONNumberByte(src[end]) {
+				end++
+			}
+			dst = appendRounded(dst, src[i:end], scale)
+			i = end
+
+		default:
+			dst = append(dst, c)
+			i++
+		}
+	}
+
+	return dst
+}
+
+// appendRounded appends the number, rounded using scale, to dst. If the number can't be parsed, it is appended unchanged.
+func appendRounded(dst, number []byte, scale float64) []byte {
+	v, err := strconv.ParseFloat(string(number), 64)
+	if err != nil {
+		return append(dst, number...)
+	}
+
+	r := math.Floor(v*scale+0.5) / scale
+	if r == 0 {
+		// avoid writing "-0"
+		r = 0
+	}
+	return strconv.AppendFloat(dst, r, 'f', -1, 64)
+}
+
+// scanJSONString returns the index just after the end of the JSON string starting at src[start].
+func scanJSONString(src []byte, start int) int {
+	for i := start + 1; i < len(src); i++ {
+		if src[i] == '\\' {
+			i++
+		} else if src[i] == '"' {
+			return i + 1
+		}
+	}
+	return len(src)
+}
+
+func nextNonSpace(src []byte, i int) byte {
+	for ; i < len(src); i++ {
+		if !isJSONSpace(src[i]) {
+			return src[i]
+		}
+	}
+	return 0
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isJSONNumberByte(c byte) bool {
+	return (c >= '0' && c <= '9') || c == '-' || c == '+' || c == '.' || c == 'e' || c == 'E'
+}
@@ -0,0 +1,69 @@
+package xonacatl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func assertRounded(input string, digits int, expected string, t *testing.T) {
+	out := string(roundCoordinates([]byte(input), digits))
+	if out != expected {
+		t.Fatalf("Expected roundCoordinates(%#v, %d) to be %#v, but was %#v", input, digits, expected, out)
+	}
+}
+
+func TestRoundCoordinates(t *testing.T) {
+	assertRounded(`{"type":"Feature","geometry":{"type":"Point","coordinates":[-122.4194155,37.7749295]}}`, 3,
+		`{"type":"Feature","geometry":{"type":"Point","coordinates":[-122.419,37.775]}}`, t)
+}
+
+func TestRoundCoordinatesNested(t *testing.T) {
+	assertRounded(`{"geometry": {"coordinates": [[[1.23456, -0.00001], [2.5, 3]]]}}`, 2,
+		`{"geometry": {"coordinates": [[[1.23, 0], [2.5, 3]]]}}`, t)
+}
+
+func TestRoundCoordinatesGeometryCollection(t *testing.T) {
+	assertRounded(`{"features":[{"geometry":{"type":"GeometryCollection","geometries":[{"type":"Point","coordinates":[1.23456,2.34567]},{"type":"GeometryCollection","geometries":[{"type":"Point","coordinates":[3.45678,4.56789]}]}]}}]}`, 1,
+		`{"features":[{"geometry":{"type":"GeometryCollection","geometries":[{"type":"Point","coordinates":[1.2,2.3]},{"type":"GeometryCollection","geometries":[{"type":"Point","coordinates":[3.5,4.6]}]}]}}]}`, t)
+}
+
+func TestRoundCoordinatesLeavesProperties(t *testing.T) {
+	input := `{"geometry":{"type":"Point","coordinates":[1.23456,2.34567]},"properties":{"area":1.23456,"coordinates":"1.23456","ids":[1.23456],"name":"café \"coordinates\""}}`
+	expected := `{"geometry":{"type":"Point","coordinates":[1.2,2.3]},"properties":{"area":1.23456,"coordinates":"1.23456","ids":[1.23456],"name":"café \"coordinates\""}}`
+	assertRounded(input, 1, expected, t)
+}
+
+func TestRoundCoordinatesLeavesPropertyCoordinates(t *testing.T) {
+	input := `{"features":[{"geometry":{"type":"Point","coordinates":[1.23456,2.34567]},"properties":{"coordinates":[1.23456,2.34567],"geometry":{"coordinates":[1.23456]}}}]}`
+	expected := `{"features":[{"geometry":{"type":"Point","coordinates":[1.2,2.3]},"properties":{"coordinates":[1.23456,2.34567],"geometry":{"coordinates":[1.23456]}}}]}`
+	assertRounded(input, 1, expected, t)
+}
+
+func TestRoundCoordinatesNull(t *testing.T) {
+	assertRounded(`{"geometry":{"coordinates":null,"other":[1.23456]}}`, 1, `{"geometry":{"coordinates":null,"other":[1.23456]}}`, t)
+}
+
+func TestZoomPrecision(t *testing.T) {
+	if p := ZoomPrecision(0); p != 0 {
+		t.Fatalf("Expected precision at zoom 0 to be 0, but was %d", p)
+	}
+	if p := ZoomPrecision(16); p != 5 {
+		t.Fatalf("Expected precision at zoom 16 to be 5, but was %d", p)
+	}
+}
+
+func TestCopyLayersPrecision(t *testing.T) {
+	input := `{"pois":{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[1.23456,2.34567]},"properties":{"height":12.3456}}]},"water":{}}`
+	expected := `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[1.235,2.346]},"properties":{"height":12.3456}}]}`
+
+	digits := 3
+	var buf bytes.Buffer
+	err := NewCopyLayersWithOptions(map[string]bool{"pois": true}, &CopyOptions{Precision: &digits}).CopyLayers(strings.NewReader(input), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+	if buf.String() != expected {
+		t.Fatalf("Expected output to be %#v, but was %#v", expected, buf.String())
+	}
+}
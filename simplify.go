@@ -0,0 +1,288 @@
+package xonacatl
+
+import (
+	"container/heap"
+	"math"
+)
+
+// Simplify configures simplification of line and polygon geometries.
+//
+// Tolerance is the largest distance which a point may be moved by Douglas-Peucker simplification, or the square root of the smallest triangle area kept by Visvalingam-Whyatt simplification. It is in the units of the tile, i.e: tile units for MVT and degrees for GeoJSON, unless Pixels is set. In that case it is in pixels of a 256 pixel tile, and Zoom is used to convert it into degrees for GeoJSON.
+//
+// Simplified rings are kept only if they are still valid, i.e: they have some area, the same winding order as before and don't intersect themselves. Otherwise, the original ring is kept. Rings, polygons and lines which collapse to nothing are dropped.
+type Simplify struct {
+	Tolerance   float64
+	Pixels      bool
+	Zoom        int
+	Visvalingam bool
+}
+
+// mvtTransform returns the simplification transform for geometry in tile units with the given extent.
+func (s *Simplify) mvtTransform(extent uint32) geometryTransform {
+	tolerance := s.Tolerance
+	if s.Pixels {
+		tolerance = tolerance * float64(extent) / 256
+	}
+	return s.transform(tolerance)
+}
+
+// lonLatTransform returns the simplification transform for geometry in degrees.
+func (s *Simplify) lonLatTransform() geometryTransform {
+	tolerance := s.Tolerance
+	if s.Pixels {
+		tolerance = tolerance * 360 / (256 * math.Exp2(float64(s.Zoom)))
+	}
+	return s.transform(tolerance)
+}
+
+func (s *Simplify) transform(tolerance float64) geometryTransform {
+	simplify := simplifyDouglasPeucker
+	if s.Visvalingam {
+		simplify = simplifyVisvalingam
+	}
+
+	return func(g *Geometry) *Geometry {
+		return simplifyGeometry(g, tolerance, simplify)
+	}
+}
+
+// simplifyGeometry simplifies the lines and polygons of the geometry, returning nil if nothing remains of it. Points are not changed.
+func simplifyGeometry(g *Geometry, tolerance float64, simplify func([]Point, float64) []Point) *Geometry {
+	if tolerance <= 0 {
+		return g
+	}
+
+	result := &Geometry{Type: g.Type, Points: g.Points}
+
+	for _, line := range g.Lines {
+		simplified := simplify(line, tolerance)
+		if len(simplified) >= 2 && !(len(simplified) == 2 && simplified[0] == simplified[1]) {
+			result.Lines = append(result.Lines, simplified)
+		}
+	}
+
+	for _, polygon := range g.Polygons {
+		var rings [][]Point
+		for i, ring := range polygon {
+			simplified := simplifyRing(ring, tolerance, simplify)
+			if simplified == nil {
+				if i == 0 {
+					// without an exterior, the holes have nothing to be holes in.
+					break
+				}
+				continue
+			}
+			rings = append(rings, simplified)
+		}
+		if len(rings) > 0 {
+			result.Polygons = append(result.Polygons, rings)
+		}
+	}
+
+	return result.normalise()
+}
+
+// simplifyRing simplifies a closed ring, returning nil if it collapses. If the simplified ring is invalid, the original ring is returned instead.
+func simplifyRing(ring []Point, tolerance float64, simplify func([]Point, float64) []Point) []Point {
+	if len(ring) < 4 {
+		return nil
+	}
+	area := ringArea(ring)
+	if area == 0 {
+		return nil
+	}
+
+	simplified := simplify(ring, tolerance)
+	if len(simplified) < 4 {
+		// a ring smaller than the tolerance collapses entirely.
+		if math.Sqrt(math.Abs(area)) < tolerance {
+			return nil
+		}
+		return ring
+	}
+
+	simplified_area := ringArea(simplified)
+	if simplified_area == 0 {
+		return nil
+	}
+	if (simplified_area > 0) != (area > 0) || ringSelfIntersects(simplified) {
+		return ring
+	}
+
+	return simplified
+}
+
+// segmentDistance returns the distance from p to the segment from a to b.
+func segmentDistance(p, a, b Point) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	if dx == 0 && dy == 0 {
+		return math.Hypot(p[0]-a[0], p[1]-a[1])
+	}
+
+	t := ((p[0]-a[0])*dx + (p[1]-a[1])*dy) / (dx*dx + dy*dy)
+	if t < 0 {
+		t = 0
+	} else if t > 1 {
+		t = 1
+	}
+	return math.Hypot(p[0]-(a[0]+t*dx), p[1]-(a[1]+t*dy))
+}
+
+// simplifyDouglasPeucker simplifies the line with the Douglas-Peucker algorithm. The first and last points are always kept.
+func simplifyDouglasPeucker(line []Point, tolerance float64) []Point {
+	if len(line) < 3 {
+		return line
+	}
+
+	keep := make([]bool, len(line))
+	keep[0] = true
+	keep[len(line)-1] = true
+
+	// use an explicit stack of ranges rather than recursion, as lines can be long.
+	stack := [][2]int{{0, len(line) - 1}}
+	for len(stack) > 0 {
+		r := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		max_dist, max_idx := 0.0, -1
+		for i := r[0] + 1; i < r[1]; i++ {
+			d := segmentDistance(line[i], line[r[0]], line[r[1]])
+			if d > max_dist {
+				max_dist, max_idx = d, i
+			}
+		}
+
+		if max_idx >= 0 && max_dist > tolerance {
+			keep[max_idx] = true
+			stack = append(stack, [2]int{r[0], max_idx}, [2]int{max_idx, r[1]})
+		}
+	}
+
+	result := make([]Point, 0, len(line))
+	for i, p := range line {
+		if keep[i] {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func triangleArea(a, b, c Point) float64 {
+	return math.Abs((b[0]-a[0])*(c[1]-a[1])-(c[0]-a[0])*(b[1]-a[1])) / 2
+}
+
+// vwEntry is a point in the heap used by Visvalingam-Whyatt simplification.
+type vwEntry struct {
+	index int
+	area  float64
+	// version must match the point's current version, otherwise this is a stale entry left after the area was updated.
+	version int
+}
+
+type vwHeap []vwEntry
+
+func (h vwHeap) Len() int            { return len(h) }
+func (h vwHeap) Less(i, j int) bool  { return h[i].area < h[j].area }
+func (h vwHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *vwHeap) Push(x interface{}) { *h = append(*h, x.(vwEntry)) }
+func (h *vwHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// simplifyVisvalingam simplifies the line with the Visvalingam-Whyatt algorithm, repeatedly removing the point which forms the smallest triangle with its neighbours until all the triangles are larger than the square of the tolerance. The first and last points are always kept.
+func simplifyVisvalingam(line []Point, tolerance float64) []Point {
+	n := len(line)
+	if n < 3 {
+		return line
+	}
+
+	min_area := tolerance * tolerance
+	prev := make([]int, n)
+	next := make([]int, n)
+	version := make([]int, n)
+	removed := make([]bool, n)
+
+	h := &vwHeap{}
+	for i := range line {
+		prev[i] = i - 1
+		next[i] = i + 1
+		if i > 0 && i < n-1 {
+			*h = append(*h, vwEntry{index: i, area: triangleArea(line[i-1], line[i], line[i+1])})
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		e := heap.Pop(h).(vwEntry)
+		if removed[e.index] || e.version != version[e.index] {
+			continue
+		}
+		if e.area >= min_area {
+			break
+		}
+
+		removed[e.index] = true
+		p, q := prev[e.index], next[e.index]
+		next[p] = q
+		prev[q] = p
+
+		// the neighbours now form different triangles.
+		for _, i := range []int{p, q} {
+			if i > 0 && i < n-1 {
+				version[i] += 1
+				heap.Push(h, vwEntry{index: i, area: triangleArea(line[prev[i]], line[i], line[next[i]]), version: version[i]})
+			}
+		}
+	}
+
+	result := make([]Point, 0, n)
+	for i, p := range line {
+		if !removed[i] {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// segmentsIntersect returns true if the segments a-b and c-d cross or touch.
+func segmentsIntersect(a, b, c, d Point) bool {
+	cross := func(o, p, q Point) float64 {
+		return (p[0]-o[0])*(q[1]-o[1]) - (p[1]-o[1])*(q[0]-o[0])
+	}
+	on_segment := func(o, p, q Point) bool {
+		return math.Min(o[0], p[0]) <= q[0] && q[0] <= math.Max(o[0], p[0]) &&
+			math.Min(o[1], p[1]) <= q[1] && q[1] <= math.Max(o[1], p[1])
+	}
+
+	d1 := cross(c, d, a)
+	d2 := cross(c, d, b)
+	d3 := cross(a, b, c)
+	d4 := cross(a, b, d)
+
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+
+	return (d1 == 0 && on_segment(c, d, a)) || (d2 == 0 && on_segment(c, d, b)) ||
+		(d3 == 0 && on_segment(a, b, c)) || (d4 == 0 && on_segment(a, b, d))
+}
+
+// ringSelfIntersects returns true if any two non-adjacent edges of the closed ring intersect.
+func ringSelfIntersects(ring []Point) bool {
+	n := len(ring) - 1
+	for i := 0; i < n; i++ {
+		for j := i + 2; j < n; j++ {
+			// the first and last edges are adjacent, as they share the closing point.
+			if i == 0 && j == n-1 {
+				continue
+			}
+			if segmentsIntersect(ring[i], ring[i+1], ring[j], ring[j+1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
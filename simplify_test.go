@@ -0,0 +1,127 @@
+package xonacatl
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDouglasPeuckerLine(t *testing.T) {
+	line := []Point{{0, 0}, {1, 0.1}, {2, -0.1}, {3, 5}, {4, 6}, {5, 7}, {6, 8.1}, {7, 9}, {8, 9}, {9, 9}}
+	out := simplifyDouglasPeucker(line, 1)
+	expected := []Point{{0, 0}, {2, -0.1}, {3, 5}, {7, 9}, {9, 9}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("Expected Douglas-Peucker simplification to be %#v, but was %#v", expected, out)
+	}
+}
+
+func TestVisvalingamLine(t *testing.T) {
+	line := []Point{{0, 0}, {1, 0.1}, {2, 0}, {3, 5}, {4, 0}}
+	out := simplifyVisvalingam(line, 1)
+	expected := []Point{{0, 0}, {2, 0}, {3, 5}, {4, 0}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("Expected Visvalingam simplification to be %#v, but was %#v", expected, out)
+	}
+}
+
+// assertValidPolygon checks that each ring is closed, has at least three distinct points, has the same winding order as the original ring and doesn't intersect itself.
+func assertValidPolygon(original, simplified [][]Point, t *testing.T) {
+	if len(simplified) == 0 {
+		t.Fatalf("Expected polygon to survive simplification.")
+	}
+	for i, ring := range simplified {
+		if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+			t.Fatalf("Ring %d is not a closed ring: %#v", i, ring)
+		}
+		if math.Signbit(ringArea(ring)) != math.Signbit(ringArea(original[i])) {
+			t.Fatalf("Ring %d changed winding order: %#v", i, ring)
+		}
+		if ringSelfIntersects(ring) {
+			t.Fatalf("Ring %d intersects itself: %#v", i, ring)
+		}
+	}
+}
+
+func TestSimplifyPolygonValidity(t *testing.T) {
+	// a square with a noisy edge and a square hole.
+	exterior := []Point{{0, 0}, {5, 0.2}, {10, 0}, {10.1, 5}, {10, 10}, {5, 9.9}, {0, 10}, {0.1, 5}, {0, 0}}
+	hole := []Point{{3, 3}, {3, 7}, {7, 7}, {7, 3}, {3, 3}}
+	g := &Geometry{Type: "Polygon", Polygons: [][][]Point{{exterior, hole}}}
+
+	for _, simplify := range []func([]Point, float64) []Point{simplifyDouglasPeucker, simplifyVisvalingam} {
+		copied := &Geometry{Type: g.Type, Polygons: [][][]Point{{exterior, hole}}}
+		out := simplifyGeometry(copied, 1.5, simplify)
+		if out == nil || len(out.Polygons) != 1 || len(out.Polygons[0]) != 2 {
+			t.Fatalf("Expected a polygon with a hole, but was %#v", out)
+		}
+		assertValidPolygon(g.Polygons[0], out.Polygons[0], t)
+		if len(out.Polygons[0][0]) != 5 {
+			t.Fatalf("Expected noisy exterior to simplify to a square, but was %#v", out.Polygons[0][0])
+		}
+	}
+}
+
+func TestSimplifyKeepsOriginalIfInvalid(t *testing.T) {
+	ring := []Point{{0, 0}, {10, 0}, {10, 10}, {5, 11}, {0, 10}, {0, 0}}
+
+	// a simplification which makes the ring intersect itself.
+	crossed := func(_ []Point, _ float64) []Point {
+		return []Point{{0, 0}, {10, 0}, {0, 10}, {5, 12}, {0, 0}}
+	}
+	out := simplifyRing(ring, 1, crossed)
+	if !reflect.DeepEqual(out, ring) {
+		t.Fatalf("Expected original ring to be kept instead of self-intersecting one, but was %#v", out)
+	}
+
+	// a simplification which reverses the winding order.
+	reversed := func(_ []Point, _ float64) []Point {
+		return []Point{{0, 0}, {0, 10}, {10, 10}, {10, 0}, {0, 0}}
+	}
+	out = simplifyRing(ring, 1, reversed)
+	if !reflect.DeepEqual(out, ring) {
+		t.Fatalf("Expected original ring to be kept instead of reversed one, but was %#v", out)
+	}
+}
+
+func TestSimplifyDropsCollapsed(t *testing.T) {
+	g := &Geometry{Type: "MultiPolygon", Polygons: [][][]Point{
+		{{{0, 0}, {100, 0}, {100, 100}, {0, 100}, {0, 0}}, {{10, 10}, {10, 10.5}, {10.5, 10.5}, {10, 10}}},
+		{{{200, 200}, {200.5, 200}, {200.5, 200.5}, {200, 200}}},
+	}}
+	out := simplifyGeometry(g, 2, simplifyDouglasPeucker)
+	if out == nil || out.Type != "Polygon" || len(out.Polygons) != 1 || len(out.Polygons[0]) != 1 {
+		t.Fatalf("Expected tiny polygon and hole to be dropped, but was %#v", out)
+	}
+
+	line := &Geometry{Type: "LineString", Lines: [][]Point{{{0, 0}, {0.1, 0.1}, {0, 0}}}}
+	if out := simplifyGeometry(line, 1, simplifyDouglasPeucker); out != nil {
+		t.Fatalf("Expected collapsed line to be dropped, but was %#v", out)
+	}
+}
+
+func TestCopyLayersSimplify(t *testing.T) {
+	input := `{"roads":{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"LineString","coordinates":[[0,0],[1,0.001],[2,0]]},"properties":{}}]}}`
+
+	options := &CopyOptions{Simplify: &Simplify{Tolerance: 0.01}}
+	var buf bytes.Buffer
+	err := NewCopyLayersWithOptions(map[string]bool{"roads": true}, options).CopyLayers(strings.NewReader(input), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+
+	var fc struct {
+		Features []struct {
+			Geometry geoJSONGeometry `json:"geometry"`
+		} `json:"features"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &fc)
+	if err != nil {
+		t.Fatalf("Unable to parse output %#v: %s", buf.String(), err.Error())
+	}
+	if len(fc.Features) != 1 || string(fc.Features[0].Geometry.Coordinates) != "[[0,0],[2,0]]" {
+		t.Fatalf("Expected simplified line, but output was %#v", buf.String())
+	}
+}
@@ -0,0 +1,103 @@
+package xonacatl
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// CopyStats describes what a copier did with a tile.
+//
+// BytesRead and BytesWritten are the sizes of the whole input and output. LayerBytes has the size of each layer in the input, whether it was kept or not, which shows how much each layer contributes to the tile. For TopoJSON, this doesn't include the arcs, which are shared between layers. LayersKept has the names of the layers written to the output, sorted, and FeaturesKept is the number of features in them.
+type CopyStats struct {
+	BytesRead    int64
+	BytesWritten int64
+	LayersSeen   int
+	LayersKept   []string
+	FeaturesKept int
+	LayerBytes   map[string]int64
+}
+
+// StatsLayerCopier is a ContextLayerCopier which can also report statistics about the copy. Collecting the statistics has a small cost, so they are only collected when asked for with CopyLayersStats.
+type StatsLayerCopier interface {
+	ContextLayerCopier
+	CopyLayersStats(context.Context, io.Reader, io.Writer) (*CopyStats, error)
+}
+
+func newCopyStats() *CopyStats {
+	return &CopyStats{LayerBytes: make(map[string]int64)}
+}
+
+// seeLayer records a layer in the input, of the given size.
+func (s *CopyStats) seeLayer(name string, size int) {
+	if s == nil {
+		return
+	}
+	s.LayersSeen += 1
+	s.LayerBytes[name] += int64(size)
+}
+
+// keepLayer records a layer written to the output, with the given number of features.
+func (s *CopyStats) keepLayer(name string, features int) {
+	if s == nil {
+		return
+	}
+	s.LayersKept = append(s.LayersKept, name)
+	s.FeaturesKept += features
+}
+
+func (s *CopyStats) finish(rd *countingReader, wr *countingWriter) {
+	if s == nil {
+		return
+	}
+	s.BytesRead = rd.n
+	s.BytesWritten = wr.n
+	sort.Strings(s.LayersKept)
+}
+
+// countJSONArray returns the number of elements in the array under key in the JSON object, or zero if there isn't one.
+func countJSONArray(m json.RawMessage, key string) int {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(m, &obj) != nil {
+		return 0
+	}
+	var elements []json.RawMessage
+	if json.Unmarshal(obj[key], &elements) != nil {
+		return 0
+	}
+	return len(elements)
+}
+
+type countingReader struct {
+	rd io.Reader
+	n  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	wr io.Writer
+	n  int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.wr.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// copyWithStats runs the copy function, counting the bytes read and written, and returns the statistics it collected.
+func copyWithStats(ctx context.Context, rd io.Reader, wr io.Writer, copy_fn func(context.Context, io.Reader, io.Writer, *CopyStats) error) (*CopyStats, error) {
+	stats := newCopyStats()
+	counting_rd := &countingReader{rd: rd}
+	counting_wr := &countingWriter{wr: wr}
+
+	err := copy_fn(ctx, counting_rd, counting_wr, stats)
+	stats.finish(counting_rd, counting_wr)
+	return stats, err
+}
@@ -0,0 +1,79 @@
+package xonacatl
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func assertStats(t *testing.T, stats *CopyStats, input string, output []byte, seen int, kept []string, features int) {
+	if stats.BytesRead != int64(len(input)) {
+		t.Fatalf("Expected %d bytes read, but got %d", len(input), stats.BytesRead)
+	}
+	if stats.BytesWritten != int64(len(output)) {
+		t.Fatalf("Expected %d bytes written, but got %d", len(output), stats.BytesWritten)
+	}
+	if stats.LayersSeen != seen {
+		t.Fatalf("Expected %d layers seen, but got %d", seen, stats.LayersSeen)
+	}
+	if !reflect.DeepEqual(stats.LayersKept, kept) {
+		t.Fatalf("Expected layers kept to be %#v, but got %#v", kept, stats.LayersKept)
+	}
+	if stats.FeaturesKept != features {
+		t.Fatalf("Expected %d features kept, but got %d", features, stats.FeaturesKept)
+	}
+	if len(stats.LayerBytes) != seen {
+		t.Fatalf("Expected sizes for %d layers, but got %#v", seen, stats.LayerBytes)
+	}
+}
+
+func TestGeoJSONStats(t *testing.T) {
+	water := `{"type":"FeatureCollection","features":[{},{}]}`
+	input := `{"water":` + water + `,"roads":{"type":"FeatureCollection","features":[{}]},"pois":{}}`
+	layers := map[string]bool{"water": true, "roads": true}
+
+	var buf bytes.Buffer
+	stats, err := NewCopyLayers(layers).CopyLayersStats(context.Background(), strings.NewReader(input), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayersStats failed, error: %s", err.Error())
+	}
+	assertStats(t, stats, input, buf.Bytes(), 3, []string{"roads", "water"}, 3)
+	if stats.LayerBytes["water"] != int64(len(water)) {
+		t.Fatalf("Expected water layer to be %d bytes, but got %d", len(water), stats.LayerBytes["water"])
+	}
+}
+
+func TestTopoJSONStats(t *testing.T) {
+	input := `{"type":"Topology","objects":{"water":{"type":"GeometryCollection","geometries":[{"type":"Point","coordinates":[0,0]}]},"roads":{"type":"GeometryCollection","geometries":[]}},"arcs":[]}`
+
+	var buf bytes.Buffer
+	stats, err := NewCopyTopoJSONLayers(map[string]bool{"water": true}).CopyLayersStats(context.Background(), strings.NewReader(input), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayersStats failed, error: %s", err.Error())
+	}
+	assertStats(t, stats, input, buf.Bytes(), 2, []string{"water"}, 1)
+}
+
+func TestMVTStats(t *testing.T) {
+	// has a water layer with a single polygon feature.
+	mvt := []byte{26, 73, 10, 5, 119, 97, 116, 101, 114, 18, 26, 8, 1, 18, 6, 0, 0, 1, 1, 2, 2, 24, 3, 34, 12, 9, 0, 128, 64, 26, 0, 1, 2, 0, 0, 2, 15, 26, 3, 102, 111, 111, 26, 3, 98, 97, 122, 26, 3, 117, 105, 100, 34, 5, 10, 3, 98, 97, 114, 34, 5, 10, 3, 102, 111, 111, 34, 2, 32, 123, 40, 128, 32, 120, 2}
+
+	var buf bytes.Buffer
+	stats, err := NewCopyMVTLayers(map[string]bool{"water": true}).CopyLayersStats(context.Background(), bytes.NewReader(mvt), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayersStats failed, error: %s", err.Error())
+	}
+	assertStats(t, stats, string(mvt), buf.Bytes(), 1, []string{"water"}, 1)
+	if stats.LayerBytes["water"] != 73 {
+		t.Fatalf("Expected water layer to be 73 bytes, but got %d", stats.LayerBytes["water"])
+	}
+
+	buf.Reset()
+	stats, err = NewCopyMVTLayers(map[string]bool{"roads": true}).CopyLayersStats(context.Background(), bytes.NewReader(mvt), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayersStats failed, error: %s", err.Error())
+	}
+	assertStats(t, stats, string(mvt), buf.Bytes(), 1, nil, 0)
+}
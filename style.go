@@ -0,0 +1,498 @@
+package xonacatl
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// Style is the subset of a Mapbox GL / MapLibre style document needed to decide which layers and features it uses.
+type Style struct {
+	Layers []StyleLayer `json:"layers"`
+}
+
+// StyleLayer is a single layer of a style. Filter is kept in its original JSON form and compiled into a FeatureFilter when needed.
+type StyleLayer struct {
+	Id          string          `json:"id"`
+	Type        string          `json:"type"`
+	Source      string          `json:"source"`
+	SourceLayer string          `json:"source-layer"`
+	MinZoom     *float64        `json:"minzoom"`
+	MaxZoom     *float64        `json:"maxzoom"`
+	Filter      json.RawMessage `json:"filter"`
+	Layout      struct {
+		Visibility string `json:"visibility"`
+	} `json:"layout"`
+}
+
+// ParseStyle reads a style document.
+func ParseStyle(rd io.Reader) (*Style, error) {
+	var s Style
+	err := json.NewDecoder(rd).Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// visibleAt returns true if the style layer might be drawn using data from a tile at zoom z. A tile at zoom z is displayed at zooms from z up to, but not including, z+1.
+func (l *StyleLayer) visibleAt(z int) bool {
+	if l.Layout.Visibility == "none" {
+		return false
+	}
+	if l.MinZoom != nil && *l.MinZoom >= float64(z+1) {
+		return false
+	}
+	if l.MaxZoom != nil && *l.MaxZoom <= float64(z) {
+		return false
+	}
+	return true
+}
+
+// LayersAt returns the set of source layers which the style uses from the given source at zoom z, along with filters for the features which the style uses in each of them.
+//
+// If source is empty, then style layers from any source are considered. If z is negative, then layers at any zoom are considered. A source layer has a filter only if every style layer using it has a filter which can be translated, otherwise all the features in the layer are kept.
+func (s *Style) LayersAt(source string, z int) (map[string]bool, map[string]FeatureFilter) {
+	layers := make(map[string]bool)
+	filters := make(map[string][]FeatureFilter)
+	keep_all := make(map[string]bool)
+
+	for i := range s.Layers {
+		l := &s.Layers[i]
+		if len(l.SourceLayer) == 0 {
+			continue
+		}
+		if len(source) > 0 && l.Source != source {
+			continue
+		}
+		if z >= 0 && !l.visibleAt(z) {
+			continue
+		}
+
+		layers[l.SourceLayer] = true
+
+		var filter FeatureFilter
+		if len(l.Filter) > 0 {
+			filter = CompileStyleFilter(l.Filter)
+		}
+		if filter == nil {
+			keep_all[l.SourceLayer] = true
+		} else {
+			filters[l.SourceLayer] = append(filters[l.SourceLayer], filter)
+		}
+	}
+
+	result := make(map[string]FeatureFilter)
+	for name, fs := range filters {
+		if keep_all[name] {
+			continue
+		}
+		result[name] = anyFilter(fs)
+	}
+
+	return layers, result
+}
+
+// anyFilter keeps a feature if any of the filters keeps it.
+func anyFilter(filters []FeatureFilter) FeatureFilter {
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	return FeatureFilterFunc(func(f *Feature) bool {
+		for _, filter := range filters {
+			if filter.KeepFeature(f) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// CompileStyleFilter translates a style filter, in either the legacy filter syntax or the expression syntax, into a FeatureFilter.
+//
+// Not every filter can be translated. Where part of a filter can't be translated, the result keeps at least all the features which the original filter would have. If none of the filter can be translated, nil is returned, meaning that all features should be kept.
+func CompileStyleFilter(raw json.RawMessage) FeatureFilter {
+	var v interface{}
+	err := json.Unmarshal(raw, &v)
+	if err != nil {
+		return nil
+	}
+
+	fn, _ := compileFilter(v)
+	if fn == nil {
+		return nil
+	}
+	return FeatureFilterFunc(fn)
+}
+
+type filterFunc func(f *Feature) bool
+
+// valueFunc evaluates an expression to a value for a feature.
+type valueFunc func(f *Feature) interface{}
+
+// compileFilter translates a filter into a function. It returns nil if the filter can't be translated, and exact is false if the function keeps a superset of the features which the original filter would.
+func compileFilter(v interface{}) (fn filterFunc, exact bool) {
+	if b, ok := v.(bool); ok {
+		return func(_ *Feature) bool { return b }, true
+	}
+
+	args, ok := v.([]interface{})
+	if !ok || len(args) == 0 {
+		return nil, false
+	}
+	op, ok := args[0].(string)
+	if !ok {
+		return nil, false
+	}
+	args = args[1:]
+
+	switch op {
+	case "all":
+		return compileAll(args)
+
+	case "any":
+		return compileAny(args)
+
+	case "none":
+		any, exact := compileAny(args)
+		if any == nil || !exact {
+			return nil, false
+		}
+		return func(f *Feature) bool { return !any(f) }, true
+
+	case "!":
+		if len(args) != 1 {
+			return nil, false
+		}
+		inner, exact := compileFilter(args[0])
+		if inner == nil || !exact {
+			return nil, false
+		}
+		return func(f *Feature) bool { return !inner(f) }, true
+
+	case "has", "!has":
+		if len(args) != 1 {
+			return nil, false
+		}
+		key, ok := args[0].(string)
+		if !ok {
+			return nil, false
+		}
+		negate := op == "!has"
+		return func(f *Feature) bool {
+			_, has := featureValue(f, key)
+			return has != negate
+		}, true
+
+	case "==", "!=", "<", "<=", ">", ">=":
+		if len(args) != 2 {
+			return nil, false
+		}
+		lhs, rhs := compileComparands(args[0], args[1])
+		if lhs == nil || rhs == nil {
+			return nil, false
+		}
+		return func(f *Feature) bool {
+			return compareValues(op, lhs(f), rhs(f))
+		}, true
+
+	case "in", "!in":
+		return compileIn(op == "!in", args)
+
+	case "match":
+		return compileMatch(args)
+	}
+
+	return nil, false
+}
+
+func compileAll(args []interface{}) (filterFunc, bool) {
+	var fns []filterFunc
+	exact := true
+
+	for _, arg := range args {
+		fn, fn_exact := compileFilter(arg)
+		if fn == nil {
+			// dropping a term from a conjunction keeps more features, so the rest can still be used.
+			exact = false
+			continue
+		}
+		exact = exact && fn_exact
+		fns = append(fns, fn)
+	}
+
+	if len(fns) == 0 && len(args) > 0 {
+		return nil, false
+	}
+
+	return func(f *Feature) bool {
+		for _, fn := range fns {
+			if !fn(f) {
+				return false
+			}
+		}
+		return true
+	}, exact
+}
+
+func compileAny(args []interface{}) (filterFunc, bool) {
+	var fns []filterFunc
+	exact := true
+
+	for _, arg := range args {
+		fn, fn_exact := compileFilter(arg)
+		if fn == nil {
+			// an untranslatable term in a disjunction could keep any feature.
+			return nil, false
+		}
+		exact = exact && fn_exact
+		fns = append(fns, fn)
+	}
+
+	return func(f *Feature) bool {
+		for _, fn := range fns {
+			if fn(f) {
+				return true
+			}
+		}
+		return false
+	}, exact
+}
+
+// compileIn handles both the legacy ["in", key, v0, v1, ...] form and the expression ["in", needle, haystack] form.
+func compileIn(negate bool, args []interface{}) (filterFunc, bool) {
+	if len(args) < 1 {
+		return nil, false
+	}
+
+	_, expr_haystack := args[len(args)-1].([]interface{})
+	if key, ok := args[0].(string); ok && !(len(args) == 2 && expr_haystack) {
+		values := args[1:]
+		return func(f *Feature) bool {
+			v, _ := featureValue(f, key)
+			for _, candidate := range values {
+				if compareValues("==", v, candidate) {
+					return !negate
+				}
+			}
+			return negate
+		}, true
+	}
+
+	if negate || len(args) != 2 {
+		return nil, false
+	}
+	needle := compileValue(args[0])
+	haystack := compileValue(args[1])
+	if needle == nil || haystack == nil {
+		return nil, false
+	}
+	return func(f *Feature) bool {
+		n := needle(f)
+		switch h := haystack(f).(type) {
+		case []interface{}:
+			for _, candidate := range h {
+				if compareValues("==", n, candidate) {
+					return true
+				}
+			}
+		case string:
+			if s, ok := n.(string); ok {
+				return strings.Contains(h, s)
+			}
+		}
+		return false
+	}, true
+}
+
+// compileMatch handles ["match", input, labels, output, ..., fallback] where the outputs are all booleans.
+func compileMatch(args []interface{}) (filterFunc, bool) {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return nil, false
+	}
+
+	input := compileValue(args[0])
+	if input == nil {
+		return nil, false
+	}
+
+	type matchCase struct {
+		labels []interface{}
+		output bool
+	}
+	var cases []matchCase
+	for i := 1; i+1 < len(args); i += 2 {
+		output, ok := args[i+1].(bool)
+		if !ok {
+			return nil, false
+		}
+		labels, ok := args[i].([]interface{})
+		if !ok {
+			labels = []interface{}{args[i]}
+		}
+		cases = append(cases, matchCase{labels: labels, output: output})
+	}
+	fallback, ok := args[len(args)-1].(bool)
+	if !ok {
+		return nil, false
+	}
+
+	return func(f *Feature) bool {
+		v := input(f)
+		for _, c := range cases {
+			for _, label := range c.labels {
+				if compareValues("==", v, label) {
+					return c.output
+				}
+			}
+		}
+		return fallback
+	}, true
+}
+
+// compileComparands compiles the arguments of a comparison. In the legacy syntax, the first argument is a property name and the second a literal value. In the expression syntax, both are expressions.
+func compileComparands(a, b interface{}) (valueFunc, valueFunc) {
+	if key, ok := a.(string); ok {
+		if _, is_expr := b.([]interface{}); !is_expr {
+			value := b
+			return func(f *Feature) interface{} {
+				v, _ := featureValue(f, key)
+				return v
+			}, func(_ *Feature) interface{} { return value }
+		}
+	}
+
+	return compileValue(a), compileValue(b)
+}
+
+// compileValue compiles a value expression, returning nil if it can't be translated.
+func compileValue(v interface{}) valueFunc {
+	args, ok := v.([]interface{})
+	if !ok {
+		return func(_ *Feature) interface{} { return v }
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	op, ok := args[0].(string)
+	if !ok {
+		return nil
+	}
+
+	switch op {
+	case "get":
+		if len(args) != 2 {
+			return nil
+		}
+		key, ok := args[1].(string)
+		if !ok {
+			return nil
+		}
+		return func(f *Feature) interface{} { return f.Properties[key] }
+
+	case "geometry-type":
+		return func(f *Feature) interface{} { return f.GeometryType }
+
+	case "id":
+		return func(f *Feature) interface{} { return f.Id }
+
+	case "literal":
+		if len(args) != 2 {
+			return nil
+		}
+		value := args[1]
+		return func(_ *Feature) interface{} { return value }
+
+	case "to-string", "string":
+		if len(args) != 2 {
+			return nil
+		}
+		inner := compileValue(args[1])
+		if inner == nil {
+			return nil
+		}
+		return func(f *Feature) interface{} {
+			s, _ := inner(f).(string)
+			return s
+		}
+	}
+
+	return nil
+}
+
+// featureValue looks up a property for the legacy filter syntax, where "$type" and "$id" refer to the geometry type and feature ID.
+func featureValue(f *Feature, key string) (interface{}, bool) {
+	switch key {
+	case "$type":
+		return f.GeometryType, true
+	case "$id":
+		return f.Id, f.Id != nil
+	}
+	v, ok := f.Properties[key]
+	return v, ok
+}
+
+// scalarEqual returns true if a and b are the same string, number, bool or both nil. Other types, such as arrays, are never equal.
+func scalarEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		return ok && x == y
+	case float64:
+		y, ok := b.(float64)
+		return ok && x == y
+	case bool:
+		y, ok := b.(bool)
+		return ok && x == y
+	case nil:
+		return b == nil
+	}
+	return false
+}
+
+// compareValues compares two values with the given operator. Values of different types are never equal, and ordering is only defined between two numbers or two strings.
+func compareValues(op string, a, b interface{}) bool {
+	switch op {
+	case "==":
+		return scalarEqual(a, b)
+	case "!=":
+		return !scalarEqual(a, b)
+	}
+
+	if x, ok := a.(float64); ok {
+		y, ok := b.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "<":
+			return x < y
+		case "<=":
+			return x <= y
+		case ">":
+			return x > y
+		case ">=":
+			return x >= y
+		}
+	}
+
+	if x, ok := a.(string); ok {
+		y, ok := b.(string)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "<":
+			return x < y
+		case "<=":
+			return x <= y
+		case ">":
+			return x > y
+		case ">=":
+			return x >= y
+		}
+	}
+
+	return false
+}
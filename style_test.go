@@ -0,0 +1,113 @@
+package xonacatl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testStyle = `{
+  "version": 8,
+  "sources": {"osm": {"type": "vector"}},
+  "layers": [
+    {"id": "background", "type": "background"},
+    {"id": "water", "type": "fill", "source": "osm", "source-layer": "water"},
+    {"id": "major-roads", "type": "line", "source": "osm", "source-layer": "roads", "filter": ["in", "kind", "highway", "major_road"]},
+    {"id": "minor-roads", "type": "line", "source": "osm", "source-layer": "roads", "minzoom": 12, "filter": ["==", ["get", "kind"], "minor_road"]},
+    {"id": "buildings", "type": "fill", "source": "osm", "source-layer": "buildings", "minzoom": 13},
+    {"id": "hidden", "type": "fill", "source": "osm", "source-layer": "landuse", "layout": {"visibility": "none"}},
+    {"id": "pois", "type": "symbol", "source": "other", "source-layer": "pois", "maxzoom": 10}
+  ]
+}`
+
+func parseTestStyle(t *testing.T) *Style {
+	s, err := ParseStyle(strings.NewReader(testStyle))
+	if err != nil {
+		t.Fatalf("ParseStyle failed, error: %s", err.Error())
+	}
+	return s
+}
+
+func assertStyleLayers(s *Style, source string, z int, expected map[string]bool, t *testing.T) map[string]FeatureFilter {
+	layers, filters := s.LayersAt(source, z)
+	if !reflect.DeepEqual(layers, expected) {
+		t.Fatalf("Expected LayersAt(%#v, %d) to be %#v, but was %#v", source, z, expected, layers)
+	}
+	return filters
+}
+
+func TestStyleLayersAtZoom(t *testing.T) {
+	s := parseTestStyle(t)
+
+	assertStyleLayers(s, "osm", 5, map[string]bool{"water": true, "roads": true}, t)
+	assertStyleLayers(s, "osm", 13, map[string]bool{"water": true, "roads": true, "buildings": true}, t)
+	assertStyleLayers(s, "", 9, map[string]bool{"water": true, "roads": true, "pois": true}, t)
+	assertStyleLayers(s, "", 10, map[string]bool{"water": true, "roads": true}, t)
+}
+
+func TestStyleFiltersCombine(t *testing.T) {
+	s := parseTestStyle(t)
+
+	highway := &Feature{Layer: "roads", GeometryType: "LineString", Properties: map[string]interface{}{"kind": "highway"}}
+	minor := &Feature{Layer: "roads", GeometryType: "LineString", Properties: map[string]interface{}{"kind": "minor_road"}}
+	path := &Feature{Layer: "roads", GeometryType: "LineString", Properties: map[string]interface{}{"kind": "path"}}
+
+	filters := assertStyleLayers(s, "osm", 5, map[string]bool{"water": true, "roads": true}, t)
+	if _, ok := filters["water"]; ok {
+		t.Fatalf("Expected no filter on unfiltered water layer.")
+	}
+	roads := filters["roads"]
+	if !roads.KeepFeature(highway) || roads.KeepFeature(minor) || roads.KeepFeature(path) {
+		t.Fatalf("Expected only highways to be kept at zoom 5.")
+	}
+
+	filters = assertStyleLayers(s, "osm", 12, map[string]bool{"water": true, "roads": true}, t)
+	roads = filters["roads"]
+	if !roads.KeepFeature(highway) || !roads.KeepFeature(minor) || roads.KeepFeature(path) {
+		t.Fatalf("Expected highways and minor roads to be kept at zoom 12.")
+	}
+}
+
+func assertFilter(filter string, f *Feature, expected bool, t *testing.T) {
+	fn := CompileStyleFilter([]byte(filter))
+	if fn == nil {
+		t.Fatalf("Expected filter %s to be translated, but it wasn't.", filter)
+	}
+	if fn.KeepFeature(f) != expected {
+		t.Fatalf("Expected filter %s on %#v to be %v", filter, f, expected)
+	}
+}
+
+func TestStyleFilterExpressions(t *testing.T) {
+	f := &Feature{
+		GeometryType: "Polygon",
+		Id:           float64(3),
+		Properties:   map[string]interface{}{"kind": "park", "area": float64(1000), "name": "Central"},
+	}
+
+	assertFilter(`["==", "$type", "Polygon"]`, f, true, t)
+	assertFilter(`["==", ["geometry-type"], "Point"]`, f, false, t)
+	assertFilter(`["all", ["has", "name"], [">=", "area", 500]]`, f, true, t)
+	assertFilter(`["any", ["!has", "name"], ["<", ["get", "area"], 500]]`, f, false, t)
+	assertFilter(`["none", ["==", "kind", "forest"]]`, f, true, t)
+	assertFilter(`["!", ["in", ["get", "kind"], ["literal", ["park", "garden"]]]]`, f, false, t)
+	assertFilter(`["!in", "kind", "forest", "wood"]`, f, true, t)
+	assertFilter(`["match", ["get", "kind"], ["park", "garden"], true, false]`, f, true, t)
+	assertFilter(`["==", "$id", 3]`, f, true, t)
+}
+
+func TestStyleFilterUntranslatable(t *testing.T) {
+	if CompileStyleFilter([]byte(`["within", {"type": "Polygon"}]`)) != nil {
+		t.Fatalf("Expected untranslatable filter to compile to nil.")
+	}
+	if CompileStyleFilter([]byte(`["any", ["==", "kind", "park"], ["within", {}]]`)) != nil {
+		t.Fatalf("Expected disjunction with untranslatable term to compile to nil.")
+	}
+
+	// an untranslatable term in a conjunction is dropped, keeping more features than the original would.
+	f := &Feature{Properties: map[string]interface{}{"kind": "park"}}
+	assertFilter(`["all", ["==", "kind", "park"], ["within", {}]]`, f, true, t)
+	if CompileStyleFilter([]byte(`["!", ["all", ["==", "kind", "park"], ["within", {}]]]`)) != nil {
+		t.Fatalf("Expected negation of an approximate filter to compile to nil.")
+	}
+}
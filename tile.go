@@ -0,0 +1,98 @@
+package xonacatl
+
+import (
+	"fmt"
+	"math"
+)
+
+// MaxZoom is the deepest zoom which tiles can be overzoomed to. Beyond it, the scale from the ancestor tile would overflow, and the tiles are far smaller than anything worth drawing.
+const MaxZoom = 30
+
+// TileCoord is the zoom, column and row of a tile in the XYZ scheme.
+type TileCoord struct {
+	Z, X, Y int
+}
+
+// Parent returns the ancestor of the tile at zoom z, which must not be greater than the tile's own zoom.
+func (t TileCoord) Parent(z int) TileCoord {
+	dz := uint(t.Z - z)
+	return TileCoord{Z: z, X: t.X >> dz, Y: t.Y >> dz}
+}
+
+func tileLon(x float64, z int) float64 {
+	return x/math.Exp2(float64(z))*360 - 180
+}
+
+func tileLat(y float64, z int) float64 {
+	n := math.Pi * (1 - 2*y/math.Exp2(float64(z)))
+	return math.Atan(math.Sinh(n)) * 180 / math.Pi
+}
+
+// lonTileX returns the fractional tile column of the longitude at zoom z, the inverse of tileLon.
+func lonTileX(lon float64, z int) float64 {
+	return (lon + 180) / 360 * math.Exp2(float64(z))
+}
+
+// latTileY returns the fractional tile row of the latitude at zoom z, the inverse of tileLat.
+func latTileY(lat float64, z int) float64 {
+	r := lat * math.Pi / 180
+	return (1 - math.Log(math.Tan(r)+1/math.Cos(r))/math.Pi) / 2 * math.Exp2(float64(z))
+}
+
+// Bounds returns the longitude and latitude bounds of the tile in the web mercator projection.
+func (t TileCoord) Bounds() Box {
+	return Box{
+		MinX: tileLon(float64(t.X), t.Z),
+		MinY: tileLat(float64(t.Y+1), t.Z),
+		MaxX: tileLon(float64(t.X+1), t.Z),
+		MaxY: tileLat(float64(t.Y), t.Z),
+	}
+}
+
+// Overzoom describes serving a tile beyond the origin's maximum zoom by cutting it out of an ancestor tile which the origin does have.
+//
+// Buffer is the extra margin, in pixels of a 256 pixel tile, to keep around the edge of the tile when clipping, so that lines and polygon edges don't show seams at the tile boundary.
+type Overzoom struct {
+	Tile   TileCoord
+	Source TileCoord
+	Buffer float64
+}
+
+// NewOverzoom returns the Overzoom for serving tile from its ancestor at max_zoom, or nil if the tile isn't beyond max_zoom. It returns an error if the tile is beyond MaxZoom.
+func NewOverzoom(tile TileCoord, max_zoom int, buffer float64) (*Overzoom, error) {
+	if tile.Z <= max_zoom {
+		return nil, nil
+	}
+	if tile.Z > MaxZoom {
+		return nil, fmt.Errorf("Unable to overzoom tile %d/%d/%d beyond zoom %d", tile.Z, tile.X, tile.Y, MaxZoom)
+	}
+	return &Overzoom{Tile: tile, Source: tile.Parent(max_zoom), Buffer: buffer}, nil
+}
+
+// mvtTransform returns a transform which rescales geometry in tile units of the source tile into the requested tile, clipping to the requested tile plus the buffer.
+func (o *Overzoom) mvtTransform(extent uint32) geometryTransform {
+	dz := uint(o.Tile.Z - o.Source.Z)
+	scale := float64(uint(1) << dz)
+	ext := float64(extent)
+	offset_x := float64(o.Tile.X-o.Source.X<<dz) * ext
+	offset_y := float64(o.Tile.Y-o.Source.Y<<dz) * ext
+	buffer := o.Buffer * ext / 256
+	clip := Box{-buffer, -buffer, ext + buffer, ext + buffer}
+
+	return func(g *Geometry) *Geometry {
+		g.Transform(func(p Point) Point {
+			return Point{p[0]*scale - offset_x, p[1]*scale - offset_y}
+		})
+		return g.ClipToBox(clip)
+	}
+}
+
+// lonLatTransform returns a transform which clips geometry in longitude and latitude to the requested tile plus the buffer.
+func (o *Overzoom) lonLatTransform() geometryTransform {
+	bounds := o.Tile.Bounds()
+	clip := bounds.Expand((bounds.MaxX-bounds.MinX)*o.Buffer/256, (bounds.MaxY-bounds.MinY)*o.Buffer/256)
+
+	return func(g *Geometry) *Geometry {
+		return g.ClipToBox(clip)
+	}
+}
@@ -0,0 +1,109 @@
+package xonacatl
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	"github.com/tilezen/xonacatl/mapnik_vector"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTileParent(t *testing.T) {
+	parent := TileCoord{Z: 18, X: 77203, Y: 98541}.Parent(16)
+	expected := TileCoord{Z: 16, X: 19300, Y: 24635}
+	if parent != expected {
+		t.Fatalf("Expected parent to be %#v, but was %#v", expected, parent)
+	}
+}
+
+func TestTileBounds(t *testing.T) {
+	b := TileCoord{Z: 1, X: 1, Y: 0}.Bounds()
+	if b.MinX != 0 || b.MaxX != 180 || b.MinY != 0 || math.Abs(b.MaxY-85.0511287798) > 1e-9 {
+		t.Fatalf("Unexpected bounds for tile 1/1/0: %#v", b)
+	}
+}
+
+func TestNewOverzoom(t *testing.T) {
+	if o, err := NewOverzoom(TileCoord{Z: 16, X: 0, Y: 0}, 16, 0); o != nil || err != nil {
+		t.Fatalf("Expected no overzoom for tile at the maximum zoom.")
+	}
+	if _, err := NewOverzoom(TileCoord{Z: MaxZoom + 1, X: 0, Y: 0}, 16, 0); err == nil {
+		t.Fatalf("Expected an error for overzooming beyond zoom %d.", MaxZoom)
+	}
+	if _, err := NewOverzoom(TileCoord{Z: 80, X: 0, Y: 0}, 0, 0); err == nil {
+		t.Fatalf("Expected an error for overzooming by more than 64 zooms.")
+	}
+}
+
+func TestOverzoomMVT(t *testing.T) {
+	// a line across the whole of tile 0/0/0, at y=1024 in the top half.
+	layer := &mapnik_vector.TileLayer{
+		Version: proto.Uint32(2),
+		Name:    proto.String("roads"),
+		Extent:  proto.Uint32(4096),
+		Features: []*mapnik_vector.TileFeature{{
+			Type:     mapnik_vector.Tile_LineString.Enum(),
+			Geometry: []uint32{9, 0, 2048, 10, 8192, 0},
+		}},
+	}
+	input, err := proto.Marshal(&mapnik_vector.Tile{Layers: []*mapnik_vector.TileLayer{layer}})
+	if err != nil {
+		t.Fatalf("Unable to marshal test tile: %s", err.Error())
+	}
+
+	overzoom, err := NewOverzoom(TileCoord{Z: 1, X: 1, Y: 0}, 0, 0)
+	if err != nil {
+		t.Fatalf("Unable to overzoom: %s", err.Error())
+	}
+	options := &CopyOptions{Overzoom: overzoom}
+	var buf bytes.Buffer
+	err = NewCopyMVTLayersWithOptions(map[string]bool{"all": true}, options).CopyLayers(bytes.NewReader(input), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+
+	var out mapnik_vector.Tile
+	err = proto.Unmarshal(buf.Bytes(), &out)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal output tile: %s", err.Error())
+	}
+
+	g, err := decodeMVTGeometry(out.Layers[0].Features[0].GetType(), out.Layers[0].Features[0].Geometry)
+	if err != nil {
+		t.Fatalf("Unable to decode output geometry: %s", err.Error())
+	}
+	// in tile 1/1/0, the line is doubled in scale and covers the left edge to the right edge.
+	expected := &Geometry{Type: "LineString", Lines: [][]Point{{{0, 2048}, {4096, 2048}}}}
+	if !reflect.DeepEqual(g, expected) {
+		t.Fatalf("Expected overzoomed geometry to be %#v, but was %#v", expected, g)
+	}
+}
+
+func TestOverzoomGeoJSON(t *testing.T) {
+	input := `{"pois":{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[-90,45]},"properties":{"name":"west"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[90,45]},"properties":{"name":"east"}}]}}`
+
+	overzoom, err := NewOverzoom(TileCoord{Z: 1, X: 1, Y: 0}, 0, 0)
+	if err != nil {
+		t.Fatalf("Unable to overzoom: %s", err.Error())
+	}
+	options := &CopyOptions{Overzoom: overzoom}
+	var buf bytes.Buffer
+	err = NewCopyLayersWithOptions(map[string]bool{"pois": true}, options).CopyLayers(strings.NewReader(input), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+
+	var fc struct {
+		Features []geoJSONFeature `json:"features"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &fc)
+	if err != nil {
+		t.Fatalf("Unable to parse output %#v: %s", buf.String(), err.Error())
+	}
+	if len(fc.Features) != 1 || fc.Features[0].Properties["name"] != "east" {
+		t.Fatalf("Expected only the eastern point in tile 1/1/0, but output was %#v", buf.String())
+	}
+}
@@ -0,0 +1,225 @@
+package xonacatl
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/tilezen/xonacatl/mapnik_vector"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// TileJSON is a TileJSON 3.0 document describing a tile set. Only the subset of the spec which xonacatl can fill in is represented here.
+type TileJSON struct {
+	TileJSON     string        `json:"tilejson"`
+	Name         string        `json:"name,omitempty"`
+	Description  string        `json:"description,omitempty"`
+	Attribution  string        `json:"attribution,omitempty"`
+	Scheme       string        `json:"scheme,omitempty"`
+	Tiles        []string      `json:"tiles"`
+	MinZoom      int           `json:"minzoom"`
+	MaxZoom      int           `json:"maxzoom"`
+	Bounds       []float64     `json:"bounds,omitempty"`
+	Center       []float64     `json:"center,omitempty"`
+	VectorLayers []VectorLayer `json:"vector_layers"`
+}
+
+// VectorLayer describes a single layer, and the types of the fields of its features.
+type VectorLayer struct {
+	ID          string            `json:"id"`
+	Description string            `json:"description,omitempty"`
+	MinZoom     *int              `json:"minzoom,omitempty"`
+	MaxZoom     *int              `json:"maxzoom,omitempty"`
+	Fields      map[string]string `json:"fields"`
+}
+
+const (
+	TileJSONVersion = "3.0.0"
+
+	FieldString  = "String"
+	FieldNumber  = "Number"
+	FieldBoolean = "Boolean"
+)
+
+// Subset returns a copy of the TileJSON document with only the vector layers in the given set. If layers contains "all", then all the vector layers are kept.
+func (t *TileJSON) Subset(layers map[string]bool) *TileJSON {
+	subset := *t
+	if layers["all"] {
+		return &subset
+	}
+
+	subset.VectorLayers = nil
+	for _, l := range t.VectorLayers {
+		if layers[l.ID] {
+			subset.VectorLayers = append(subset.VectorLayers, l)
+		}
+	}
+
+	return &subset
+}
+
+// MergeVectorLayers merges the layers and fields from both lists, returning a new list sorted by layer ID. Where the same field appears in both with different types, the type from a is kept.
+func MergeVectorLayers(a, b []VectorLayer) []VectorLayer {
+	merged := make(map[string]*VectorLayer)
+	for _, ls := range [][]VectorLayer{a, b} {
+		for _, l := range ls {
+			m, ok := merged[l.ID]
+			if !ok {
+				m = &VectorLayer{
+					ID:          l.ID,
+					Description: l.Description,
+					MinZoom:     l.MinZoom,
+					MaxZoom:     l.MaxZoom,
+					Fields:      make(map[string]string),
+				}
+				merged[l.ID] = m
+			}
+			for k, v := range l.Fields {
+				if _, ok := m.Fields[k]; !ok {
+					m.Fields[k] = v
+				}
+			}
+		}
+	}
+
+	var ids []string
+	for id := range merged {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	result := make([]VectorLayer, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, *merged[id])
+	}
+	return result
+}
+
+// VectorLayersFor reads a tile in the format registered for the extension and returns a description of the layers and fields in it. The tile should contain all layers, as would be returned from the origin for the "all" layer.
+func VectorLayersFor(format string, rd io.Reader) ([]VectorLayer, error) {
+	f, ok := FormatFor(format)
+	if !ok || f.VectorLayers == nil {
+		return nil, fmt.Errorf("Unable to read vector layers from format %#v", format)
+	}
+	return f.VectorLayers(rd)
+}
+
+// jsonFieldType returns the TileJSON field type for a JSON property value, or false if the value is null or not a simple type.
+func jsonFieldType(v interface{}) (string, bool) {
+	switch v.(type) {
+	case string:
+		return FieldString, true
+	case float64:
+		return FieldNumber, true
+	case bool:
+		return FieldBoolean, true
+	}
+	return "", false
+}
+
+type propertiesOnly struct {
+	Properties map[string]interface{} `json:"properties"`
+}
+
+func addJSONFields(fields map[string]string, props map[string]interface{}) {
+	for k, v := range props {
+		if typ, ok := jsonFieldType(v); ok {
+			if _, exists := fields[k]; !exists {
+				fields[k] = typ
+			}
+		}
+	}
+}
+
+func geoJSONVectorLayers(rd io.Reader) ([]VectorLayer, error) {
+	var layers map[string]struct {
+		Features []propertiesOnly `json:"features"`
+	}
+
+	err := json.NewDecoder(rd).Decode(&layers)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []VectorLayer
+	for name, fc := range layers {
+		l := VectorLayer{ID: name, Fields: make(map[string]string)}
+		for _, f := range fc.Features {
+			addJSONFields(l.Fields, f.Properties)
+		}
+		result = append(result, l)
+	}
+
+	return MergeVectorLayers(result, nil), nil
+}
+
+func topoJSONVectorLayers(rd io.Reader) ([]VectorLayer, error) {
+	var t struct {
+		Objects map[string]struct {
+			Geometries []propertiesOnly `json:"geometries"`
+		} `json:"objects"`
+	}
+
+	err := json.NewDecoder(rd).Decode(&t)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []VectorLayer
+	for name, obj := range t.Objects {
+		l := VectorLayer{ID: name, Fields: make(map[string]string)}
+		for _, g := range obj.Geometries {
+			addJSONFields(l.Fields, g.Properties)
+		}
+		result = append(result, l)
+	}
+
+	return MergeVectorLayers(result, nil), nil
+}
+
+// mvtFieldType returns the TileJSON field type for an MVT value.
+func mvtFieldType(v *mapnik_vector.TileValue) string {
+	if v.StringValue != nil {
+		return FieldString
+	} else if v.BoolValue != nil {
+		return FieldBoolean
+	}
+	return FieldNumber
+}
+
+func mvtVectorLayers(rd io.Reader) ([]VectorLayer, error) {
+	buf, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &mapnik_vector.Tile{}
+	err = proto.Unmarshal(buf, t)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []VectorLayer
+	for _, layer := range t.GetLayers() {
+		l := VectorLayer{ID: layer.GetName(), Fields: make(map[string]string)}
+		keys := layer.GetKeys()
+		values := layer.GetValues()
+
+		for _, f := range layer.GetFeatures() {
+			tags := f.GetTags()
+			for i := 0; i+1 < len(tags); i += 2 {
+				k, v := int(tags[i]), int(tags[i+1])
+				if k >= len(keys) || v >= len(values) {
+					return nil, fmt.Errorf("Feature tag (%d, %d) out of range in layer %#v", k, v, layer.GetName())
+				}
+				if _, exists := l.Fields[keys[k]]; !exists {
+					l.Fields[keys[k]] = mvtFieldType(values[v])
+				}
+			}
+		}
+		result = append(result, l)
+	}
+
+	return MergeVectorLayers(result, nil), nil
+}
@@ -0,0 +1,74 @@
+package xonacatl
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func assertVectorLayers(format string, input []byte, expected []VectorLayer, t *testing.T) {
+	out, err := VectorLayersFor(format, bytes.NewReader(input))
+	if err != nil {
+		t.Fatalf("VectorLayersFor(%#v) failed, error: %s", format, err.Error())
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("Expected VectorLayersFor(%#v) to be %#v, but instead was %#v", format, expected, out)
+	}
+}
+
+func TestVectorLayersMVT(t *testing.T) {
+	// has a water layer with a single feature.
+	mvt := []byte{26, 73, 10, 5, 119, 97, 116, 101, 114, 18, 26, 8, 1, 18, 6, 0, 0, 1, 1, 2, 2, 24, 3, 34, 12, 9, 0, 128, 64, 26, 0, 1, 2, 0, 0, 2, 15, 26, 3, 102, 111, 111, 26, 3, 98, 97, 122, 26, 3, 117, 105, 100, 34, 5, 10, 3, 98, 97, 114, 34, 5, 10, 3, 102, 111, 111, 34, 2, 32, 123, 40, 128, 32, 120, 2}
+	expected := []VectorLayer{
+		{ID: "water", Fields: map[string]string{"foo": "String", "baz": "String", "uid": "Number"}},
+	}
+	assertVectorLayers("mvt", mvt, expected, t)
+}
+
+func TestVectorLayersGeoJSON(t *testing.T) {
+	json := `{"water":{"type":"FeatureCollection","features":[{"type":"Feature","properties":{"kind":"ocean","area":1.5}}]},"roads":{"type":"FeatureCollection","features":[{"type":"Feature","properties":{"oneway":true,"ref":null}}]}}`
+	expected := []VectorLayer{
+		{ID: "roads", Fields: map[string]string{"oneway": "Boolean"}},
+		{ID: "water", Fields: map[string]string{"kind": "String", "area": "Number"}},
+	}
+	assertVectorLayers("json", []byte(json), expected, t)
+}
+
+func TestVectorLayersTopoJSON(t *testing.T) {
+	json := `{"type":"Topology","objects":{"water":{"type":"GeometryCollection","geometries":[{"type":"Polygon","properties":{"kind":"lake"}}]}},"arcs":[]}`
+	expected := []VectorLayer{
+		{ID: "water", Fields: map[string]string{"kind": "String"}},
+	}
+	assertVectorLayers("topojson", []byte(json), expected, t)
+}
+
+func TestTileJSONSubset(t *testing.T) {
+	tj := &TileJSON{
+		TileJSON: TileJSONVersion,
+		VectorLayers: []VectorLayer{
+			{ID: "roads", Fields: map[string]string{}},
+			{ID: "water", Fields: map[string]string{}},
+		},
+	}
+
+	subset := tj.Subset(map[string]bool{"water": true})
+	if len(subset.VectorLayers) != 1 || subset.VectorLayers[0].ID != "water" {
+		t.Fatalf("Expected subset to contain only water layer, but was %#v", subset.VectorLayers)
+	}
+	if len(tj.VectorLayers) != 2 {
+		t.Fatalf("Expected Subset not to modify original, but was %#v", tj.VectorLayers)
+	}
+
+	all := tj.Subset(map[string]bool{"all": true})
+	if len(all.VectorLayers) != 2 {
+		t.Fatalf("Expected subset of all to contain both layers, but was %#v", all.VectorLayers)
+	}
+}
+
+func TestVectorLayersUnknownFormat(t *testing.T) {
+	_, err := VectorLayersFor("png", strings.NewReader(""))
+	if err == nil {
+		t.Fatalf("Expected VectorLayersFor to fail for unknown format, but it succeeded.")
+	}
+}
@@ -1,6 +1,7 @@
 package xonacatl
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 )
@@ -26,26 +27,272 @@ type topoJSON struct {
 }
 
 type topoJSONCopier struct {
-	layers map[string]bool
+	layers  map[string]bool
+	options *CopyOptions
+}
+
+func init() {
+	// TopoJSON geometries are made of arcs which may be shared, so they aren't transformed.
+	RegisterFormat(&Format{
+		Extension:   "topojson",
+		ContentType: "application/json",
+		NewCopier: func(layers map[string]bool, options *CopyOptions) LayerCopier {
+			return NewCopyTopoJSONLayersWithOptions(layers, options)
+		},
+		VectorLayers: topoJSONVectorLayers,
+	})
 }
 
 func NewCopyTopoJSONLayers(layers map[string]bool) *topoJSONCopier {
-	return &topoJSONCopier{layers: layers}
+	return NewCopyTopoJSONLayersWithOptions(layers, nil)
+}
+
+func NewCopyTopoJSONLayersWithOptions(layers map[string]bool, options *CopyOptions) *topoJSONCopier {
+	return &topoJSONCopier{layers: layers, options: options}
+}
+
+// topoJSONGeometry is the part of a TopoJSON geometry needed to make a Feature for filtering, or to find its bounds.
+type topoJSONGeometry struct {
+	Type        string                 `json:"type"`
+	Id          interface{}            `json:"id"`
+	Properties  map[string]interface{} `json:"properties"`
+	Arcs        interface{}            `json:"arcs"`
+	Coordinates interface{}            `json:"coordinates"`
+}
+
+// topoJSONTransform is the transform from quantized positions to longitude and latitude.
+type topoJSONTransform struct {
+	Scale     [2]float64 `json:"scale"`
+	Translate [2]float64 `json:"translate"`
+}
+
+// topoJSONPositions holds the decoded positions of a topology's arcs, for finding the bounds of its geometries.
+type topoJSONPositions struct {
+	transform *topoJSONTransform
+	arcs      [][]Point
+}
+
+func newTopoJSONPositions(t *topoJSON) (*topoJSONPositions, error) {
+	p := &topoJSONPositions{}
+
+	if t.Transform != nil {
+		p.transform = &topoJSONTransform{}
+		err := json.Unmarshal(*t.Transform, p.transform)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if t.Arcs == nil {
+		return p, nil
+	}
+
+	var arcs [][][]float64
+	err := json.Unmarshal(*t.Arcs, &arcs)
+	if err != nil {
+		return nil, err
+	}
+
+	p.arcs = make([][]Point, len(arcs))
+	for i, arc := range arcs {
+		// quantized arcs are delta-encoded, each position relative to the previous one.
+		var x, y float64
+		for _, pos := range arc {
+			if len(pos) < 2 {
+				continue
+			}
+			if p.transform != nil {
+				x, y = x+pos[0], y+pos[1]
+			} else {
+				x, y = pos[0], pos[1]
+			}
+			p.arcs[i] = append(p.arcs[i], p.point(x, y))
+		}
+	}
+
+	return p, nil
+}
+
+// point returns the longitude and latitude of the position, which is quantized if the topology has a transform.
+func (p *topoJSONPositions) point(x, y float64) Point {
+	if p.transform == nil {
+		return Point{x, y}
+	}
+	return Point{
+		x*p.transform.Scale[0] + p.transform.Translate[0],
+		y*p.transform.Scale[1] + p.transform.Translate[1],
+	}
+}
+
+// geometry returns a geometry with all the positions of the TopoJSON geometry as points, which is enough to find its bounds.
+func (p *topoJSONPositions) geometry(g *topoJSONGeometry) *Geometry {
+	result := &Geometry{Type: "MultiPoint"}
+
+	var walk_arcs func(v interface{})
+	walk_arcs = func(v interface{}) {
+		switch v := v.(type) {
+		case float64:
+			i := int(v)
+			if i < 0 {
+				// negative indices refer to arcs in reverse, with ~i being the index.
+				i = ^i
+			}
+			if i < len(p.arcs) {
+				result.Points = append(result.Points, p.arcs[i]...)
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk_arcs(e)
+			}
+		}
+	}
+
+	var walk_coordinates func(v interface{})
+	walk_coordinates = func(v interface{}) {
+		coords, ok := v.([]interface{})
+		if !ok {
+			return
+		}
+		if len(coords) >= 2 {
+			x, x_ok := coords[0].(float64)
+			y, y_ok := coords[1].(float64)
+			if x_ok && y_ok {
+				result.Points = append(result.Points, p.point(x, y))
+				return
+			}
+		}
+		for _, e := range coords {
+			walk_coordinates(e)
+		}
+	}
+
+	walk_arcs(g.Arcs)
+	walk_coordinates(g.Coordinates)
+	return result
+}
+
+// processObject applies any feature-level options to the geometries of the object. The positions are only needed when clipping or masking.
+func (c *topoJSONCopier) processObject(ctx context.Context, name string, obj *topoObject, positions *topoJSONPositions) error {
+	types := c.options.geometryTypesFor(name)
+	filter := c.options.filterFor(name)
+
+	var clip *Clip
+	var mask *maskView
+	if positions != nil {
+		clip = c.options.Clip
+		if c.options.Masks != nil && c.options.Masks.layerRelation(name) == maskBoundary {
+			mask = &maskView{mask: c.options.Masks.Layers[name], proj: lonLatProjection{}}
+		}
+	}
+
+	if types == nil && filter == nil && clip == nil && mask == nil {
+		return nil
+	}
+
+	data, err := mapJSONArray(obj.data, "geometries", func(raw json.RawMessage) (json.RawMessage, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var g topoJSONGeometry
+		err := json.Unmarshal(raw, &g)
+		if err != nil {
+			return nil, err
+		}
+
+		if types != nil && !types[g.Type] {
+			return nil, nil
+		}
+
+		if clip != nil || mask != nil {
+			points := positions.geometry(&g)
+			// geometries without any positions, such as nested GeometryCollections, can't be shown to be outside the clip, so are kept. but they can't be shown to be inside the mask either, so are dropped.
+			if points.isEmpty() {
+				if mask != nil {
+					return nil, nil
+				}
+			} else {
+				bounds := points.Bounds()
+				if clip != nil && !bounds.Intersects(clip.Box) {
+					return nil, nil
+				}
+				// a geometry crossing the mask can't be clipped, so it's dropped rather than serving the part outside.
+				if mask != nil && mask.relation(bounds) != maskInside {
+					return nil, nil
+				}
+			}
+		}
+
+		if filter != nil {
+			feature := Feature{
+				Layer:        name,
+				GeometryType: baseGeometryType(g.Type),
+				Id:           g.Id,
+				Properties:   g.Properties,
+			}
+			if !filter.KeepFeature(&feature) {
+				return nil, nil
+			}
+		}
+		return raw, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	obj.data = data
+	return nil
 }
 
 func (c *topoJSONCopier) CopyLayers(rd io.Reader, wr io.Writer) error {
+	return c.CopyLayersContext(context.Background(), rd, wr)
+}
+
+func (c *topoJSONCopier) CopyLayersContext(ctx context.Context, rd io.Reader, wr io.Writer) error {
+	return c.copyLayers(ctx, rd, wr, nil)
+}
+
+func (c *topoJSONCopier) CopyLayersStats(ctx context.Context, rd io.Reader, wr io.Writer) (*CopyStats, error) {
+	return copyWithStats(ctx, rd, wr, c.copyLayers)
+}
+
+// copyLayers copies the layers, collecting statistics if stats is not nil.
+func (c *topoJSONCopier) copyLayers(ctx context.Context, rd io.Reader, wr io.Writer, stats *CopyStats) error {
 	var t topoJSON
 
-	dec := json.NewDecoder(rd)
+	dec := json.NewDecoder(&contextReader{ctx: ctx, rd: rd})
 
 	err := dec.Decode(&t)
 	if err != nil {
 		return err
 	}
 
-	for k := range t.Objects {
-		if !c.layers[k] {
+	var positions *topoJSONPositions
+	if c.options != nil && (c.options.Clip != nil || c.options.Masks != nil) {
+		positions, err = newTopoJSONPositions(&t)
+		if err != nil {
+			return err
+		}
+	}
+
+	for k, obj := range t.Objects {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		stats.seeLayer(k, len(obj.data))
+
+		if !KeepLayer(c.layers, k) || c.options.dropLayer(k) {
 			delete(t.Objects, k)
+			continue
+		}
+
+		err = c.processObject(ctx, k, obj, positions)
+		if err != nil {
+			return err
+		}
+		if stats != nil {
+			stats.keepLayer(k, countJSONArray(obj.data, "geometries"))
 		}
 	}
 
@@ -61,3 +61,45 @@ func TestTopoJSONNonEmptyWithSingleLayer(t *testing.T) {
 func TestTopoJSONNonEmptyWithLayers(t *testing.T) {
 	runCopyTopoJSONAssertOutput(foobar, map[string]bool{"foo": true, "bar": true}, foobar, t)
 }
+
+func TestTopoJSONFilterFeatures(t *testing.T) {
+	input := `{"type":"Topology","objects":{"foo":{"type":"GeometryCollection","geometries":[{"type":"Point","properties":{"kind":"a"}},{"type":"Point","properties":{"kind":"b"}}]}},"arcs":[]}`
+	expected := `{"type":"Topology","objects":{"foo":{"geometries":[{"type":"Point","properties":{"kind":"b"}}],"type":"GeometryCollection"}},"arcs":[]}`
+	options := &CopyOptions{
+		Filters: map[string]FeatureFilter{
+			"foo": FeatureFilterFunc(func(f *Feature) bool { return f.Properties["kind"] == "b" }),
+		},
+	}
+
+	var buf bytes.Buffer
+	copier := NewCopyTopoJSONLayersWithOptions(map[string]bool{"foo": true}, options)
+	err := copier.CopyLayers(strings.NewReader(input), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+
+	out := strings.TrimSpace(buf.String())
+	if out != expected {
+		t.Fatalf("Expected filtered output to be %#v, but was %#v", expected, out)
+	}
+}
+
+func TestTopoJSONGeometryTypes(t *testing.T) {
+	input := `{"type":"Topology","objects":{"foo":{"type":"GeometryCollection","geometries":[{"type":"Point"},{"type":"MultiPolygon","arcs":[]},{"type":"Polygon","arcs":[]}]}},"arcs":[]}`
+	expected := `{"type":"Topology","objects":{"foo":{"geometries":[{"type":"MultiPolygon","arcs":[]}],"type":"GeometryCollection"}},"arcs":[]}`
+	options := &CopyOptions{
+		GeometryTypes: map[string]GeometryTypes{"all": {"MultiPolygon": true}},
+	}
+
+	var buf bytes.Buffer
+	copier := NewCopyTopoJSONLayersWithOptions(map[string]bool{"foo": true}, options)
+	err := copier.CopyLayers(strings.NewReader(input), &buf)
+	if err != nil {
+		t.Fatalf("CopyLayers failed, error: %s", err.Error())
+	}
+
+	out := strings.TrimSpace(buf.String())
+	if out != expected {
+		t.Fatalf("Expected output restricted to multipolygons to be %#v, but was %#v", expected, out)
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tilezen/xonacatl"
+	"github.com/tilezen/xonacatl/handler"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// serverConfig is the whole configuration of the server, as read from a config file or built from the command line flags.
+//
+// Headers and NoForward apply to all patterns, and each pattern can add its own. Nested values have the same JSON form as the equivalent command line flags.
+type serverConfig struct {
+	Listen            string                     `json:"listen"`
+	Healthcheck       string                     `json:"healthcheck"`
+	DebugHost         string                     `json:"debug_host"`
+	Headers           map[string]string          `json:"headers"`
+	NoForward         []string                   `json:"noforward"`
+	Layers            []string                   `json:"layers"`
+	CanonicalRedirect bool                       `json:"canonical_redirect"`
+	StatsMetrics      bool                       `json:"stats_metrics"`
+	StatsHeaders      bool                       `json:"stats_headers"`
+	Styles            stylesConfig               `json:"styles"`
+	Caches            cachesConfig               `json:"caches"`
+	Limits            limitsConfig               `json:"limits"`
+	Admin             adminConfig                `json:"admin"`
+	Shutdown          shutdownConfig             `json:"shutdown"`
+	TLS               tlsConfig                  `json:"tls"`
+	Compression       handler.CompressionOptions `json:"compression"`
+	Patterns          map[string]*patternConfig  `json:"patterns"`
+}
+
+// stylesConfig configures the styles which tile requests can refer to. Files are loaded at startup, keyed by style ID, and clients can POST styles to Path if it's set. At most MaxPosted POSTed styles are cached.
+type stylesConfig struct {
+	Files     map[string]string `json:"files"`
+	Path      string            `json:"path"`
+	MaxPosted int               `json:"max_posted"`
+}
+
+// cachesConfig configures what the server caches. TileJSONTTL is how long TileJSON descriptions are kept before they're fetched from the origin again, for patterns which don't set their own tilejson.cache_ttl, and an empty or zero TTL means they're kept until the configuration is reloaded. The other caches are configured where they're used, such as styles.max_posted and the api_keys of each pattern.
+type cachesConfig struct {
+	TileJSONTTL string `json:"tilejson_ttl"`
+}
+
+// limitsConfig limits the server's use of the origin, and what clients can make it do. OriginTimeout is a duration such as "30s", and an empty or zero timeout means requests to the origin never time out. ReadTimeout and WriteTimeout are durations for reading each request, including its body, and writing each response, and MaxHeaderBytes is the largest request header accepted, defaulting to net/http's 1MB. Those three apply to the listeners, so they can't be changed without a restart.
+type limitsConfig struct {
+	OriginTimeout  string `json:"origin_timeout"`
+	ReadTimeout    string `json:"read_timeout"`
+	WriteTimeout   string `json:"write_timeout"`
+	MaxHeaderBytes int    `json:"max_header_bytes"`
+}
+
+// server returns an http.Server listening on the address, with the limits on clients, which have already been validated.
+func (l *limitsConfig) server(addr string, h http.Handler) *http.Server {
+	read_timeout, _ := time.ParseDuration(l.ReadTimeout)
+	write_timeout, _ := time.ParseDuration(l.WriteTimeout)
+	return &http.Server{
+		Addr:           addr,
+		Handler:        h,
+		ReadTimeout:    read_timeout,
+		WriteTimeout:   write_timeout,
+		MaxHeaderBytes: l.MaxHeaderBytes,
+	}
+}
+
+// adminConfig configures the admin endpoint, which reloads the configuration when a POST request with the token as a bearer token is made to Path. There's no admin endpoint if Path is empty.
+type adminConfig struct {
+	Path  string `json:"path"`
+	Token string `json:"token"`
+}
+
+// shutdownConfig configures how the server stops when it gets a SIGTERM or SIGINT. For the DrainPeriod, the healthcheck fails but requests are still served, so that load balancers notice before the listener closes. Then the server waits up to Timeout for requests in progress to finish. Both are durations, such as "10s".
+type shutdownConfig struct {
+	DrainPeriod string `json:"drain_period"`
+	Timeout     string `json:"timeout"`
+}
+
+// drainPeriod returns the drain period, which has already been validated.
+func (s *shutdownConfig) drainPeriod() time.Duration {
+	d, _ := time.ParseDuration(s.DrainPeriod)
+	return d
+}
+
+// timeout returns the shutdown timeout, which has already been validated, or zero for no timeout.
+func (s *shutdownConfig) timeout() time.Duration {
+	d, _ := time.ParseDuration(s.Timeout)
+	return d
+}
+
+// tlsConfig configures serving HTTPS. If Cert and Key are set, then the server listens for HTTPS instead of plain HTTP, using the certificates in SNI for the server names they're keyed by, which may be wildcards such as "*.example.com". Certificate files are reloaded when they change. If RedirectListen is set, then a plain HTTP listener there redirects requests to HTTPS.
+type tlsConfig struct {
+	Cert           string              `json:"cert"`
+	Key            string              `json:"key"`
+	SNI            map[string]certPair `json:"sni"`
+	RedirectListen string              `json:"redirect_listen"`
+}
+
+// certPair is the files for a certificate and its private key.
+type certPair struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+func (t *tlsConfig) enabled() bool {
+	return len(t.Cert) > 0 || len(t.Key) > 0
+}
+
+// patternConfig configures the requests matching a single route pattern.
+type patternConfig struct {
+	Origin    string                    `json:"origin"`
+	Headers   map[string]string         `json:"headers"`
+	NoForward []string                  `json:"noforward"`
+	ZoomRules xonacatl.ZoomRules        `json:"zoom_rules"`
+	Overzoom  *handler.OverzoomOptions  `json:"overzoom"`
+	Precision string                    `json:"precision"`
+	Masks     map[string]string         `json:"masks"`
+	TileJSON  *handler.TileJSONOptions  `json:"tilejson"`
+	OriginTLS *originTLSConfig          `json:"origin_tls"`
+	CORS      *handler.CORSPolicy       `json:"cors"`
+	RateLimit *handler.RateLimitOptions `json:"rate_limit"`
+	APIKeys   *handler.APIKeyOptions    `json:"api_keys"`
+}
+
+// originTLSConfig configures TLS for requests to an origin. CA is a PEM bundle of the certificates to trust, instead of the system's. Cert and Key are a client certificate, for origins which require one, and are reloaded when they change. ServerName overrides the name the origin's certificate is verified against, and MinVersion is the minimum TLS version, such as "1.2".
+type originTLSConfig struct {
+	CA         string `json:"ca"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ServerName string `json:"server_name"`
+	MinVersion string `json:"min_version"`
+}
+
+func defaultConfig() *serverConfig {
+	return &serverConfig{
+		Listen:   ":8080",
+		Styles:   stylesConfig{MaxPosted: 1000},
+		Shutdown: shutdownConfig{Timeout: "30s"},
+		Patterns: make(map[string]*patternConfig),
+	}
+}
+
+// configError collects the problems found in a configuration, each prefixed with the key it was found at.
+type configError struct {
+	problems []string
+}
+
+func (e *configError) add(key, format string, args ...interface{}) {
+	e.problems = append(e.problems, key+": "+fmt.Sprintf(format, args...))
+}
+
+func (e *configError) Error() string {
+	return strings.Join(e.problems, "\n")
+}
+
+// err returns the configError, or nil if there weren't any problems.
+func (e *configError) err() error {
+	if len(e.problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// mapKey returns the key for an entry in the map at key, quoting the map key, as pattern keys are full of punctuation.
+func mapKey(key, k string) string {
+	return fmt.Sprintf("%s[%#v]", key, k)
+}
+
+func fieldKey(key, k string) string {
+	if len(key) == 0 {
+		return k
+	}
+	return key + "." + k
+}
+
+// loadConfig reads a YAML or JSON config file, and returns the configuration in it. Unknown keys and values of the wrong type are errors, and are reported with the key they were found at.
+func loadConfig(rd io.Reader) (*serverConfig, error) {
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config: %s", err.Error())
+	}
+
+	var doc interface{}
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse config: %s", err.Error())
+	}
+	if doc == nil {
+		doc = make(map[string]interface{})
+	}
+	doc = normaliseYAML(doc)
+
+	cfg := defaultConfig()
+	errs := &configError{}
+	checkConfigValue(errs, "", doc, reflect.TypeOf(cfg).Elem())
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+
+	// the document has been checked against the config types, so it can be decoded by way of JSON, which means the same tags work for the flags and the config file.
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to convert config: %s", err.Error())
+	}
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode config: %s", err.Error())
+	}
+
+	return cfg, nil
+}
+
+// normaliseYAML converts the maps decoded from YAML, which can have keys of any type, to maps with string keys, as in JSON.
+func normaliseYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normaliseYAML(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normaliseYAML(e)
+		}
+	}
+	return v
+}
+
+// checkConfigValue checks that the value decoded from the config file can be decoded into type t, adding any problems to errs.
+func checkConfigValue(errs *configError, key string, v interface{}, t reflect.Type) {
+	if v == nil {
+		return
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			errs.add(key, "expected an object, but got %s", describeValue(v))
+			return
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if len(name) > 0 && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		for _, k := range sortedKeys(m) {
+			field_type, ok := fields[k]
+			if !ok {
+				errs.add(fieldKey(key, k), "unknown key")
+				continue
+			}
+			checkConfigValue(errs, fieldKey(key, k), m[k], field_type)
+		}
+
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			errs.add(key, "expected an object, but got %s", describeValue(v))
+			return
+		}
+		for _, k := range sortedKeys(m) {
+			checkConfigValue(errs, mapKey(key, k), m[k], t.Elem())
+		}
+
+	case reflect.Slice:
+		l, ok := v.([]interface{})
+		if !ok {
+			errs.add(key, "expected a list, but got %s", describeValue(v))
+			return
+		}
+		for i, e := range l {
+			checkConfigValue(errs, fmt.Sprintf("%s[%d]", key, i), e, t.Elem())
+		}
+
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			errs.add(key, "expected a string, but got %s", describeValue(v))
+		}
+
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			errs.add(key, "expected true or false, but got %s", describeValue(v))
+		}
+
+	case reflect.Int, reflect.Int64:
+		if f, ok := configNumber(v); !ok || f != float64(int64(f)) {
+			errs.add(key, "expected an integer, but got %s", describeValue(v))
+		}
+
+	case reflect.Float64:
+		if _, ok := configNumber(v); !ok {
+			errs.add(key, "expected a number, but got %s", describeValue(v))
+		}
+	}
+}
+
+func configNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// describeValue describes a value from the config file for error messages.
+func describeValue(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "a list"
+	}
+	return fmt.Sprintf("%#v", v)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validate checks the values in the configuration, returning an error describing every problem found, with the key it was found at. Files, such as masks and styles, and options which the handler checks itself, such as precision, are checked when the router is built.
+func (c *serverConfig) validate() error {
+	errs := &configError{}
+
+	if len(c.Listen) == 0 {
+		errs.add("listen", "must be an interface and port to listen on, such as \":8080\"")
+	}
+
+	for i, re := range c.NoForward {
+		if _, err := regexp.Compile(re); err != nil {
+			errs.add(fmt.Sprintf("noforward[%d]", i), "unable to compile regexp: %s", err.Error())
+		}
+	}
+
+	if c.Styles.MaxPosted < 0 {
+		errs.add("styles.max_posted", "must not be negative")
+	}
+
+	checkDuration(errs, "caches.tilejson_ttl", c.Caches.TileJSONTTL)
+
+	checkDuration(errs, "limits.origin_timeout", c.Limits.OriginTimeout)
+	checkDuration(errs, "limits.read_timeout", c.Limits.ReadTimeout)
+	checkDuration(errs, "limits.write_timeout", c.Limits.WriteTimeout)
+	if c.Limits.MaxHeaderBytes < 0 {
+		errs.add("limits.max_header_bytes", "must not be negative")
+	}
+
+	checkDuration(errs, "shutdown.drain_period", c.Shutdown.DrainPeriod)
+	checkDuration(errs, "shutdown.timeout", c.Shutdown.Timeout)
+
+	if c.TLS.enabled() || len(c.TLS.SNI) > 0 || len(c.TLS.RedirectListen) > 0 {
+		if len(c.TLS.Cert) == 0 {
+			errs.add("tls.cert", "must be set to serve HTTPS")
+		}
+		if len(c.TLS.Key) == 0 {
+			errs.add("tls.key", "must be set to serve HTTPS")
+		}
+	}
+	for name, pair := range c.TLS.SNI {
+		if len(pair.Cert) == 0 || len(pair.Key) == 0 {
+			errs.add(mapKey("tls.sni", name), "must have both a cert and a key")
+		}
+	}
+
+	if _, err := handler.NewCompressHandler(nil, &c.Compression); err != nil {
+		errs.add("compression", "%s", err.Error())
+	}
+
+	if len(c.Admin.Path) > 0 && len(c.Admin.Token) == 0 {
+		errs.add("admin.token", "must be set to use the admin endpoint")
+	}
+
+	if len(c.Patterns) == 0 {
+		errs.add("patterns", "must have at least one pattern to proxy")
+	}
+
+	patterns := make([]string, 0, len(c.Patterns))
+	for pattern := range c.Patterns {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	for _, pattern := range patterns {
+		c.Patterns[pattern].validate(errs, mapKey("patterns", pattern))
+	}
+
+	return errs.err()
+}
+
+// checkDuration checks that a value is empty or a non-negative duration.
+func checkDuration(errs *configError, key, value string) {
+	if len(value) > 0 {
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			errs.add(key, "expected a duration, such as \"30s\", but got %#v", value)
+		}
+	}
+}
+
+func (p *patternConfig) validate(errs *configError, key string) {
+	if p == nil {
+		errs.add(key, "expected an object with an origin")
+		return
+	}
+
+	if len(p.Origin) == 0 {
+		errs.add(fieldKey(key, "origin"), "must be the URL pattern of the origin")
+	} else if u, err := url.Parse(p.Origin); err != nil {
+		errs.add(fieldKey(key, "origin"), "unable to parse URL: %s", err.Error())
+	} else if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		errs.add(fieldKey(key, "origin"), "expected an absolute URL, but got %#v", p.Origin)
+	}
+
+	for i, re := range p.NoForward {
+		if _, err := regexp.Compile(re); err != nil {
+			errs.add(fmt.Sprintf("%s[%d]", fieldKey(key, "noforward"), i), "unable to compile regexp: %s", err.Error())
+		}
+	}
+
+	if p.Overzoom != nil && p.Overzoom.MaxZoom < 0 {
+		errs.add(fieldKey(key, "overzoom.maxzoom"), "must not be negative")
+	} else if p.Overzoom != nil && p.Overzoom.MaxZoom > xonacatl.MaxZoom {
+		errs.add(fieldKey(key, "overzoom.maxzoom"), "must not be greater than %d", xonacatl.MaxZoom)
+	}
+
+	if t := p.OriginTLS; t != nil {
+		if (len(t.Cert) == 0) != (len(t.Key) == 0) {
+			errs.add(fieldKey(key, "origin_tls"), "must have both a cert and a key, or neither")
+		}
+		if _, ok := tlsVersions[t.MinVersion]; !ok && len(t.MinVersion) > 0 {
+			errs.add(fieldKey(key, "origin_tls.min_version"), "expected one of \"1.0\", \"1.1\", \"1.2\" or \"1.3\", but got %#v", t.MinVersion)
+		}
+	}
+
+	if c := p.CORS; c != nil {
+		if len(c.AllowedOrigins) == 0 {
+			errs.add(fieldKey(key, "cors.allowed_origins"), "must have at least one origin, or \"*\" for any")
+		}
+		for i, o := range c.AllowedOrigins {
+			if strings.Count(o, "*") > 1 {
+				errs.add(fmt.Sprintf("%s[%d]", fieldKey(key, "cors.allowed_origins"), i), "expected at most one \"*\" wildcard, but got %#v", o)
+			}
+		}
+		if c.MaxAge < 0 {
+			errs.add(fieldKey(key, "cors.max_age"), "must not be negative")
+		}
+	}
+
+	if p.RateLimit != nil {
+		if _, err := handler.NewRateLimiter(p.RateLimit); err != nil {
+			errs.add(fieldKey(key, "rate_limit"), "%s", err.Error())
+		}
+	}
+
+	if k := p.APIKeys; k != nil {
+		if len(k.File) == 0 && len(k.AuthURL) == 0 {
+			errs.add(fieldKey(key, "api_keys"), "must have a file or an auth_url to check keys with")
+		}
+		if u, err := url.Parse(k.AuthURL); len(k.AuthURL) > 0 && (err != nil || len(u.Scheme) == 0 || len(u.Host) == 0) {
+			errs.add(fieldKey(key, "api_keys.auth_url"), "expected an absolute URL, but got %#v", k.AuthURL)
+		}
+		checkDuration(errs, fieldKey(key, "api_keys.cache_ttl"), k.CacheTTL)
+		checkDuration(errs, fieldKey(key, "api_keys.negative_cache_ttl"), k.NegativeCacheTTL)
+		if k.CacheSize < 0 {
+			errs.add(fieldKey(key, "api_keys.cache_size"), "must not be negative")
+		}
+	}
+
+	if p.TileJSON != nil {
+		checkDuration(errs, fieldKey(key, "tilejson.cache_ttl"), p.TileJSON.CacheTTL)
+	}
+	if p.TileJSON != nil && len(p.TileJSON.Path) == 0 {
+		errs.add(fieldKey(key, "tilejson.path"), "must be the route pattern for the TileJSON endpoint")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"github.com/tilezen/xonacatl/handler"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+listen: ":8000"
+healthcheck: /health
+headers:
+  X-Api-Key: secret
+noforward: ["(?i)X-Mz-.*"]
+styles:
+  path: /styles
+  max_posted: 10
+caches:
+  tilejson_ttl: 1h
+limits:
+  origin_timeout: 5s
+  read_timeout: 10s
+  max_header_bytes: 16384
+compression:
+  encodings: [zstd, gzip]
+  levels: {gzip: 4}
+  min_size: 512
+patterns:
+  "/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}":
+    origin: "https://tile.example.com/{layers}/{z}/{x}/{y}.{fmt}"
+    headers:
+      X-Origin: xonacatl
+    zoom_rules:
+      buildings: {minzoom: 13}
+    overzoom: {maxzoom: 16, buffer: 8}
+    precision: auto
+    rate_limit: {rate: 10, burst: 20, key: "query:api_key"}
+`
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadConfig(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatalf("Unable to load config: %s", err.Error())
+	}
+	if err = cfg.validate(); err != nil {
+		t.Fatalf("Expected config to be valid, but got: %s", err.Error())
+	}
+
+	if cfg.Listen != ":8000" || cfg.Styles.MaxPosted != 10 || cfg.Caches.TileJSONTTL != "1h" || cfg.Limits.OriginTimeout != "5s" || cfg.Limits.ReadTimeout != "10s" || cfg.Limits.MaxHeaderBytes != 16384 || cfg.Compression.MinSize != 512 || cfg.Compression.Levels["gzip"] != 4 {
+		t.Fatalf("Unexpected top level config: %#v", cfg)
+	}
+	p := cfg.Patterns["/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}"]
+	if p == nil {
+		t.Fatalf("Expected pattern in config, but got %#v", cfg.Patterns)
+	}
+	if p.RateLimit == nil || p.RateLimit.Rate != 10 || p.RateLimit.Burst != 20 || p.RateLimit.Key != "query:api_key" {
+		t.Fatalf("Unexpected rate limit config: %#v", p.RateLimit)
+	}
+	if *p.ZoomRules["buildings"].MinZoom != 13 || p.Overzoom.MaxZoom != 16 || p.Overzoom.Buffer != 8 || p.Precision != "auto" {
+		t.Fatalf("Unexpected pattern config: %#v", p)
+	}
+	if !reflect.DeepEqual(p.Headers, map[string]string{"X-Origin": "xonacatl"}) {
+		t.Fatalf("Unexpected pattern headers: %#v", p.Headers)
+	}
+}
+
+func TestLoadJSONConfig(t *testing.T) {
+	cfg, err := loadConfig(strings.NewReader(`{"patterns":{"/{layers}/{z}/{x}/{y}.{fmt}":{"origin":"http://localhost/{layers}/{z}/{x}/{y}.{fmt}"}}}`))
+	if err != nil {
+		t.Fatalf("Unable to load config: %s", err.Error())
+	}
+	if cfg.Listen != ":8080" || len(cfg.Patterns) != 1 {
+		t.Fatalf("Unexpected config: %#v", cfg)
+	}
+}
+
+func assertConfigProblems(t *testing.T, err error, expected []string) {
+	if err == nil {
+		t.Fatalf("Expected config problems %#v, but config was OK", expected)
+	}
+	problems := strings.Split(err.Error(), "\n")
+	if !reflect.DeepEqual(problems, expected) {
+		t.Fatalf("Expected config problems %#v, but got %#v", expected, problems)
+	}
+}
+
+func TestLoadConfigStrict(t *testing.T) {
+	_, err := loadConfig(strings.NewReader(`
+listen: 8080
+lissen: ":8080"
+patterns:
+  "/{z}/{x}/{y}.json":
+    orign: "http://localhost/"
+    overzoom: {maxzoom: "16"}
+    noforward: x-mz
+`))
+	assertConfigProblems(t, err, []string{
+		`lissen: unknown key`,
+		`listen: expected a string, but got 8080`,
+		`patterns["/{z}/{x}/{y}.json"].noforward: expected a list, but got "x-mz"`,
+		`patterns["/{z}/{x}/{y}.json"].orign: unknown key`,
+		`patterns["/{z}/{x}/{y}.json"].overzoom.maxzoom: expected an integer, but got "16"`,
+	})
+}
+
+func TestValidateConfig(t *testing.T) {
+	cfg, err := loadConfig(strings.NewReader(`
+noforward: ["("]
+caches: {tilejson_ttl: soon}
+limits: {origin_timeout: soon, max_header_bytes: -1}
+compression: {levels: {br: 12}}
+patterns:
+  "/a/{z}/{x}/{y}.json":
+    origin: "/{z}/{x}/{y}.json"
+    overzoom: {maxzoom: 31}
+  "/b/{z}/{x}/{y}.json":
+    origin: "http://localhost/{layers}/{z}/{x}/{y}.{fmt}"
+    tilejson: {name: b, cache_ttl: -1h}
+  "/c/{z}/{x}/{y}.json":
+    origin: "http://localhost/{z}/{x}/{y}.json"
+    cors: {allowed_origins: ["https://*.*.example.com"], max_age: -1}
+  "/d/{z}/{x}/{y}.json":
+    origin: "http://localhost/{z}/{x}/{y}.json"
+    cors: {max_age: 600}
+    rate_limit: {rate: 10, key: cookie}
+    api_keys: {cache_ttl: soon}
+`))
+	if err != nil {
+		t.Fatalf("Unable to load config: %s", err.Error())
+	}
+
+	assertConfigProblems(t, cfg.validate(), []string{
+		"noforward[0]: unable to compile regexp: error parsing regexp: missing closing ): `(`",
+		`caches.tilejson_ttl: expected a duration, such as "30s", but got "soon"`,
+		`limits.origin_timeout: expected a duration, such as "30s", but got "soon"`,
+		`limits.max_header_bytes: must not be negative`,
+		`compression: Invalid compression level 12 for "br", expected 0-11`,
+		`patterns["/a/{z}/{x}/{y}.json"].origin: expected an absolute URL, but got "/{z}/{x}/{y}.json"`,
+		`patterns["/a/{z}/{x}/{y}.json"].overzoom.maxzoom: must not be greater than 30`,
+		`patterns["/b/{z}/{x}/{y}.json"].tilejson.cache_ttl: expected a duration, such as "30s", but got "-1h"`,
+		`patterns["/b/{z}/{x}/{y}.json"].tilejson.path: must be the route pattern for the TileJSON endpoint`,
+		`patterns["/c/{z}/{x}/{y}.json"].cors.allowed_origins[0]: expected at most one "*" wildcard, but got "https://*.*.example.com"`,
+		`patterns["/c/{z}/{x}/{y}.json"].cors.max_age: must not be negative`,
+		`patterns["/d/{z}/{x}/{y}.json"].cors.allowed_origins: must have at least one origin, or "*" for any`,
+		`patterns["/d/{z}/{x}/{y}.json"].rate_limit: Invalid rate limit key "cookie", expected "ip", "forwarded_for", "query:<name>" or "header:<name>"`,
+		`patterns["/d/{z}/{x}/{y}.json"].api_keys: must have a file or an auth_url to check keys with`,
+		`patterns["/d/{z}/{x}/{y}.json"].api_keys.cache_ttl: expected a duration, such as "30s", but got "soon"`,
+	})
+
+	assertConfigProblems(t, defaultConfig().validate(), []string{
+		`patterns: must have at least one pattern to proxy`,
+	})
+}
+
+func TestParseConfigFlags(t *testing.T) {
+	cfg, err := parseConfig([]string{
+		"-patterns", `{"/{layers}/{z}/{x}/{y}.{fmt}": "http://localhost/{layers}/{z}/{x}/{y}.{fmt}"}`,
+		"-headers", `{"x-api-key": "secret"}`,
+		"-precision", `{"/{layers}/{z}/{x}/{y}.{fmt}": "auto"}`,
+		"-layers", `["water", "roads"]`,
+		"-cors", `{"/{layers}/{z}/{x}/{y}.{fmt}": {"allowed_origins": ["*"]}}`,
+	})
+	if err != nil {
+		t.Fatalf("Unable to parse flags: %s", err.Error())
+	}
+
+	p := cfg.Patterns["/{layers}/{z}/{x}/{y}.{fmt}"]
+	if p == nil || p.Origin != "http://localhost/{layers}/{z}/{x}/{y}.{fmt}" || p.Precision != "auto" || p.CORS == nil {
+		t.Fatalf("Unexpected pattern config from flags: %#v", p)
+	}
+	if !reflect.DeepEqual(cfg.Headers, map[string]string{"X-Api-Key": "secret"}) {
+		t.Fatalf("Unexpected headers from flags: %#v", cfg.Headers)
+	}
+	if !reflect.DeepEqual(cfg.Layers, []string{"roads", "water"}) {
+		t.Fatalf("Unexpected layers from flags: %#v", cfg.Layers)
+	}
+
+	if _, err = parseConfig(nil); err == nil {
+		t.Fatalf("Expected flags without any patterns to be invalid")
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "xonacatl-config")
+	if err != nil {
+		t.Fatalf("Unable to create config file: %s", err.Error())
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(testConfig)
+	file.Close()
+
+	cfg, err := parseConfig([]string{"-yamlConfig", file.Name()})
+	if err != nil {
+		t.Fatalf("Unable to parse config file: %s", err.Error())
+	}
+	if cfg.Listen != ":8000" {
+		t.Fatalf("Expected listen from config file, but got %#v", cfg.Listen)
+	}
+
+	_, err = parseConfig([]string{"-yamlConfig", file.Name(), "-listen", ":9000"})
+	if err == nil || !strings.Contains(err.Error(), "-listen") {
+		t.Fatalf("Expected flags combined with a config file to be rejected, but got %v", err)
+	}
+}
+
+func TestNewRouter(t *testing.T) {
+	cfg, err := loadConfig(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatalf("Unable to load config: %s", err.Error())
+	}
+	r, err := newRouter(cfg)
+	if err != nil {
+		t.Fatalf("Unable to build router: %s", err.Error())
+	}
+
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest("GET", "/health", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected healthcheck to be OK, but got status %d", rw.Code)
+	}
+
+	p := cfg.Patterns["/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}"]
+	p.APIKeys = &handler.APIKeyOptions{File: "/does/not/exist.txt"}
+	_, err = newRouter(cfg)
+	if err == nil || !strings.HasPrefix(err.Error(), `patterns["/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}"].api_keys: `) {
+		t.Fatalf("Expected missing key file to be reported at its key, but got %v", err)
+	}
+	p.APIKeys = nil
+
+	p.Masks = map[string]string{"water": "/does/not/exist.json"}
+	_, err = newRouter(cfg)
+	if err == nil || !strings.HasPrefix(err.Error(), `patterns["/{layers}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}"].masks: `) {
+		t.Fatalf("Expected missing mask file to be reported at its key, but got %v", err)
+	}
+}
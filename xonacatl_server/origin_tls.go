@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// tlsVersions are the names of the TLS versions which can be the minimum for an origin.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// originTransport returns a transport for requests to an origin with its own TLS settings. Other than TLS, it has the same settings as http.DefaultTransport. Errors are prefixed with key, the key of the settings in the configuration.
+func originTransport(key string, cfg *originTLSConfig) (*http.Transport, error) {
+	tls_config := &tls.Config{
+		ServerName: cfg.ServerName,
+		MinVersion: tlsVersions[cfg.MinVersion],
+	}
+
+	if len(cfg.CA) > 0 {
+		pem_data, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("%s.ca: Unable to read CA bundle: %s", key, err.Error())
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem_data) {
+			return nil, fmt.Errorf("%s.ca: No PEM certificates found in %#v", key, cfg.CA)
+		}
+		tls_config.RootCAs = roots
+	}
+
+	if len(cfg.Cert) > 0 {
+		client_cert, err := loadCertFile(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%s.cert: %s", key, err.Error())
+		}
+		tls_config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return client_cert.get(), nil
+		}
+	}
+
+	// the same settings as http.DefaultTransport, which a custom TLSClientConfig would otherwise stop from using HTTP/2 unless asked to.
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tls_config,
+		ForceAttemptHTTP2:     true,
+	}, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOriginTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xonacatl-tls")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	server_cert, server_key := writeTestCert(t, dir, "origin.internal", 1)
+	client_cert, client_key := writeTestCert(t, dir, "xonacatl.internal", 2)
+
+	cert, err := tls.LoadX509KeyPair(server_cert, server_key)
+	if err != nil {
+		t.Fatalf("Unable to load server certificate: %s", err.Error())
+	}
+	client_pem, _ := ioutil.ReadFile(client_cert)
+	client_cas := x509.NewCertPool()
+	client_cas.AppendCertsFromPEM(client_pem)
+
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	origin.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    client_cas,
+	}
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+
+	// the origin is at 127.0.0.1, so its certificate is only valid with the server name override.
+	cfg := &originTLSConfig{CA: server_cert, Cert: client_cert, Key: client_key, ServerName: "origin.internal", MinVersion: "1.2"}
+	transport, err := originTransport("origin_tls", cfg)
+	if err != nil {
+		t.Fatalf("Unable to create origin transport: %s", err.Error())
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(origin.URL)
+	if err != nil {
+		t.Fatalf("Unable to make request to origin: %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "xonacatl.internal" {
+		t.Fatalf("Expected origin to see the client certificate, but got %#v", string(body))
+	}
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Expected the origin transport to use HTTP/2, but got %s", resp.Proto)
+	}
+
+	for _, bad := range []*originTLSConfig{
+		{CA: server_cert, ServerName: "origin.internal"},
+		{Cert: client_cert, Key: client_key, ServerName: "origin.internal"},
+		{CA: server_cert, Cert: client_cert, Key: client_key},
+	} {
+		transport, err = originTransport("origin_tls", bad)
+		if err != nil {
+			t.Fatalf("Unable to create origin transport: %s", err.Error())
+		}
+		if _, err = (&http.Client{Transport: transport}).Get(origin.URL); err == nil {
+			t.Fatalf("Expected request with TLS options %#v to fail", bad)
+		}
+	}
+
+	_, err = originTransport("origin_tls", &originTLSConfig{CA: client_key})
+	if err == nil || !strings.HasPrefix(err.Error(), "origin_tls.ca: ") {
+		t.Fatalf("Expected CA bundle without certificates to be reported at its key, but got %v", err)
+	}
+}
+
+func TestValidateOriginTLS(t *testing.T) {
+	cfg, err := loadConfig(strings.NewReader(`
+patterns:
+  "/{layers}/{z}/{x}/{y}.{fmt}":
+    origin: "https://origin.internal/{layers}/{z}/{x}/{y}.{fmt}"
+    origin_tls: {cert: client.crt, min_version: "1.4"}
+`))
+	if err != nil {
+		t.Fatalf("Unable to load config: %s", err.Error())
+	}
+
+	assertConfigProblems(t, cfg.validate(), []string{
+		`patterns["/{layers}/{z}/{x}/{y}.{fmt}"].origin_tls: must have both a cert and a key, or neither`,
+		`patterns["/{layers}/{z}/{x}/{y}.{fmt}"].origin_tls.min_version: expected one of "1.0", "1.1", "1.2" or "1.3", but got "1.4"`,
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/tilezen/xonacatl/handler"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	configReloads      = expvar.NewInt("configReloads")
+	configReloadErrors = expvar.NewInt("configReloadErrors")
+)
+
+// reloader serves requests with the router built from the most recent valid configuration, and can rebuild it from the same arguments, re-reading the environment and any config files.
+//
+// The router is swapped atomically, so requests already being served carry on with the router they started with. If the new configuration is invalid, then the current router stays in use. Styles POSTed by clients are kept by each router, so they're lost on reload, but rate limits carry on where they were unless they're changed. The listen address, TLS settings and limits on clients can't be changed without a restart.
+type reloader struct {
+	args      []string
+	listen    string
+	current   atomic.Value
+	in_flight int64
+
+	// mutex stops reloads from racing each other, so that the last one to finish is the last one to start. It also guards cfg, the configuration in use.
+	mutex sync.Mutex
+	cfg   *serverConfig
+}
+
+// routing is a router, the transports for the origins it proxies to, and the rate limiters for its patterns.
+type routing struct {
+	router     *mux.Router
+	transports []*http.Transport
+	limiters   map[string]*rateLimit
+}
+
+// rateLimit is a pattern's rate limiter, and the options it was made with, so that it can be kept on reload if they don't change.
+type rateLimit struct {
+	options handler.RateLimitOptions
+	limiter *handler.RateLimiter
+}
+
+// closeIdleConnections closes the idle connections to the origins, which are otherwise kept open for reuse.
+func (r *routing) closeIdleConnections() {
+	for _, t := range r.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// build returns the routing for a configuration, including the admin endpoint to reload it. The rate limiters of the routing in use are kept for patterns whose rate limits haven't changed.
+func (rl *reloader) build(cfg *serverConfig) (*routing, error) {
+	previous, _ := rl.current.Load().(*routing)
+	r, err := buildRouter(cfg, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Admin.Path) > 0 {
+		r.router.Handle(cfg.Admin.Path, &adminHandler{token: cfg.Admin.Token, reloader: rl}).Methods("POST")
+	}
+
+	return r, nil
+}
+
+// use starts serving requests with the routing. The idle connections of the previous routing's transports are closed, and the rest are closed by its handlers as they finish.
+func (rl *reloader) use(r *routing) {
+	old, _ := rl.current.Load().(*routing)
+	rl.current.Store(r)
+	if old != nil {
+		old.closeIdleConnections()
+	}
+}
+
+// routing returns the routing in use.
+func (rl *reloader) routing() *routing {
+	return rl.current.Load().(*routing)
+}
+
+// Reload reads the configuration again, and starts serving requests with it if it's valid. Otherwise, the error is returned and logged, and the current configuration stays in use.
+func (rl *reloader) Reload() error {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	cfg, err := parseConfig(rl.args)
+	var r *routing
+	if err == nil {
+		r, err = rl.build(cfg)
+	}
+	if err != nil {
+		configReloadErrors.Add(1)
+		log.Printf("ERROR: Unable to reload configuration, keeping the current one: %s", err.Error())
+		return err
+	}
+
+	if cfg.Listen != rl.listen {
+		log.Printf("WARNING: The listen address changed from %#v to %#v, which needs a restart to take effect.", rl.listen, cfg.Listen)
+	}
+	if rl.cfg != nil && (cfg.Limits.ReadTimeout != rl.cfg.Limits.ReadTimeout || cfg.Limits.WriteTimeout != rl.cfg.Limits.WriteTimeout || cfg.Limits.MaxHeaderBytes != rl.cfg.Limits.MaxHeaderBytes) {
+		log.Printf("WARNING: The limits on clients changed, which needs a restart to take effect.")
+	}
+	if rl.cfg != nil && !reflect.DeepEqual(cfg.TLS, rl.cfg.TLS) {
+		log.Printf("WARNING: The TLS settings changed, which needs a restart to take effect. Changes to the certificate files are picked up without one.")
+	}
+
+	rl.use(r)
+	rl.cfg = cfg
+	configReloads.Add(1)
+	log.Printf("Reloaded configuration.")
+	return nil
+}
+
+// watchSignals reloads the configuration whenever the process gets a SIGHUP.
+func (rl *reloader) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			rl.Reload()
+		}
+	}()
+}
+
+// config returns the configuration in use.
+func (rl *reloader) config() *serverConfig {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	return rl.cfg
+}
+
+func (rl *reloader) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&rl.in_flight, 1)
+	defer atomic.AddInt64(&rl.in_flight, -1)
+
+	rl.routing().router.ServeHTTP(rw, req)
+}
+
+// adminHandler reloads the configuration for requests with the admin token as a bearer token.
+type adminHandler struct {
+	token    string
+	reloader *reloader
+}
+
+func (a *adminHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.token)) != 1 {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(rw, "Invalid or missing admin token.", http.StatusUnauthorized)
+		return
+	}
+
+	err := a.reloader.Reload()
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Unable to reload configuration, keeping the current one: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(rw, "Reloaded configuration.")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// reloadConfig returns a config with the healthcheck at the given path, so that tests can tell which config is in use.
+func reloadConfig(healthcheck string) string {
+	return fmt.Sprintf(`
+healthcheck: %s
+admin: {path: /admin/reload, token: secret}
+patterns:
+  "/{layers}/{z}/{x}/{y}.{fmt}":
+    origin: "http://localhost/{layers}/{z}/{x}/{y}.{fmt}"
+`, healthcheck)
+}
+
+func writeConfig(t *testing.T, name, config string) {
+	err := ioutil.WriteFile(name, []byte(config), 0644)
+	if err != nil {
+		t.Fatalf("Unable to write config file: %s", err.Error())
+	}
+}
+
+func assertStatus(t *testing.T, h http.Handler, req *http.Request, expected int) {
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != expected {
+		t.Fatalf("Expected %s %s to have status %d, but got %d", req.Method, req.URL.Path, expected, rw.Code)
+	}
+}
+
+func newTestReloader(t *testing.T, name string) *reloader {
+	args := []string{"-yamlConfig", name}
+	cfg, err := parseConfig(args)
+	if err != nil {
+		t.Fatalf("Unable to parse config: %s", err.Error())
+	}
+	rl := &reloader{args: args, listen: cfg.Listen, cfg: cfg}
+	r, err := rl.build(cfg)
+	if err != nil {
+		t.Fatalf("Unable to build router: %s", err.Error())
+	}
+	rl.use(r)
+	return rl
+}
+
+func TestReload(t *testing.T) {
+	file, err := ioutil.TempFile("", "xonacatl-config")
+	if err != nil {
+		t.Fatalf("Unable to create config file: %s", err.Error())
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	writeConfig(t, file.Name(), reloadConfig("/health"))
+	rl := newTestReloader(t, file.Name())
+	assertStatus(t, rl, httptest.NewRequest("GET", "/health", nil), http.StatusOK)
+
+	writeConfig(t, file.Name(), reloadConfig("/healthz"))
+	if err = rl.Reload(); err != nil {
+		t.Fatalf("Unable to reload config: %s", err.Error())
+	}
+	assertStatus(t, rl, httptest.NewRequest("GET", "/health", nil), http.StatusNotFound)
+	assertStatus(t, rl, httptest.NewRequest("GET", "/healthz", nil), http.StatusOK)
+
+	// an invalid config is rejected, and the current one stays in use.
+	before := configReloadErrors.Value()
+	writeConfig(t, file.Name(), "healthcheck: /other\npatterns: {}\n")
+	if err = rl.Reload(); err == nil {
+		t.Fatalf("Expected invalid config to be rejected")
+	}
+	if configReloadErrors.Value() != before+1 {
+		t.Fatalf("Expected failed reload to be counted")
+	}
+	assertStatus(t, rl, httptest.NewRequest("GET", "/healthz", nil), http.StatusOK)
+}
+
+func TestAdminReload(t *testing.T) {
+	file, err := ioutil.TempFile("", "xonacatl-config")
+	if err != nil {
+		t.Fatalf("Unable to create config file: %s", err.Error())
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	writeConfig(t, file.Name(), reloadConfig("/health"))
+	rl := newTestReloader(t, file.Name())
+	writeConfig(t, file.Name(), reloadConfig("/healthz"))
+
+	req := httptest.NewRequest("POST", "/admin/reload", nil)
+	assertStatus(t, rl, req, http.StatusUnauthorized)
+	req.Header.Set("Authorization", "Bearer wrong")
+	assertStatus(t, rl, req, http.StatusUnauthorized)
+	assertStatus(t, rl, httptest.NewRequest("GET", "/healthz", nil), http.StatusNotFound)
+
+	req.Header.Set("Authorization", "Bearer secret")
+	assertStatus(t, rl, req, http.StatusOK)
+	assertStatus(t, rl, httptest.NewRequest("GET", "/healthz", nil), http.StatusOK)
+}
+
+func TestReloadKeepsRateLimits(t *testing.T) {
+	file, err := ioutil.TempFile("", "xonacatl-config")
+	if err != nil {
+		t.Fatalf("Unable to create config file: %s", err.Error())
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	pattern := "/{layers}/{z}/{x}/{y}.{fmt}"
+	config := func(healthcheck string, rate int) string {
+		return fmt.Sprintf("%s    rate_limit: {rate: %d}\n", reloadConfig(healthcheck), rate)
+	}
+
+	writeConfig(t, file.Name(), config("/health", 10))
+	rl := newTestReloader(t, file.Name())
+	limiter := rl.routing().limiters[pattern].limiter
+
+	// an unrelated change keeps the clients' buckets.
+	writeConfig(t, file.Name(), config("/healthz", 10))
+	if err = rl.Reload(); err != nil {
+		t.Fatalf("Unable to reload config: %s", err.Error())
+	}
+	if rl.routing().limiters[pattern].limiter != limiter {
+		t.Fatalf("Expected the rate limiter to be kept when its options didn't change")
+	}
+
+	writeConfig(t, file.Name(), config("/healthz", 20))
+	if err = rl.Reload(); err != nil {
+		t.Fatalf("Unable to reload config: %s", err.Error())
+	}
+	if rl.routing().limiters[pattern].limiter == limiter {
+		t.Fatalf("Expected a new rate limiter when its options changed")
+	}
+}
@@ -4,15 +4,21 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"github.com/NYTimes/gziphandler"
 	"github.com/gorilla/mux"
 	"github.com/namsral/flag"
+	"github.com/tilezen/xonacatl"
+	"github.com/tilezen/xonacatl/handler"
 	"github.com/whosonfirst/go-httpony/stats"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"reflect"
 	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type headerOption struct {
@@ -39,12 +45,19 @@ func (h *headerOption) Set(line string) error {
 	return nil
 }
 
+// draining is set while the server is shutting down, so that the healthcheck fails and load balancers stop sending requests.
+var draining int32
+
 func getHealth(rw http.ResponseWriter, _ *http.Request) {
+	if atomic.LoadInt32(&draining) != 0 {
+		http.Error(rw, "Shutting down.", http.StatusServiceUnavailable)
+		return
+	}
 	rw.WriteHeader(200)
 }
 
 type patternsOption struct {
-	patterns map[string]*url.URL
+	patterns map[string]string
 }
 
 func (p *patternsOption) String() string {
@@ -59,12 +72,13 @@ func (p *patternsOption) Set(line string) error {
 	}
 
 	for k, v := range m {
-		url, err := url.Parse(v)
+		_, err := url.Parse(v)
 		if err != nil {
 			return fmt.Errorf("Unable to parse origin URL %#v: %s", v, err.Error())
 		}
 
-		p.patterns[k] = url
+		// keep the original, as re-encoding the URL would escape the braces around route variables.
+		p.patterns[k] = v
 	}
 
 	return nil
@@ -96,70 +110,679 @@ func (r *regexpListOption) Set(line string) error {
 	return nil
 }
 
-func main() {
-	var listen, healthcheck, debug_host string
+type stringMapOption struct {
+	values map[string]string
+}
+
+func (s *stringMapOption) String() string {
+	return fmt.Sprintf("%#v", s.values)
+}
+
+func (s *stringMapOption) Set(line string) error {
+	m := make(map[string]string)
+	err := json.Unmarshal([]byte(line), &m)
+	if err != nil {
+		return fmt.Errorf("Unable to parse value as a JSON object: %s", err.Error())
+	}
+
+	for k, v := range m {
+		s.values[k] = v
+	}
+
+	return nil
+}
+
+type zoomRulesOption struct {
+	rules map[string]xonacatl.ZoomRules
+}
+
+func (z *zoomRulesOption) String() string {
+	return fmt.Sprintf("%#v", z.rules)
+}
+
+func (z *zoomRulesOption) Set(line string) error {
+	m := make(map[string]xonacatl.ZoomRules)
+	err := json.Unmarshal([]byte(line), &m)
+	if err != nil {
+		return fmt.Errorf("Unable to parse value as a JSON object: %s", err.Error())
+	}
+
+	for k, v := range m {
+		z.rules[k] = v
+	}
+
+	return nil
+}
+
+type overzoomOption struct {
+	options map[string]*handler.OverzoomOptions
+}
+
+func (o *overzoomOption) String() string {
+	return fmt.Sprintf("%#v", o.options)
+}
+
+func (o *overzoomOption) Set(line string) error {
+	m := make(map[string]*handler.OverzoomOptions)
+	err := json.Unmarshal([]byte(line), &m)
+	if err != nil {
+		return fmt.Errorf("Unable to parse value as a JSON object: %s", err.Error())
+	}
+
+	for k, v := range m {
+		o.options[k] = v
+	}
+
+	return nil
+}
+
+type masksOption struct {
+	files map[string]map[string]string
+}
+
+func (m *masksOption) String() string {
+	return fmt.Sprintf("%#v", m.files)
+}
+
+func (m *masksOption) Set(line string) error {
+	v := make(map[string]map[string]string)
+	err := json.Unmarshal([]byte(line), &v)
+	if err != nil {
+		return fmt.Errorf("Unable to parse value as a JSON object: %s", err.Error())
+	}
+
+	for k, files := range v {
+		m.files[k] = files
+	}
+
+	return nil
+}
+
+// loadMasks reads the mask files for each layer. Masks are cached by file name, as the same file is often used for several layers or patterns.
+func loadMasks(files map[string]string, cache map[string]*xonacatl.Mask) (map[string]*xonacatl.Mask, error) {
+	masks := make(map[string]*xonacatl.Mask)
+
+	for layer, file := range files {
+		mask, ok := cache[file]
+		if !ok {
+			f, err := os.Open(file)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to open mask file %#v: %s", file, err.Error())
+			}
+			mask, err = xonacatl.ParseMask(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("Unable to load mask file %#v: %s", file, err.Error())
+			}
+			cache[file] = mask
+		}
+		masks[layer] = mask
+	}
+
+	return masks, nil
+}
+
+type sniOption struct {
+	certs map[string]certPair
+}
+
+func (s *sniOption) String() string {
+	return fmt.Sprintf("%#v", s.certs)
+}
+
+func (s *sniOption) Set(line string) error {
+	m := make(map[string]certPair)
+	err := json.Unmarshal([]byte(line), &m)
+	if err != nil {
+		return fmt.Errorf("Unable to parse value as a JSON object: %s", err.Error())
+	}
+
+	for k, v := range m {
+		s.certs[k] = v
+	}
+
+	return nil
+}
+
+type originTLSOption struct {
+	options map[string]*originTLSConfig
+}
+
+func (o *originTLSOption) String() string {
+	return fmt.Sprintf("%#v", o.options)
+}
+
+func (o *originTLSOption) Set(line string) error {
+	m := make(map[string]*originTLSConfig)
+	err := json.Unmarshal([]byte(line), &m)
+	if err != nil {
+		return fmt.Errorf("Unable to parse value as a JSON object: %s", err.Error())
+	}
+
+	for k, v := range m {
+		o.options[k] = v
+	}
+
+	return nil
+}
+
+type corsOption struct {
+	policies map[string]*handler.CORSPolicy
+}
+
+func (c *corsOption) String() string {
+	return fmt.Sprintf("%#v", c.policies)
+}
+
+func (c *corsOption) Set(line string) error {
+	m := make(map[string]*handler.CORSPolicy)
+	err := json.Unmarshal([]byte(line), &m)
+	if err != nil {
+		return fmt.Errorf("Unable to parse value as a JSON object: %s", err.Error())
+	}
+
+	for k, v := range m {
+		c.policies[k] = v
+	}
+
+	return nil
+}
+
+type rateLimitOption struct {
+	options map[string]*handler.RateLimitOptions
+}
+
+func (r *rateLimitOption) String() string {
+	return fmt.Sprintf("%#v", r.options)
+}
+
+func (r *rateLimitOption) Set(line string) error {
+	m := make(map[string]*handler.RateLimitOptions)
+	err := json.Unmarshal([]byte(line), &m)
+	if err != nil {
+		return fmt.Errorf("Unable to parse value as a JSON object: %s", err.Error())
+	}
+
+	for k, v := range m {
+		r.options[k] = v
+	}
+
+	return nil
+}
+
+type apiKeysOption struct {
+	options map[string]*handler.APIKeyOptions
+}
+
+func (a *apiKeysOption) String() string {
+	return fmt.Sprintf("%#v", a.options)
+}
+
+func (a *apiKeysOption) Set(line string) error {
+	m := make(map[string]*handler.APIKeyOptions)
+	err := json.Unmarshal([]byte(line), &m)
+	if err != nil {
+		return fmt.Errorf("Unable to parse value as a JSON object: %s", err.Error())
+	}
+
+	for k, v := range m {
+		a.options[k] = v
+	}
+
+	return nil
+}
+
+type compressionOption struct {
+	options *handler.CompressionOptions
+}
+
+func (c *compressionOption) String() string {
+	return fmt.Sprintf("%#v", c.options)
+}
+
+func (c *compressionOption) Set(line string) error {
+	err := json.Unmarshal([]byte(line), c.options)
+	if err != nil {
+		return fmt.Errorf("Unable to parse value as a JSON object: %s", err.Error())
+	}
+	return nil
+}
+
+type layerListOption struct {
+	layers map[string]bool
+}
+
+func (l *layerListOption) String() string {
+	return fmt.Sprintf("%#v", l.layers)
+}
+
+func (l *layerListOption) Set(line string) error {
+	var parts []string
+	err := json.Unmarshal([]byte(line), &parts)
+	if err != nil {
+		return fmt.Errorf("Unable to parse value as a JSON list: %s", err.Error())
+	}
+
+	if l.layers == nil {
+		l.layers = make(map[string]bool)
+	}
+	for _, part := range parts {
+		l.layers[part] = true
+	}
+
+	return nil
+}
+
+type tileJSONOption struct {
+	options map[string]*handler.TileJSONOptions
+}
+
+func (t *tileJSONOption) String() string {
+	return fmt.Sprintf("%#v", t.options)
+}
+
+func (t *tileJSONOption) Set(line string) error {
+	m := make(map[string]*handler.TileJSONOptions)
+	err := json.Unmarshal([]byte(line), &m)
+	if err != nil {
+		return fmt.Errorf("Unable to parse value as a JSON object: %s", err.Error())
+	}
+
+	for k, v := range m {
+		if len(v.Path) == 0 {
+			return fmt.Errorf("TileJSON options for pattern %#v must include a path", k)
+		}
+		t.options[k] = v
+	}
+
+	return nil
+}
+
+// parseConfig parses the command line arguments and environment, and returns the configuration they describe. If the -yamlConfig flag is given, then the configuration is read from that file instead, and no other settings may be given as flags.
+func parseConfig(args []string) (*serverConfig, error) {
+	var config_file string
+	cfg := defaultConfig()
 	custom_headers := headerOption{header: make(http.Header)}
-	patterns := patternsOption{patterns: make(map[string]*url.URL)}
+	patterns := patternsOption{patterns: make(map[string]string)}
 	do_not_forward := regexpListOption{}
-
-	f := flag.NewFlagSetWithEnvPrefix(os.Args[0], "XONACATL", 0)
+	known_layers := layerListOption{}
+	tilejson := tileJSONOption{options: make(map[string]*handler.TileJSONOptions)}
+	style_files := stringMapOption{values: make(map[string]string)}
+	zoom_rules := zoomRulesOption{rules: make(map[string]xonacatl.ZoomRules)}
+	overzoom := overzoomOption{options: make(map[string]*handler.OverzoomOptions)}
+	precision := stringMapOption{values: make(map[string]string)}
+	mask_files := masksOption{files: make(map[string]map[string]string)}
+	sni := sniOption{certs: make(map[string]certPair)}
+	origin_tls := originTLSOption{options: make(map[string]*originTLSConfig)}
+	cors := corsOption{policies: make(map[string]*handler.CORSPolicy)}
+	compression := compressionOption{options: &cfg.Compression}
+	rate_limit := rateLimitOption{options: make(map[string]*handler.RateLimitOptions)}
+	api_keys := apiKeysOption{options: make(map[string]*handler.APIKeyOptions)}
+
+	f := flag.NewFlagSetWithEnvPrefix(os.Args[0], "XONACATL", flag.ContinueOnError)
+	f.StringVar(&config_file, "yamlConfig", "", "YAML or JSON file with the whole server configuration, in place of the other flags.")
 	f.Var(&patterns, "patterns", "JSON object of patterns to use when matching incoming tile requests.")
-	f.StringVar(&listen, "listen", ":8080", "interface and port to listen on")
-	f.String("config", "", "Config file to read values from.")
+	f.StringVar(&cfg.Listen, "listen", cfg.Listen, "interface and port to listen on")
+	f.String("config", "", "File to read flag values from, one \"name value\" per line. For a structured configuration file, use -yamlConfig instead.")
 	f.Var(&custom_headers, "headers", "JSON object of extra headers to add to proxied requests.")
-	f.StringVar(&healthcheck, "healthcheck", "", "A path to respond to with a blank 200 OK. Intended for use by load balancer health checks.")
+	f.StringVar(&cfg.Healthcheck, "healthcheck", "", "A path to respond to with a blank 200 OK. Intended for use by load balancer health checks.")
 	f.Var(&do_not_forward, "noforward", "List of regular expressions. If a header matches one of these, then it will not be forwarded to the origin.")
-	f.StringVar(&debug_host, "debugHost", "", "IP address of remote debug host allowed to read expvars at /debug/vars.")
-	err := f.Parse(os.Args[1:])
-	if err == flag.ErrHelp {
-		return
-	} else if err != nil {
-		log.Fatalf("Unable to parse input command line, environment or config: %s", err.Error())
+	f.StringVar(&cfg.DebugHost, "debugHost", "", "IP address of remote debug host allowed to read expvars at /debug/vars.")
+	f.BoolVar(&cfg.CanonicalRedirect, "canonicalRedirect", false, "If true, redirect requests for non-canonical layer lists (unsorted, duplicated or containing unknown layers) to the canonical URL.")
+	f.Var(&known_layers, "layers", "JSON list of known layer names. If given, unknown layers are removed from canonical layer lists.")
+	f.Var(&tilejson, "tilejson", "JSON object of TileJSON endpoint options, keyed by the pattern they describe.")
+	f.Var(&style_files, "styles", "JSON object of style IDs to style files. Tile requests with a \"style\" query parameter only get the layers and features that style uses.")
+	f.StringVar(&cfg.Styles.Path, "stylePath", "", "A path to which clients may POST styles, receiving an ID to use in the \"style\" query parameter.")
+	f.IntVar(&cfg.Styles.MaxPosted, "maxPostedStyles", cfg.Styles.MaxPosted, "The maximum number of POSTed styles to keep.")
+	f.Var(&zoom_rules, "zoomRules", "JSON object of zoom rules, keyed by pattern. Each is an object of layer names to {\"minzoom\": z, \"maxzoom\": z}, and requested layers outside that range are dropped.")
+	f.Var(&overzoom, "overzoom", "JSON object of overzoom options, keyed by pattern. Each is an object {\"maxzoom\": z, \"buffer\": pixels}, and tiles beyond the maximum zoom are cut out of their ancestor at that zoom.")
+	f.Var(&precision, "precision", "JSON object of default GeoJSON coordinate precision, keyed by pattern. Each is a number of decimal places or \"auto\" to suit the zoom, and can be overridden by the \"precision\" query parameter.")
+	f.Var(&mask_files, "masks", "JSON object of layer masks, keyed by pattern. Each is an object of layer names to GeoJSON polygon files, and those layers are only served within their mask.")
+	f.Var(&compression, "compression", "JSON object of response compression options {\"encodings\": [\"br\", \"zstd\", \"gzip\"], \"levels\": {encoding: level}, \"min_size\": bytes}. Responses are compressed with the best encoding the client accepts.")
+	f.BoolVar(&cfg.StatsMetrics, "statsMetrics", false, "If true, add the layers and features kept and bytes read and written to the counters at /debug/vars. This parses every tile a little more, so costs some CPU.")
+	f.BoolVar(&cfg.StatsHeaders, "statsHeaders", false, "If true, add X-Xonacatl-* headers to responses with the layers and features kept and bytes read and written. This buffers responses, so is intended for debugging.")
+	f.StringVar(&cfg.Shutdown.DrainPeriod, "drainPeriod", "", "How long to keep serving requests with a failing healthcheck after SIGTERM, so that load balancers notice, such as \"10s\".")
+	f.StringVar(&cfg.Shutdown.Timeout, "shutdownTimeout", cfg.Shutdown.Timeout, "How long to wait for requests in progress to finish when shutting down.")
+	f.Var(&origin_tls, "originTLS", "JSON object of origin TLS options, keyed by pattern. Each is an object {\"ca\": file, \"cert\": file, \"key\": file, \"server_name\": name, \"min_version\": \"1.2\"}, to trust a private CA, send a client certificate, or verify the origin as another name.")
+	f.Var(&cors, "cors", "JSON object of CORS policies, keyed by pattern. Each is an object {\"allowed_origins\": [origins], \"allowed_methods\": [methods], \"allowed_headers\": [headers], \"exposed_headers\": [headers], \"max_age\": seconds}, where origins may have a \"*\" wildcard.")
+	f.Var(&rate_limit, "rateLimit", "JSON object of rate limits, keyed by pattern. Each is an object {\"rate\": requests per second, \"burst\": requests, \"key\": \"ip\", \"forwarded_for\", \"query:<name>\" or \"header:<name>\", \"max_clients\": n}, and clients over their limit get 429 Too Many Requests.")
+	f.Var(&api_keys, "apiKeys", "JSON object of API key checks, keyed by pattern. Each is an object {\"param\": name, \"file\": file, \"auth_url\": url, \"cache_ttl\": \"1m\", \"negative_cache_ttl\": \"1m\", \"strip\": true, \"forward_as\": name, \"origin_key\": key}, and requests without a valid key are rejected before going to the origin.")
+	f.StringVar(&cfg.TLS.Cert, "tlsCert", "", "PEM certificate file. If given with tlsKey, the server listens for HTTPS instead of HTTP.")
+	f.StringVar(&cfg.TLS.Key, "tlsKey", "", "PEM private key file for tlsCert.")
+	f.Var(&sni, "tlsSNI", "JSON object of server names, such as \"tiles.example.com\" or \"*.example.com\", to {\"cert\": file, \"key\": file} to use for them instead of tlsCert.")
+	f.StringVar(&cfg.TLS.RedirectListen, "redirectListen", "", "interface and port to listen on for plain HTTP requests, which are redirected to HTTPS.")
+	f.StringVar(&cfg.Admin.Path, "adminPath", "", "A path to which POST requests reload the configuration, authenticated with the adminToken as a bearer token.")
+	f.StringVar(&cfg.Admin.Token, "adminToken", "", "The token which requests to the adminPath must have.")
+	err := f.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config_file) > 0 {
+		var others []string
+		f.Visit(func(fl *flag.Flag) {
+			if fl.Name != "yamlConfig" && fl.Name != "config" {
+				others = append(others, "-"+fl.Name)
+			}
+		})
+		if len(others) > 0 {
+			return nil, fmt.Errorf("Unable to combine -yamlConfig with %s, which should be set in the config file", strings.Join(others, ", "))
+		}
+
+		file, err := os.Open(config_file)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open config file: %s", err.Error())
+		}
+		defer file.Close()
+
+		cfg, err = loadConfig(file)
+		if err != nil {
+			return nil, err
+		}
+		return cfg, cfg.validate()
+	}
+
+	for k := range custom_headers.header {
+		if cfg.Headers == nil {
+			cfg.Headers = make(map[string]string)
+		}
+		cfg.Headers[k] = custom_headers.header.Get(k)
+	}
+	for _, re := range do_not_forward.regexps {
+		cfg.NoForward = append(cfg.NoForward, re.String())
+	}
+	for l := range known_layers.layers {
+		cfg.Layers = append(cfg.Layers, l)
+	}
+	sort.Strings(cfg.Layers)
+	if len(style_files.values) > 0 {
+		cfg.Styles.Files = style_files.values
+	}
+	if len(sni.certs) > 0 {
+		cfg.TLS.SNI = sni.certs
+	}
+
+	for pattern, origin := range patterns.patterns {
+		cfg.Patterns[pattern] = &patternConfig{
+			Origin:    origin,
+			ZoomRules: zoom_rules.rules[pattern],
+			Overzoom:  overzoom.options[pattern],
+			Precision: precision.values[pattern],
+			Masks:     mask_files.files[pattern],
+			TileJSON:  tilejson.options[pattern],
+			OriginTLS: origin_tls.options[pattern],
+			CORS:      cors.policies[pattern],
+			RateLimit: rate_limit.options[pattern],
+			APIKeys:   api_keys.options[pattern],
+		}
+	}
+
+	return cfg, cfg.validate()
+}
+
+// newRouter returns a router which serves everything in the configuration. Errors are prefixed with the key of the part of the configuration they came from.
+func newRouter(cfg *serverConfig) (*mux.Router, error) {
+	r, err := buildRouter(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r.router, nil
+}
+
+// rateLimiter returns the rate limiter for a pattern. If the previous routing had one for the same pattern with the same options, then that's used again, so that clients' buckets are kept across reloads.
+func rateLimiter(previous *routing, pattern string, options *handler.RateLimitOptions) (*handler.RateLimiter, error) {
+	if previous != nil {
+		if l, ok := previous.limiters[pattern]; ok && reflect.DeepEqual(l.options, *options) {
+			return l.limiter, nil
+		}
 	}
+	return handler.NewRateLimiter(options)
+}
 
-	if len(patterns.patterns) == 0 {
-		log.Fatalf("You must provide at least one pattern to proxy.")
+// buildRouter returns the routing for everything in the configuration, with the transports it made for origins with their own TLS settings. Other origins use http.DefaultTransport. Rate limiters are carried over from the previous routing, if there is one.
+func buildRouter(cfg *serverConfig, previous *routing) (*routing, error) {
+	var styles *handler.StyleRegistry
+	if len(cfg.Styles.Files) > 0 || len(cfg.Styles.Path) > 0 {
+		styles = handler.NewStyleRegistry(cfg.Styles.MaxPosted)
+		for id, path := range cfg.Styles.Files {
+			err := styles.LoadFile(id, path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: Unable to load style: %s", mapKey("styles.files", id), err.Error())
+			}
+		}
 	}
 
-	var headers *http.Header
-	if len(custom_headers.header) > 0 {
-		headers = &custom_headers.header
+	var known_layers map[string]bool
+	if len(cfg.Layers) > 0 {
+		known_layers = make(map[string]bool)
+		for _, l := range cfg.Layers {
+			known_layers[l] = true
+		}
 	}
 
+	var timeout time.Duration
+	if len(cfg.Limits.OriginTimeout) > 0 {
+		var err error
+		timeout, err = time.ParseDuration(cfg.Limits.OriginTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("limits.origin_timeout: %s", err.Error())
+		}
+	}
+	client := &http.Client{Timeout: timeout}
+	var transports []*http.Transport
+	limiters := make(map[string]*rateLimit)
+
 	r := mux.NewRouter()
+	mask_cache := make(map[string]*xonacatl.Mask)
 
-	// initialise expvar counters
-	initCounters()
+	for pattern, p := range cfg.Patterns {
+		key := mapKey("patterns", pattern)
 
-	for pattern, origin := range patterns.patterns {
-		origin_router := mux.NewRouter()
-		origin_router.NewRoute().Path(origin.Path).BuildOnly().Name("origin")
+		origin, err := url.Parse(p.Origin)
+		if err != nil {
+			return nil, fmt.Errorf("%s.origin: Unable to parse URL: %s", key, err.Error())
+		}
+
+		headers := make(http.Header)
+		for k, v := range cfg.Headers {
+			headers.Set(k, v)
+		}
+		for k, v := range p.Headers {
+			headers.Set(k, v)
+		}
+
+		var do_not_forward []*regexp.Regexp
+		for _, re := range append(append([]string(nil), cfg.NoForward...), p.NoForward...) {
+			compiled, err := regexp.Compile(re)
+			if err != nil {
+				return nil, fmt.Errorf("%s.noforward: Unable to compile regexp %#v: %s", key, re, err.Error())
+			}
+			do_not_forward = append(do_not_forward, compiled)
+		}
+
+		pattern_client := client
+		if p.OriginTLS != nil {
+			transport, err := originTransport(fieldKey(key, "origin_tls"), p.OriginTLS)
+			if err != nil {
+				return nil, err
+			}
+			transports = append(transports, transport)
+			pattern_client = &http.Client{Timeout: timeout, Transport: transport}
+		}
+
+		masks, err := loadMasks(p.Masks, mask_cache)
+		if err != nil {
+			return nil, fmt.Errorf("%s.masks: %s", key, err.Error())
+		}
+
+		var check_request func(req *http.Request) error
+		var rewrite_request func(origin_req, req *http.Request) error
+		if p.APIKeys != nil {
+			checker, err := handler.NewAPIKeyChecker(p.APIKeys)
+			if err != nil {
+				return nil, fmt.Errorf("%s.api_keys: %s", key, err.Error())
+			}
+			check_request = checker.CheckRequest
+			rewrite_request = checker.RewriteRequest
+		}
+
+		h, err := handler.New(&handler.Options{
+			Origin:            origin,
+			Headers:           headers,
+			DoNotForward:      do_not_forward,
+			Client:            pattern_client,
+			CanonicalRedirect: cfg.CanonicalRedirect,
+			KnownLayers:       known_layers,
+			Styles:            styles,
+			ZoomRules:         p.ZoomRules,
+			Overzoom:          p.Overzoom,
+			Precision:         p.Precision,
+			Masks:             masks,
+			StatsMetrics:      cfg.StatsMetrics,
+			StatsHeaders:      cfg.StatsHeaders,
+			CORS:              p.CORS,
+			CheckRequest:      check_request,
+			RewriteRequest:    rewrite_request,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err.Error())
+		}
 
-		h := &LayersHandler{
-			origin:                 origin,
-			route:                  origin_router.GetRoute("origin"),
-			custom_headers:         headers,
-			do_not_forward_headers: do_not_forward.regexps,
-			http_client:            &http.Client{},
+		// the handlers answer CORS preflight requests themselves.
+		methods := []string{"GET", "HEAD"}
+		if p.CORS != nil {
+			methods = append(methods, "OPTIONS")
 		}
 
-		gzipped := gziphandler.GzipHandler(h)
+		if p.TileJSON != nil {
+			tj_options := *p.TileJSON
+			if len(tj_options.CacheTTL) == 0 {
+				tj_options.CacheTTL = cfg.Caches.TileJSONTTL
+			}
+			tj_handler, err := handler.NewTileJSONHandler(h, pattern, &tj_options)
+			if err != nil {
+				return nil, fmt.Errorf("%s.tilejson: %s", key, err.Error())
+			}
+			tj, err := handler.NewCompressHandler(tj_handler, &cfg.Compression)
+			if err != nil {
+				return nil, fmt.Errorf("compression: %s", err.Error())
+			}
+			r.Handle(p.TileJSON.Path, tj).Methods(methods...)
+		}
 
-		r.Handle(pattern, gzipped).Methods("GET")
+		compressed, err := handler.NewCompressHandler(h, &cfg.Compression)
+		if err != nil {
+			return nil, fmt.Errorf("compression: %s", err.Error())
+		}
+
+		// throttled requests are turned away before any work is done on them.
+		var tiles http.Handler = compressed
+		if p.RateLimit != nil {
+			limiter, err := rateLimiter(previous, pattern, p.RateLimit)
+			if err != nil {
+				return nil, fmt.Errorf("%s.rate_limit: %s", key, err.Error())
+			}
+			limiters[pattern] = &rateLimit{options: *p.RateLimit, limiter: limiter}
+			tiles = limiter.Handler(compressed, p.CORS)
+		}
+
+		r.Handle(pattern, tiles).Methods(methods...)
+	}
+
+	if len(cfg.Styles.Path) > 0 {
+		r.Handle(cfg.Styles.Path, styles).Methods("POST")
 	}
 
-	if len(healthcheck) > 0 {
-		r.HandleFunc(healthcheck, getHealth).Methods("GET")
+	if len(cfg.Healthcheck) > 0 {
+		r.HandleFunc(cfg.Healthcheck, getHealth).Methods("GET")
 	}
 
 	// serve expvar stats to localhost and debugHost
-	expvar_func, err := stats.HandlerFunc(debug_host)
+	expvar_func, err := stats.HandlerFunc(cfg.DebugHost)
 	if err != nil {
-		log.Fatalf("Error initializing stats.HandlerFunc: %s", err.Error())
+		return nil, fmt.Errorf("debug_host: Error initializing stats.HandlerFunc: %s", err.Error())
 	}
 	r.HandleFunc("/debug/vars", expvar_func).Methods("GET")
 
-	http.Handle("/", r)
+	return &routing{router: r, transports: transports, limiters: limiters}, nil
+}
+
+func main() {
+	// "check-config" validates the configuration, including loading any files it refers to, and exits without starting the server.
+	args := os.Args[1:]
+	check_config := len(args) > 0 && args[0] == "check-config"
+	if check_config {
+		args = args[1:]
+	}
 
-	log.Fatal(http.ListenAndServe(listen, r))
+	cfg, err := parseConfig(args)
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		configFailed(check_config, err)
+	}
+
+	rl := &reloader{args: args, listen: cfg.Listen, cfg: cfg}
+	r, err := rl.build(cfg)
+	if err != nil {
+		configFailed(check_config, err)
+	}
+
+	var certs *certStore
+	if cfg.TLS.enabled() {
+		certs, err = newCertStore(&cfg.TLS)
+		if err != nil {
+			configFailed(check_config, err)
+		}
+	}
+
+	if check_config {
+		fmt.Println("Configuration OK")
+		return
+	}
+
+	rl.use(r)
+	rl.watchSignals()
+
+	srv := cfg.Limits.server(cfg.Listen, rl)
+	servers := []*http.Server{srv}
+	if len(cfg.TLS.RedirectListen) > 0 {
+		redirect_srv := cfg.Limits.server(cfg.TLS.RedirectListen, redirectToHTTPS(cfg.Listen))
+		servers = append(servers, redirect_srv)
+		go func() {
+			err := redirect_srv.ListenAndServe()
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	exit_status := make(chan int, 1)
+	go func() {
+		exit_status <- rl.shutdownOnSignal(servers...)
+	}()
+
+	if certs != nil {
+		srv.TLSConfig = serverTLSConfig(certs)
+		// the certificates come from the TLS config, so that they can be reloaded.
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	status := <-exit_status
+	log.Printf("Exiting with status %d.", status)
+	os.Exit(status)
+}
+
+// configFailed reports an invalid configuration and exits. In check-config mode, the problems are written plainly, one per line, so that they're easy to read.
+func configFailed(check_config bool, err error) {
+	if check_config {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%s\n", err.Error())
+		os.Exit(1)
+	}
+	log.Fatalf("Invalid configuration: %s", err.Error())
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// drainLogInterval is how often progress is logged while draining.
+const drainLogInterval = 5 * time.Second
+
+// shutdownOnSignal waits for a SIGTERM or SIGINT, then shuts the servers down gracefully, returning the exit status.
+func (rl *reloader) shutdownOnSignal(servers ...*http.Server) int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	signal.Stop(signals)
+
+	return rl.shutdown(sig, servers...)
+}
+
+// shutdown fails the healthcheck and keeps serving requests for the drain period, so that load balancers stop sending new ones, then stops the servers together, waiting up to the shutdown timeout for requests in progress to finish. Idle connections to origins are closed afterwards. It returns the exit status: zero if all requests finished, or one if some were cut off.
+func (rl *reloader) shutdown(sig os.Signal, servers ...*http.Server) int {
+	cfg := rl.config().Shutdown
+	drain_period := cfg.drainPeriod()
+
+	log.Printf("Received %s, failing healthcheck and draining for %s.", sig, drain_period)
+	atomic.StoreInt32(&draining, 1)
+
+	drain_end := time.Now().Add(drain_period)
+	drained := time.NewTimer(drain_period)
+	ticker := time.NewTicker(drainLogInterval)
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+			remaining := time.Until(drain_end) / time.Second * time.Second
+			log.Printf("Draining, %s remaining with %d requests in progress.", remaining, atomic.LoadInt64(&rl.in_flight))
+		case <-drained.C:
+			done = true
+		}
+	}
+	ticker.Stop()
+
+	ctx := context.Background()
+	if timeout := cfg.timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	log.Printf("Shutting down, with %d requests in progress.", atomic.LoadInt64(&rl.in_flight))
+	// the servers are shut down together, so that they all stop accepting connections straight away, and a slow request on one doesn't use up the others' time.
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			errs <- srv.Shutdown(ctx)
+		}(srv)
+	}
+	var err error
+	for range servers {
+		if srv_err := <-errs; srv_err != nil {
+			err = srv_err
+		}
+	}
+
+	// the origin clients keep connections open for reuse. most use the default transport, but origins with their own TLS settings have their own.
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+	rl.routing().closeIdleConnections()
+
+	if err != nil {
+		log.Printf("ERROR: Shutdown didn't finish cleanly, with %d requests cut off: %s", atomic.LoadInt64(&rl.in_flight), err.Error())
+		return 1
+	}
+	log.Printf("Shutdown complete.")
+	return 0
+}
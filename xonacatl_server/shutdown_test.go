@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	file, err := ioutil.TempFile("", "xonacatl-config")
+	if err != nil {
+		t.Fatalf("Unable to create config file: %s", err.Error())
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	writeConfig(t, file.Name(), reloadConfig("/health")+"shutdown: {drain_period: 200ms, timeout: 1s}\n")
+	rl := newTestReloader(t, file.Name())
+	defer atomic.StoreInt32(&draining, 0)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err.Error())
+	}
+	srv := &http.Server{Handler: rl}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	health_url := "http://" + ln.Addr().String() + "/health"
+	resp, err := http.Get(health_url)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected healthcheck to pass before shutdown, but got %v (error %v)", resp, err)
+	}
+	resp.Body.Close()
+
+	status := make(chan int, 1)
+	go func() {
+		status <- rl.shutdown(syscall.SIGTERM, srv)
+	}()
+
+	// the healthcheck fails while draining, but requests are still served.
+	time.Sleep(50 * time.Millisecond)
+	resp, err = http.Get(health_url)
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected healthcheck to fail while draining, but got %v (error %v)", resp, err)
+	}
+	resp.Body.Close()
+
+	if s := <-status; s != 0 {
+		t.Fatalf("Expected clean shutdown to have exit status 0, but got %d", s)
+	}
+	if err = <-served; err != http.ErrServerClosed {
+		t.Fatalf("Expected server to be closed, but got %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	file, err := ioutil.TempFile("", "xonacatl-config")
+	if err != nil {
+		t.Fatalf("Unable to create config file: %s", err.Error())
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	writeConfig(t, file.Name(), reloadConfig("/health")+"shutdown: {timeout: 50ms}\n")
+	rl := newTestReloader(t, file.Name())
+	defer atomic.StoreInt32(&draining, 0)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	go http.Get(srv.URL)
+	<-started
+
+	if s := rl.shutdown(syscall.SIGTERM, srv.Config); s != 1 {
+		t.Fatalf("Expected shutdown cutting off a request to have exit status 1, but got %d", s)
+	}
+}
+
+func TestShutdownConcurrent(t *testing.T) {
+	file, err := ioutil.TempFile("", "xonacatl-config")
+	if err != nil {
+		t.Fatalf("Unable to create config file: %s", err.Error())
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	writeConfig(t, file.Name(), reloadConfig("/health")+"shutdown: {timeout: 5s}\n")
+	rl := newTestReloader(t, file.Name())
+	defer atomic.StoreInt32(&draining, 0)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	busy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer busy.Close()
+	idle := httptest.NewServer(http.NotFoundHandler())
+	defer idle.Close()
+
+	go http.Get(busy.URL)
+	<-started
+
+	status := make(chan int, 1)
+	go func() {
+		status <- rl.shutdown(syscall.SIGTERM, busy.Config, idle.Config)
+	}()
+
+	// the idle server stops listening while the busy one is still waiting for its request.
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, err := net.Dial("tcp", idle.Listener.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			close(release)
+			t.Fatalf("Expected the idle server to stop listening while the busy one shut down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	if s := <-status; s != 0 {
+		t.Fatalf("Expected clean shutdown to have exit status 0, but got %d", s)
+	}
+}
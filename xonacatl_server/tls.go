@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often certificate files are checked for changes.
+var certCheckInterval = 10 * time.Second
+
+// certFile is a certificate and key loaded from disk, which is reloaded when either file changes, so that renewed certificates are picked up without a restart.
+type certFile struct {
+	cert_file, key_file string
+
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	mod_time time.Time
+	checked  time.Time
+}
+
+func loadCertFile(cert_file, key_file string) (*certFile, error) {
+	c := &certFile{cert_file: cert_file, key_file: key_file}
+	mod_time, err := c.modTime()
+	if err != nil {
+		return nil, err
+	}
+	err = c.load(mod_time)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// modTime returns the later of the modification times of the certificate and key files.
+func (c *certFile) modTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.cert_file, c.key_file} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certFile) load(mod_time time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.cert_file, c.key_file)
+	if err != nil {
+		return fmt.Errorf("Unable to load certificate %#v and key %#v: %s", c.cert_file, c.key_file, err.Error())
+	}
+	c.cert = &cert
+	c.mod_time = mod_time
+	c.checked = time.Now()
+	return nil
+}
+
+// get returns the certificate, reloading it first if the files have changed. If the new files can't be loaded, for example because only one of them has been replaced so far, then the old certificate is kept, and loading is tried again at the next check.
+func (c *certFile) get() *tls.Certificate {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if time.Since(c.checked) < certCheckInterval {
+		return c.cert
+	}
+	c.checked = time.Now()
+
+	mod_time, err := c.modTime()
+	if err != nil {
+		log.Printf("WARNING: Unable to check certificate %#v for changes: %s", c.cert_file, err.Error())
+		return c.cert
+	}
+	if mod_time.Equal(c.mod_time) {
+		return c.cert
+	}
+
+	err = c.load(mod_time)
+	if err != nil {
+		log.Printf("WARNING: Keeping the current certificate: %s", err.Error())
+	} else {
+		log.Printf("Reloaded certificate %#v.", c.cert_file)
+	}
+	return c.cert
+}
+
+// certStore picks the certificate for each TLS connection by the server name the client asked for, falling back to the default certificate.
+type certStore struct {
+	default_cert *certFile
+	sni          map[string]*certFile
+}
+
+func newCertStore(cfg *tlsConfig) (*certStore, error) {
+	default_cert, err := loadCertFile(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %s", err.Error())
+	}
+
+	s := &certStore{default_cert: default_cert, sni: make(map[string]*certFile)}
+	for name, pair := range cfg.SNI {
+		c, err := loadCertFile(pair.Cert, pair.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", mapKey("tls.sni", name), err.Error())
+		}
+		s.sni[strings.ToLower(name)] = c
+	}
+
+	return s, nil
+}
+
+// GetCertificate returns the certificate for the server name, which may match an SNI name exactly or a wildcard such as "*.example.com".
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+	if c, ok := s.sni[name]; ok {
+		return c.get(), nil
+	}
+	if idx := strings.Index(name, "."); idx >= 0 {
+		if c, ok := s.sni["*"+name[idx:]]; ok {
+			return c.get(), nil
+		}
+	}
+	return s.default_cert.get(), nil
+}
+
+// serverTLSConfig returns the TLS configuration for the server, with HTTP/2 enabled.
+func serverTLSConfig(store *certStore) *tls.Config {
+	return &tls.Config{
+		GetCertificate: store.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// redirectToHTTPS redirects requests to the same URL with HTTPS, on the port of the TLS listener.
+func redirectToHTTPS(tls_listen string) http.Handler {
+	_, port, _ := net.SplitHostPort(tls_listen)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if len(port) > 0 && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(rw, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert generates a self-signed certificate for the name, writing it and its key to files in dir, and returns the file names.
+func writeTestCert(t *testing.T, dir, name string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %s", err.Error())
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Unable to marshal key: %s", err.Error())
+	}
+
+	cert_file := filepath.Join(dir, name+".crt")
+	key_file := filepath.Join(dir, name+".key")
+	ioutil.WriteFile(cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600)
+	return cert_file, key_file
+}
+
+func certSerial(t *testing.T, cert *tls.Certificate) int64 {
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Unable to parse certificate: %s", err.Error())
+	}
+	return parsed.SerialNumber.Int64()
+}
+
+func assertCertFor(t *testing.T, store *certStore, server_name string, serial int64) {
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: server_name})
+	if err != nil {
+		t.Fatalf("Unable to get certificate for %#v: %s", server_name, err.Error())
+	}
+	if s := certSerial(t, cert); s != serial {
+		t.Fatalf("Expected certificate with serial %d for %#v, but got %d", serial, server_name, s)
+	}
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xonacatl-tls")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key := writeTestCert(t, dir, "default.example.com", 1)
+	tiles_cert, tiles_key := writeTestCert(t, dir, "tiles.example.com", 2)
+	wild_cert, wild_key := writeTestCert(t, dir, "wild.example.org", 3)
+
+	store, err := newCertStore(&tlsConfig{
+		Cert: cert,
+		Key:  key,
+		SNI: map[string]certPair{
+			"Tiles.Example.com": {Cert: tiles_cert, Key: tiles_key},
+			"*.example.org":     {Cert: wild_cert, Key: wild_key},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to create certificate store: %s", err.Error())
+	}
+
+	assertCertFor(t, store, "tiles.example.com", 2)
+	assertCertFor(t, store, "a.example.org", 3)
+	assertCertFor(t, store, "a.b.example.org", 1)
+	assertCertFor(t, store, "other.example.com", 1)
+	assertCertFor(t, store, "", 1)
+
+	_, err = newCertStore(&tlsConfig{Cert: cert, Key: key, SNI: map[string]certPair{"x": {Cert: cert, Key: "missing.key"}}})
+	if err == nil {
+		t.Fatalf("Expected missing SNI key file to be an error")
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xonacatl-tls")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	old_interval := certCheckInterval
+	certCheckInterval = 0
+	defer func() { certCheckInterval = old_interval }()
+
+	cert, key := writeTestCert(t, dir, "tiles.example.com", 1)
+	store, err := newCertStore(&tlsConfig{Cert: cert, Key: key})
+	if err != nil {
+		t.Fatalf("Unable to create certificate store: %s", err.Error())
+	}
+	assertCertFor(t, store, "tiles.example.com", 1)
+
+	// a renewed certificate is picked up.
+	writeTestCert(t, dir, "tiles.example.com", 2)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(cert, later, later)
+	assertCertFor(t, store, "tiles.example.com", 2)
+
+	// a broken certificate is ignored, and the current one kept.
+	ioutil.WriteFile(cert, []byte("not a certificate"), 0644)
+	later = later.Add(time.Minute)
+	os.Chtimes(cert, later, later)
+	assertCertFor(t, store, "tiles.example.com", 2)
+}
+
+func TestServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xonacatl-tls")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key := writeTestCert(t, dir, "localhost", 1)
+	store, err := newCertStore(&tlsConfig{Cert: cert, Key: key})
+	if err != nil {
+		t.Fatalf("Unable to create certificate store: %s", err.Error())
+	}
+
+	// find a free port, as ListenAndServeTLS is what sets up HTTP/2.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err.Error())
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(getHealth), TLSConfig: serverTLSConfig(store)}
+	go srv.ListenAndServeTLS("", "")
+	defer srv.Close()
+
+	pem_data, _ := ioutil.ReadFile(cert)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pem_data)
+
+	var conn *tls.Conn
+	for i := 0; i < 50; i++ {
+		conn, err = tls.Dial("tcp", addr, &tls.Config{ServerName: "localhost", RootCAs: roots, NextProtos: []string{"h2", "http/1.1"}})
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Unable to connect with TLS: %s", err.Error())
+	}
+	defer conn.Close()
+
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		t.Fatalf("Expected HTTP/2 to be negotiated, but got %#v", proto)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		listen, host, expected string
+	}{
+		{":443", "tiles.example.com", "https://tiles.example.com/roads/0/0/0.mvt?key=x"},
+		{":443", "tiles.example.com:80", "https://tiles.example.com/roads/0/0/0.mvt?key=x"},
+		{":8443", "tiles.example.com:8080", "https://tiles.example.com:8443/roads/0/0/0.mvt?key=x"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/roads/0/0/0.mvt?key=x", nil)
+		req.Host = test.host
+		rw := httptest.NewRecorder()
+		redirectToHTTPS(test.listen).ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusMovedPermanently || rw.Header().Get("Location") != test.expected {
+			t.Fatalf("Expected redirect to %#v, but got status %d to %#v", test.expected, rw.Code, rw.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package xonacatl
+
+import (
+	"sort"
+)
+
+// ZoomRange is an inclusive range of zoom levels. A nil bound means the range is unbounded in that direction.
+type ZoomRange struct {
+	MinZoom *int `json:"minzoom"`
+	MaxZoom *int `json:"maxzoom"`
+}
+
+// Contains returns true if the zoom level z is within the range.
+func (r ZoomRange) Contains(z int) bool {
+	if r.MinZoom != nil && z < *r.MinZoom {
+		return false
+	}
+	if r.MaxZoom != nil && z > *r.MaxZoom {
+		return false
+	}
+	return true
+}
+
+// ZoomRules maps layer names to the range of zooms at which the layer should be served. Layers without a rule are served at all zooms.
+type ZoomRules map[string]ZoomRange
+
+// Apply removes the layers which are outside their zoom range at zoom z from the set, returning a sorted list of the names of the layers which were removed.
+//
+// A request for "all" is affected by a rule for "all", and by the rules for the layers it contains. Those outside their range are excluded from it by setting them to false in the set, which the copiers drop even though "all" is requested.
+func (r ZoomRules) Apply(layers map[string]bool, z int) []string {
+	var dropped []string
+	includes_all := layers["all"]
+
+	for l, rng := range r {
+		if rng.Contains(z) {
+			continue
+		}
+		if includes_all && l != "all" {
+			if requested, ok := layers[l]; !ok || requested {
+				layers[l] = false
+				dropped = append(dropped, l)
+			}
+		} else if layers[l] {
+			delete(layers, l)
+			dropped = append(dropped, l)
+		}
+	}
+
+	sort.Strings(dropped)
+	return dropped
+}
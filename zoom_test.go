@@ -0,0 +1,61 @@
+package xonacatl
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func parseZoomRules(input string, t *testing.T) ZoomRules {
+	var rules ZoomRules
+	err := json.Unmarshal([]byte(input), &rules)
+	if err != nil {
+		t.Fatalf("Unable to parse zoom rules %#v: %s", input, err.Error())
+	}
+	return rules
+}
+
+func assertZoomRules(rules ZoomRules, z int, layers, expected_layers map[string]bool, expected_dropped []string, t *testing.T) {
+	dropped := rules.Apply(layers, z)
+	if !reflect.DeepEqual(layers, expected_layers) {
+		t.Fatalf("Expected layers at zoom %d to be %#v, but was %#v", z, expected_layers, layers)
+	}
+	if !reflect.DeepEqual(dropped, expected_dropped) {
+		t.Fatalf("Expected dropped layers at zoom %d to be %#v, but was %#v", z, expected_dropped, dropped)
+	}
+}
+
+func TestZoomRulesDropBelowMin(t *testing.T) {
+	rules := parseZoomRules(`{"buildings":{"minzoom":13},"pois":{"minzoom":15}}`, t)
+
+	assertZoomRules(rules, 12,
+		map[string]bool{"buildings": true, "pois": true, "water": true},
+		map[string]bool{"water": true},
+		[]string{"buildings", "pois"}, t)
+
+	assertZoomRules(rules, 13,
+		map[string]bool{"buildings": true, "pois": true, "water": true},
+		map[string]bool{"buildings": true, "water": true},
+		[]string{"pois"}, t)
+}
+
+func TestZoomRulesDropAboveMax(t *testing.T) {
+	rules := parseZoomRules(`{"earth":{"maxzoom":8}}`, t)
+
+	assertZoomRules(rules, 8, map[string]bool{"earth": true}, map[string]bool{"earth": true}, nil, t)
+	assertZoomRules(rules, 9, map[string]bool{"earth": true}, map[string]bool{}, []string{"earth"}, t)
+}
+
+func TestZoomRulesAll(t *testing.T) {
+	rules := parseZoomRules(`{"all":{"minzoom":13}}`, t)
+	// rules for "all" are applied the same as any other layer name.
+	assertZoomRules(rules, 12, map[string]bool{"all": true}, map[string]bool{}, []string{"all"}, t)
+
+	// rules for the layers in "all" exclude them from it, whether they were also requested by name or not.
+	rules = parseZoomRules(`{"buildings":{"minzoom":13},"pois":{"minzoom":15}}`, t)
+	assertZoomRules(rules, 12,
+		map[string]bool{"all": true, "pois": true},
+		map[string]bool{"all": true, "buildings": false, "pois": false},
+		[]string{"buildings", "pois"}, t)
+	assertZoomRules(rules, 13, map[string]bool{"all": true}, map[string]bool{"all": true, "pois": false}, []string{"pois"}, t)
+}